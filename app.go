@@ -1,6 +1,7 @@
 package zfiber
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/bytedance/sonic"
@@ -19,7 +20,9 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 const LoggerFormat = "${respHeader:X-Request-ID} ${method} ${status} ${path} ${ip} ${queryParams} ${body} -> ${resBody} ${latency}\n"
@@ -45,9 +48,14 @@ type Middleware struct {
 	LoggerRespMax int      `json:"logger_resp_max,omitempty" yaml:"logger_resp_max,omitempty"`
 }
 
+var svrConf = new(Config)
+
 type App struct {
 	app       *fiber.App
 	shutdowns []func()
+	closers   []func()
+	warmups   []func(context.Context) error
+	ready     atomic.Bool
 	addr      string
 }
 
@@ -66,19 +74,26 @@ func NewApp(ops Options, cfs ...fiber.Config) *App {
 		zants.New(ants)
 	}
 	// 初始化zch
+	var closers []func()
 	if ch := ops.ZchOptions(); ch != nil {
 		zch.NewL2(ch)
 		// 初始化ID生成器
-		zid.AutoWorkerId(zch.V(), nil)
+		zid.AutoWorkerId(zch.S(), nil)
+		// 请求处理完后保存L1快照并关闭缓存
+		closers = append(closers, func() {
+			if err := zch.L().Close(); err != nil {
+				zlog.Warnf("close zch failed: %v", err)
+			}
+		})
 	}
 	// 初始化zdb
-	if db, dts := ops.ZdbOptions(); db != nil {
+	db, dts := ops.ZdbOptions()
+	if db != nil {
 		zdb.New(db, dts...)
 	}
 	// 服务配置
-	svrConf := ops.ServerOptions()
-	if svrConf == nil {
-		svrConf = new(Config)
+	if conf := ops.ServerOptions(); conf != nil {
+		svrConf = conf
 	}
 
 	// fiber
@@ -104,9 +119,31 @@ func NewApp(ops Options, cfs ...fiber.Config) *App {
 	app.Use(requestid.New(requestid.Config{Generator: zid.NextIdShort}))
 	// 日志中间件
 	app.Use(logger.New(loggerConfig(svrConf.Middleware)))
+	// 请求ID写入ctx，供审计日志记录
+	if db != nil {
+		app.Use(func(c fiber.Ctx) error {
+			c.SetContext(zdb.WithRequestId(c.Context(), requestid.FromContext(c)))
+			return c.Next()
+		})
+	}
+	// 读己之写，请求内写入后的读取走主库
+	if db != nil && len(db.Replicas) > 0 {
+		app.Use(func(c fiber.Ctx) error {
+			c.SetContext(zdb.WithSticky(c.Context()))
+			return c.Next()
+		})
+	}
 
-	return &App{app: app, addr: zutil.FirstTruth(svrConf.Addr, ":3000")}
+	return &App{app: app, closers: closers, addr: zutil.FirstTruth(svrConf.Addr, ":3000")}
 }
+
+// Domain
+// @Description: 服务域名，供cookie等组件作为默认值
+// @return string
+func Domain() string {
+	return svrConf.Domain
+}
+
 func (s *App) Use(args ...any) *App {
 	s.app.Use(args...)
 	return s
@@ -119,9 +156,38 @@ func (s *App) Shutdown(shutdown func()) *App {
 	s.shutdowns = append(s.shutdowns, shutdown)
 	return s
 }
+
+// Warmup
+// @Description: 预热钩子，如 zch.Warm 预取热点key；全部执行完成前health返回503，避免流量打到冷实例
+// @receiver s
+// @param fn
+// @return *App
+func (s *App) Warmup(fn func(ctx context.Context) error) *App {
+	s.warmups = append(s.warmups, fn)
+	return s
+}
+
+// warmup
+// @Description: 依次执行预热钩子，失败只记录日志，最长等待1分钟
+// @receiver s
+func (s *App) warmup() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, fn := range s.warmups {
+		if err := fn(ctx); err != nil {
+			zlog.Warnf("warmup failed: %v", err)
+		}
+	}
+	s.ready.Store(true)
+	zlog.Infof(">> ready")
+}
+
 func (s *App) Listen(config ...fiber.ListenConfig) {
 	// 默认路由
 	s.app.Get("health", func(c fiber.Ctx) error {
+		if !s.ready.Load() {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("warming")
+		}
 		return c.SendString("ok")
 	})
 
@@ -133,6 +199,7 @@ func (s *App) Listen(config ...fiber.ListenConfig) {
 		_ = s.app.Listen(s.addr, config[0])
 	}()
 	zlog.Infof(">> listening on %s", s.addr)
+	go s.warmup()
 
 	// 等待中断信号关闭服务器, 设置一个60秒的超时
 	quit := make(chan os.Signal, 1)
@@ -145,12 +212,18 @@ func (s *App) Listen(config ...fiber.ListenConfig) {
 	if err := s.app.Shutdown(); err != nil {
 		zlog.Fatalf("serve shutdown failed: %v", err)
 	}
+	for _, closer := range s.closers {
+		closer()
+	}
 	zlog.Infof("serve shutdowned")
 }
 func errorHandler(c fiber.Ctx, err error) error {
 	zlog.Warnf("%s %s %s: %v", requestid.FromContext(c), c.Method(), c.Path(), err)
 
 	code := fiber.StatusInternalServerError
+	if errors.Is(err, zdb.ErrConflict) {
+		return AbortHttpCode(c, fiber.StatusConflict, ErrConflict)
+	}
 	var e *fiber.Error
 	if errors.As(err, &e) {
 		code = e.Code
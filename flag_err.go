@@ -10,6 +10,8 @@ var (
 	ErrParameter      = NewFlag(400, "参数错误")
 	ErrInvalidToken   = NewFlag(401, "登录态失效")
 	ErrInvalidSession = NewFlag(401, "已在其他地方登录，请确认账号密码是否泄露")
+	ErrTenant         = NewFlag(400, "租户无效")
+	ErrConflict       = NewFlag(409, "数据已被修改，请刷新后重试")
 	ErrNil            = NewFlag(500, "未知错误，联系管理员")
 	ErrNotImplemented = NewFlag(501, "暂不支持")
 )
@@ -0,0 +1,65 @@
+package zfiber
+
+import (
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber/zdb"
+	"github.com/zohu/zfiber/zutil"
+	"strings"
+)
+
+// TenantResolver
+// @Description: 从请求中解析租户，解析不到返回空
+type TenantResolver func(c fiber.Ctx) string
+
+// TenantFromHeader
+// @Description: 从请求头解析租户
+// @param name
+// @return TenantResolver
+func TenantFromHeader(name string) TenantResolver {
+	return func(c fiber.Ctx) string {
+		return c.Get(name)
+	}
+}
+
+// TenantFromSubdomain
+// @Description: 从子域名解析租户，配置了Domain时(忽略协议和端口)取Domain之前的最后一级，否则取主机名第一级，如 acme.example.com -> acme
+// @return TenantResolver
+func TenantFromSubdomain() TenantResolver {
+	return func(c fiber.Ctx) string {
+		host := c.Hostname()
+		if d := strings.TrimPrefix(zutil.Host(Domain()), "."); d != "" {
+			sub, ok := strings.CutSuffix(host, "."+d)
+			if !ok {
+				return ""
+			}
+			return sub[strings.LastIndexByte(sub, '.')+1:]
+		}
+		if subs := c.Subdomains(); len(subs) > 0 && subs[0] != "www" {
+			return subs[0]
+		}
+		return ""
+	}
+}
+
+// Tenant
+// @Description: 租户中间件，按顺序取第一个解析到的租户写入请求ctx，之后 zdb.DB(c.Context()) 自动选择租户；
+// 解析不到或租户不合法时返回400；依赖登录信息的解析器需放在认证中间件之后
+// @param resolvers
+// @return fiber.Handler
+func Tenant(resolvers ...TenantResolver) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		for _, resolve := range resolvers {
+			tenant := resolve(c)
+			if tenant == "" {
+				continue
+			}
+			ctx, err := zdb.WithTenant(c.Context(), tenant)
+			if err != nil {
+				return AbortHttpCode(c, fiber.StatusBadRequest, ErrTenant)
+			}
+			c.SetContext(ctx)
+			return c.Next()
+		}
+		return AbortHttpCode(c, fiber.StatusBadRequest, ErrTenant)
+	}
+}
@@ -1,6 +1,7 @@
 package zants
 
 import (
+	"errors"
 	"github.com/panjf2000/ants/v2"
 	"github.com/zohu/zfiber/zlog"
 	"github.com/zohu/zfiber/zutil"
@@ -19,6 +20,8 @@ type PoolStatus struct {
 
 var multiPool *ants.MultiPool
 
+var ErrNotInit = errors.New("zants: pool not initialized")
+
 func New(conf *Config) {
 	size := zutil.FirstTruth(int(conf.MultiSize), 1)
 	preSize := zutil.FirstTruth(int(conf.PoolSize), 10)
@@ -34,11 +37,29 @@ func New(conf *Config) {
 // @Description: 提交一个函数到池中执行
 // @param fn
 func Submit(fn func()) {
-	if err := multiPool.Submit(fn); err != nil {
+	if err := TrySubmit(fn); err != nil {
 		zlog.Errorf("submit fn error: %v", err)
 	}
 }
 
+// TrySubmit
+// @Description: 提交一个函数到池中执行，未初始化或池拒绝时返回错误，fn不会执行
+// @param fn
+// @return error
+func TrySubmit(fn func()) error {
+	if multiPool == nil {
+		return ErrNotInit
+	}
+	return multiPool.Submit(fn)
+}
+
+// Ready
+// @Description: 池是否已初始化
+// @return bool
+func Ready() bool {
+	return multiPool != nil
+}
+
 // Status
 // @Description: 获取池状态
 // @return *PoolStatus
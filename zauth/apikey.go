@@ -0,0 +1,346 @@
+package zauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/dromara/carbon/v2"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zdb"
+	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"gorm.io/gorm"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ApiKeyHeader = "X-API-Key"
+	ApiKeyScheme = "ApiKey "
+	ApiKeyCache  = "ak:"
+	ApiKeyTouch  = "aku:"
+
+	LocalsApiKey = "api_key"
+)
+
+var ErrInvalidApiKey = zfiber.NewFlag(401, "API Key无效")
+
+// ZauthApiKey
+// @Description: 机器客户端的API Key，仅保存密钥哈希
+type ZauthApiKey struct {
+	Id         uint64          `json:"id" gorm:"->;primarykey"`
+	Prefix     string          `json:"prefix" gorm:"unique;comment:公开前缀"`
+	Hash       string          `json:"-" gorm:"comment:密钥哈希"`
+	Name       string          `json:"name" gorm:"comment:名称"`
+	Owner      string          `json:"owner" gorm:"index;comment:所属主体ID"`
+	Value      string          `json:"-" gorm:"comment:主体数据"`
+	Scopes     string          `json:"scopes" gorm:"comment:权限范围，逗号分隔"`
+	AllowIps   string          `json:"allow_ips" gorm:"comment:IP白名单，逗号分隔，支持CIDR"`
+	ExpiresAt  *time.Time      `json:"expires_at" gorm:"comment:过期时间"`
+	LastUsedAt *time.Time      `json:"last_used_at" gorm:"comment:最后使用时间"`
+	RevokedAt  *time.Time      `json:"revoked_at" gorm:"comment:吊销时间"`
+	CreatedAt  carbon.DateTime `json:"createdAt"`
+	UpdatedAt  carbon.DateTime `json:"updatedAt"`
+}
+
+// HasScope
+// @Description: 是否拥有全部权限范围，*表示全部
+// @receiver k
+// @param scopes
+// @return bool
+func (k *ZauthApiKey) HasScope(scopes ...string) bool {
+	owned := strings.Split(k.Scopes, ",")
+	if slices.Contains(owned, "*") {
+		return true
+	}
+	for _, s := range scopes {
+		if !slices.Contains(owned, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowIp
+// @Description: 校验IP白名单，为空则不限制
+// @receiver k
+// @param ip
+// @return bool
+func (k *ZauthApiKey) allowIp(ip string) bool {
+	if strings.TrimSpace(k.AllowIps) == "" {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	for _, item := range strings.Split(k.AllowIps, ",") {
+		item = strings.TrimSpace(item)
+		if _, cidr, err := net.ParseCIDR(item); err == nil {
+			if addr != nil && cidr.Contains(addr) {
+				return true
+			}
+		} else if item == ip {
+			return true
+		}
+	}
+	return false
+}
+
+type ReqApiKey struct {
+	Name     string        `json:"name" validate:"required" note:"名称"`
+	Owner    string        `json:"owner" validate:"required" note:"所属主体ID"`
+	Scopes   []string      `json:"scopes" note:"权限范围"`
+	AllowIps []string      `json:"allow_ips" note:"IP白名单，支持CIDR"`
+	Expire   time.Duration `json:"expire" note:"有效期，0则永久"`
+}
+
+// CreateApiKey
+// @Description: 创建API Key，明文只在此返回一次，value为通过Auth[T]取到的主体数据
+// @param ctx
+// @param h
+// @param value
+// @return string 明文key
+// @return *ZauthApiKey
+// @return error
+func CreateApiKey[T any](ctx context.Context, h *ReqApiKey, value T) (string, *ZauthApiKey, error) {
+	if err := zfiber.Validator().Struct(h); err != nil {
+		return "", nil, err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	prefix := fmt.Sprintf("%s_%s", conf.ApiKeyPrefix, strings.ToLower(b32.EncodeToString(b[:5])))
+	val, err := sonic.MarshalString(value)
+	if err != nil {
+		return "", nil, err
+	}
+	rec := &ZauthApiKey{
+		Prefix:   prefix,
+		Hash:     apiKeyHash(secret),
+		Name:     h.Name,
+		Owner:    h.Owner,
+		Value:    val,
+		Scopes:   strings.Join(h.Scopes, ","),
+		AllowIps: strings.Join(h.AllowIps, ","),
+	}
+	if h.Expire > 0 {
+		rec.ExpiresAt = zutil.Ptr(time.Now().Add(h.Expire))
+	}
+	if err = zdb.DB(ctx).Create(rec).Error; err != nil {
+		return "", nil, err
+	}
+	// 清掉可能存在的未命中缓存
+	_ = store.Del(ctx, conf.key(ApiKeyCache+prefix))
+	return prefix + "." + secret, rec, nil
+}
+
+// RevokeApiKey
+// @Description: 吊销API Key，缓存写入吊销记录，避免并发回源把吊销前的数据写回缓存
+// @param ctx
+// @param prefix
+// @return error
+func RevokeApiKey(ctx context.Context, prefix string) error {
+	now := time.Now()
+	if err := zdb.DB(ctx).Model(&ZauthApiKey{}).Where("prefix=?", prefix).Update("revoked_at", now).Error; err != nil {
+		return err
+	}
+	return revokeApiKeyCache(ctx, prefix, now)
+}
+
+func revokeApiKeyCache(ctx context.Context, prefix string, at time.Time) error {
+	str, _ := sonic.MarshalString(&cachedApiKey{ZauthApiKey: &ZauthApiKey{Prefix: prefix, RevokedAt: &at}})
+	return store.Set(ctx, conf.key(ApiKeyCache+prefix), str, conf.ApiKeyCacheAge)
+}
+
+// ListApiKeys
+// @Description: 查询主体下的API Key
+// @param ctx
+// @param owner
+// @return []ZauthApiKey
+// @return error
+func ListApiKeys(ctx context.Context, owner string) ([]ZauthApiKey, error) {
+	var list []ZauthApiKey
+	err := zdb.DB(ctx).Where("owner=?", owner).Order("id desc").Find(&list).Error
+	return list, err
+}
+
+// ApiKeyFromCtx
+// @Description: 当前请求使用的API Key，非API Key请求返回nil
+// @param c
+// @return *ZauthApiKey
+func ApiKeyFromCtx(c fiber.Ctx) *ZauthApiKey {
+	if k, ok := c.Locals(LocalsApiKey).(*ZauthApiKey); ok {
+		return k
+	}
+	return nil
+}
+
+// RequireScopes
+// @Description: 要求API Key拥有指定权限范围，非API Key请求直接放行
+// @param scopes
+// @return fiber.Handler
+func RequireScopes(scopes ...string) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if k := ApiKeyFromCtx(c); k != nil && !k.HasScope(scopes...) {
+			return zfiber.AbortHttpCode(c, fiber.StatusForbidden, zfiber.NewFlag(403, "权限不足"))
+		}
+		return c.Next()
+	}
+}
+
+// apiKeyFromRequest
+// @Description: 从X-API-Key或Authorization: ApiKey xxx中提取
+// @param c
+// @return string
+func apiKeyFromRequest(c fiber.Ctx) string {
+	if k := c.Get(ApiKeyHeader); k != "" {
+		return strings.TrimSpace(k)
+	}
+	if a := c.Get("Authorization"); strings.HasPrefix(a, ApiKeyScheme) {
+		return strings.TrimSpace(strings.TrimPrefix(a, ApiKeyScheme))
+	}
+	return ""
+}
+
+// verifyApiKey
+// @Description: 校验API Key并存储主体数据，优先读二级缓存
+// @param c
+// @param raw
+// @return zfiber.RespBean
+// @return bool
+func verifyApiKey[T any](c fiber.Ctx, raw string) (zfiber.RespBean, bool) {
+	prefix, secret, ok := strings.Cut(raw, ".")
+	if !ok || prefix == "" || secret == "" {
+		return ErrInvalidApiKey, false
+	}
+	rec, err := loadApiKey(c.Context(), prefix)
+	if err != nil {
+		return ErrInvalidApiKey, false
+	}
+	if subtle.ConstantTimeCompare([]byte(rec.Hash), []byte(apiKeyHash(secret))) != 1 {
+		return ErrInvalidApiKey, false
+	}
+	if rec.RevokedAt != nil || (rec.ExpiresAt != nil && rec.ExpiresAt.Before(time.Now())) {
+		return ErrInvalidApiKey, false
+	}
+	if !rec.allowIp(c.IP()) {
+		return ErrInvalidApiKey, false
+	}
+	var value T
+	if err = sonic.UnmarshalString(rec.Value, &value); err != nil {
+		return ErrInvalidApiKey, false
+	}
+	c.Locals(LocalsUserKey, &value)
+	c.Locals(LocalsApiKey, rec)
+	c.SetContext(zdb.WithActor(c.Context(), rec.Owner))
+	touchApiKey(c.Context(), rec)
+	return zfiber.RespBean{}, true
+}
+
+// loadApiKey
+// @Description: 读取API Key，不存在的前缀短暂缓存，避免随机前缀穿透到数据库
+// @param ctx
+// @param prefix
+// @return *ZauthApiKey
+// @return error
+func loadApiKey(ctx context.Context, prefix string) (*ZauthApiKey, error) {
+	key := conf.key(ApiKeyCache + prefix)
+	rec := new(ZauthApiKey)
+	if v, err := store.Get(ctx, key); err == nil {
+		cached := &cachedApiKey{ZauthApiKey: rec}
+		if err = sonic.UnmarshalString(v, cached); err == nil {
+			if cached.Hash == "" && rec.RevokedAt == nil {
+				return nil, gorm.ErrRecordNotFound
+			}
+			rec.Hash, rec.Value = cached.Hash, cached.Value
+			return rec, nil
+		}
+	}
+	if err := zdb.DB(ctx).Where("prefix=?", prefix).First(rec).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			str, _ := sonic.MarshalString(&cachedApiKey{ZauthApiKey: &ZauthApiKey{Prefix: prefix}})
+			_, _ = store.SetNX(ctx, key, str, conf.ApiKeyMissAge)
+		}
+		return nil, err
+	}
+	cacheApiKey(ctx, rec)
+	return rec, nil
+}
+
+// cacheApiKey
+// @Description: 回填缓存，已存在(如并发写入的吊销记录)时不覆盖
+// @param ctx
+// @param rec
+func cacheApiKey(ctx context.Context, rec *ZauthApiKey) {
+	// json忽略了hash和value，缓存需要完整数据
+	str, _ := sonic.MarshalString(&cachedApiKey{ZauthApiKey: rec, Hash: rec.Hash, Value: rec.Value})
+	_, _ = store.SetNX(ctx, conf.key(ApiKeyCache+rec.Prefix), str, conf.ApiKeyCacheAge)
+}
+
+type cachedApiKey struct {
+	*ZauthApiKey
+	Hash  string `json:"hash"`
+	Value string `json:"value"`
+}
+
+// touchApiKey
+// @Description: 更新最后使用时间并回写缓存，每分钟最多一次；沿用请求ctx中的租户，不随请求结束取消
+// @param ctx
+// @param rec
+func touchApiKey(ctx context.Context, rec *ZauthApiKey) {
+	now := time.Now()
+	if rec.LastUsedAt != nil && now.Sub(*rec.LastUsedAt) < time.Minute {
+		return
+	}
+	rec.LastUsedAt = &now
+	cp := *rec
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if ok, err := store.SetNX(ctx, conf.key(ApiKeyTouch+cp.Prefix), "1", time.Minute); err != nil || !ok {
+			return
+		}
+		res := zdb.DB(ctx).Model(&ZauthApiKey{}).Where("id=? AND revoked_at IS NULL", cp.Id).UpdateColumn("last_used_at", now)
+		if res.Error != nil {
+			zlog.Warnf("update api key last used failed: %v", res.Error)
+			return
+		}
+		if res.RowsAffected == 0 {
+			return
+		}
+		refreshApiKeyCache(ctx, &cp)
+	}()
+}
+
+// refreshApiKeyCache
+// @Description: 覆盖缓存中的记录；写入后再确认未被吊销，并发吊销时补写吊销记录，不会被覆盖
+// @param ctx
+// @param rec
+func refreshApiKeyCache(ctx context.Context, rec *ZauthApiKey) {
+	str, _ := sonic.MarshalString(&cachedApiKey{ZauthApiKey: rec, Hash: rec.Hash, Value: rec.Value})
+	if err := store.Set(ctx, conf.key(ApiKeyCache+rec.Prefix), str, conf.ApiKeyCacheAge); err != nil {
+		return
+	}
+	var cur ZauthApiKey
+	if err := zdb.Primary(ctx).Select("revoked_at").Where("id=?", rec.Id).First(&cur).Error; err != nil {
+		// 无法确认时删除缓存，下次回源
+		_ = store.Del(ctx, conf.key(ApiKeyCache+rec.Prefix))
+		return
+	}
+	if cur.RevokedAt != nil {
+		_ = revokeApiKeyCache(ctx, rec.Prefix, *cur.RevokedAt)
+	}
+}
+
+func apiKeyHash(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
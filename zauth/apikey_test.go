@@ -0,0 +1,127 @@
+package zauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/bytedance/sonic"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zch"
+	"github.com/zohu/zfiber/zutil"
+	"gorm.io/gorm"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApiKeyRules(t *testing.T) {
+	k := &ZauthApiKey{Scopes: "order:read,order:write", AllowIps: "10.0.0.0/8, 1.2.3.4"}
+	if !k.HasScope("order:read") || k.HasScope("order:read", "user:read") {
+		t.Errorf("HasScope mismatch for %s", k.Scopes)
+	}
+	var args = []struct {
+		ip     string
+		result bool
+	}{
+		{"10.1.2.3", true},
+		{"1.2.3.4", true},
+		{"1.2.3.5", false},
+		{"", false},
+	}
+	for _, arg := range args {
+		if r := k.allowIp(arg.ip); r != arg.result {
+			t.Errorf("allowIp(%s) = %v; want %v", arg.ip, r, arg.result)
+		}
+	}
+	if !(&ZauthApiKey{Scopes: "*"}).HasScope("any") || !(&ZauthApiKey{}).allowIp("8.8.8.8") {
+		t.Errorf("wildcard scope or empty allow list rejected")
+	}
+}
+
+type apiKeyUser struct {
+	Name string `json:"name"`
+}
+
+// apiKeyApp
+// @Description: 开启API Key的测试应用，记录预先写入缓存，不依赖数据库
+// @param t
+// @return func(header, value string) zfiber.RespBean
+func apiKeyApp(t *testing.T) func(header, value string) zfiber.RespBean {
+	zch.NewMemoryL2()
+	store = zch.S()
+	conf = &Config{ApiKey: true}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Use(Guard[apiKeyUser](PolicyRequired))
+	app.Get("/me", func(c fiber.Ctx) error {
+		u, err := Auth[apiKeyUser](c)
+		if err != nil {
+			return err
+		}
+		return zfiber.Abort(c, zfiber.NewData(u))
+	})
+	return func(header, value string) zfiber.RespBean {
+		req := httptest.NewRequest(fiber.MethodGet, "/me", nil)
+		req.Header.Set(header, value)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		var bean zfiber.RespBean
+		_ = json.Unmarshal(b, &bean)
+		return bean
+	}
+}
+
+func seedApiKey(prefix, secret string, expires *time.Time) {
+	now := time.Now()
+	cacheApiKey(context.Background(), &ZauthApiKey{
+		Id:         1,
+		Prefix:     prefix,
+		Hash:       apiKeyHash(secret),
+		Owner:      "u1",
+		Value:      `{"name":"bot"}`,
+		ExpiresAt:  expires,
+		LastUsedAt: &now,
+	})
+}
+
+func TestApiKeyMiddleware(t *testing.T) {
+	call := apiKeyApp(t)
+	seedApiKey("zk_a", "secret", nil)
+	for header, value := range map[string]string{ApiKeyHeader: "zk_a.secret", "Authorization": ApiKeyScheme + "zk_a.secret"} {
+		r := call(header, value)
+		if name, _ := r.Data.(map[string]any)["name"].(string); name != "bot" {
+			t.Errorf("GET /me with %s = %+v; want bot", header, r)
+		}
+	}
+	if r := call(ApiKeyHeader, "zk_a.wrong"); r.Code != ErrInvalidApiKey.Code {
+		t.Errorf("GET /me with wrong secret = %+v; want invalid api key", r)
+	}
+
+	seedApiKey("zk_b", "secret", zutil.Ptr(time.Now().Add(-time.Second)))
+	if r := call(ApiKeyHeader, "zk_b.secret"); r.Code != ErrInvalidApiKey.Code {
+		t.Errorf("GET /me with expired key = %+v; want invalid api key", r)
+	}
+
+	// 吊销后并发回源写回的旧数据不能覆盖吊销记录
+	if err := revokeApiKeyCache(context.Background(), "zk_a", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	seedApiKey("zk_a", "secret", nil)
+	if r := call(ApiKeyHeader, "zk_a.secret"); r.Code != ErrInvalidApiKey.Code {
+		t.Errorf("GET /me with revoked key = %+v; want invalid api key", r)
+	}
+
+	// 缓存的未命中记录不回源
+	miss, _ := sonic.MarshalString(&cachedApiKey{ZauthApiKey: &ZauthApiKey{Prefix: "zk_x"}})
+	_ = store.Set(context.Background(), conf.key(ApiKeyCache+"zk_x"), miss, conf.ApiKeyMissAge)
+	if _, err := loadApiKey(context.Background(), "zk_x"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("loadApiKey(zk_x) = %v; want %v", err, gorm.ErrRecordNotFound)
+	}
+}
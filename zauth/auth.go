@@ -1,23 +1,27 @@
 package zauth
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/bytedance/sonic"
 	"github.com/gofiber/fiber/v3"
-	"github.com/valkey-io/valkey-go"
 	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zch"
 	"github.com/zohu/zfiber/zcpt"
+	"github.com/zohu/zfiber/zdb"
 	"github.com/zohu/zfiber/zid"
 	"github.com/zohu/zfiber/zlog"
 	"github.com/zohu/zfiber/zutil"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Authorization[T any] struct {
 	Session string `json:"session"`
+	Csrf    string `json:"csrf,omitempty"`
 	Value   T      `json:"value"`
 }
 
@@ -26,19 +30,23 @@ const (
 	AESKey    = "315c2wd6vpc7q4hx"
 	TokenKey  = "tk:"
 
-	LocalsUserKey    = "user"
-	LocalsSessionKey = "session"
+	LocalsUserKey       = "user"
+	LocalsSessionKey    = "session"
+	LocalsCsrfKey       = "csrf"
+	LocalsFromCookieKey = "auth_from_cookie"
 )
 
+var ErrInvalidCsrf = zfiber.NewFlag(403, "csrf校验失败")
+
 var conf = &Config{}
-var vk valkey.Client
+var store zch.Store
 
-func New[T any](client valkey.Client, ops *Config) fiber.Handler {
-	if client == nil {
-		zlog.Fatalf("valkey is nil")
+func New[T any](s zch.Store, ops *Config) fiber.Handler {
+	if s == nil {
+		zlog.Fatalf("zch store is nil")
 		return nil
 	}
-	vk = client
+	store = s
 	if ops != nil {
 		conf = ops
 	}
@@ -46,104 +54,184 @@ func New[T any](client valkey.Client, ops *Config) fiber.Handler {
 		zlog.Fatalf("validate auth config failed: %v", err)
 		return nil
 	}
-	return func(c fiber.Ctx) error {
-		defer func() {
-			if err := recover(); err != nil {
-				zlog.Errorf("auth panic: %v", err)
-				_ = zfiber.Abort(c, zfiber.ErrInvalidToken)
-			}
-		}()
-		// 过滤白名单
-		if conf.IsWhite(c.Path()) {
-			return c.Next()
-		}
-		// 校验登录态
-		token := zutil.FirstTruth(c.Cookies("auth"), c.Get("Authorization"), c.Query("auth"))
-		if strings.TrimSpace(token) == "" {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
-		}
-		d, err := base64.StdEncoding.DecodeString(token)
-		if err != nil {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
-		}
-		d, err = zcpt.AesDecryptCBC(d, []byte(AESKey))
-		if err != nil {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
-		}
-		tks := strings.Split(string(d), "##")
-		if len(tks) != 5 {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
+	if conf.ApiKey {
+		if err := zdb.AutoMigrate(context.TODO(), &ZauthApiKey{}); err != nil {
+			zlog.Fatalf("init api key table failed: %v", err)
+			return nil
 		}
-		// 校验ua
-		if !conf.AllowUaChange && tks[1] != zcpt.Md5(c.Get(UserAgent)) {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
+	}
+	return func(c fiber.Ctx) error {
+		return handle[T](c, conf.Policy(c.Method(), c.Path()))
+	}
+}
+
+// Guard
+// @Description: 以指定策略鉴权，用于不挂载全局中间件时按路由组鉴权，如 app.Group("/api", zauth.Guard[T](zauth.PolicyRequired))
+// @param policy
+// @return fiber.Handler
+func Guard[T any](policy Policy) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		return handle[T](c, policy)
+	}
+}
+
+var (
+	attachMu sync.RWMutex
+	attached []*rule
+)
+
+// Attach
+// @Description: 为路由组追加策略规则，配合全局中间件使用，patterns为组内相对路径，默认整个组；
+// 与New的先后顺序无关，且优先于白名单和可选登录名单匹配
+// @param r 路由组
+// @param policy
+// @param patterns 格式 [METHOD ]/path
+func Attach(r fiber.Router, policy Policy, patterns ...string) {
+	prefix := ""
+	if g, ok := r.(*fiber.Group); ok {
+		prefix = g.Prefix
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"/*"}
+	}
+	for _, p := range patterns {
+		method := ""
+		if fields := strings.Fields(p); len(fields) == 2 {
+			method, p = fields[0], fields[1]
 		}
-		// 校验ip
-		if !conf.AllowIpChange && tks[2] != c.IP() {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
+		full := strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(p, "/")
+		if ru := parseRule(strings.TrimSpace(method+" "+full), policy); ru != nil {
+			attachMu.Lock()
+			attached = append(attached, ru)
+			attachMu.Unlock()
 		}
+	}
+}
 
-		// 提取用户数据
-		uid := tks[3]
-		vKey := conf.key(TokenKey + uid)
-		userStr, err := vk.Do(c.Context(), vk.B().Get().Key(vKey).Build()).ToString()
-		if err != nil {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
+func handle[T any](c fiber.Ctx, policy Policy) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			zlog.Errorf("auth panic: %v", e)
+			err = zfiber.Abort(c, zfiber.ErrInvalidToken)
 		}
-		var auth Authorization[T]
-		if err = sonic.UnmarshalString(userStr, &auth); err != nil {
-			return zfiber.Abort(c, zfiber.ErrInvalidToken)
+	}()
+	switch policy {
+	case PolicyPublic:
+		return c.Next()
+	case PolicyOptional:
+		// 可选登录，解析失败也放行
+		_, _ = verify[T](c)
+		return c.Next()
+	default:
+		if flag, ok := verify[T](c); !ok {
+			return zfiber.Abort(c, flag)
 		}
-		// 是否允许多地同时登陆
-		if !conf.MultipleCoexist && auth.Session != zcpt.Md5(token) {
-			return zfiber.Abort(c, zfiber.ErrInvalidSession)
+		return c.Next()
+	}
+}
+
+// verify
+// @Description: 校验登录态并存储用户数据
+// @param c
+// @return zfiber.RespBean 失败时的错误
+// @return bool 是否成功
+func verify[T any](c fiber.Ctx) (zfiber.RespBean, bool) {
+	if conf.ApiKey {
+		if k := apiKeyFromRequest(c); k != "" {
+			return verifyApiKey[T](c, k)
 		}
+	}
+	cookie := c.Cookies("auth")
+	token := zutil.FirstTruth(cookie, c.Get("Authorization"), c.Query("auth"))
+	if strings.TrimSpace(token) == "" {
+		return zfiber.ErrInvalidToken, false
+	}
+	d, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return zfiber.ErrInvalidToken, false
+	}
+	d, err = zcpt.AesDecryptCBC(d, []byte(AESKey))
+	if err != nil {
+		return zfiber.ErrInvalidToken, false
+	}
+	tks := strings.Split(string(d), "##")
+	if len(tks) != 5 {
+		return zfiber.ErrInvalidToken, false
+	}
+	// 校验ua
+	if !conf.AllowUaChange && tks[1] != zcpt.Md5(c.Get(UserAgent)) {
+		return zfiber.ErrInvalidToken, false
+	}
+	// 校验ip
+	if !conf.AllowIpChange && tks[2] != c.IP() {
+		return zfiber.ErrInvalidToken, false
+	}
 
-		// 存储用户数据
-		c.Locals(LocalsUserKey, zutil.Ptr(auth.Value))
-		c.Locals(LocalsSessionKey, auth.Session)
-
-		// 刷新Token有效期
-		c.Cookie(&fiber.Cookie{
-			Expires: time.Now().Add(conf.AuthAge),
-			MaxAge:  int(conf.AuthAge.Seconds()),
-			Name:    "auth",
-			Value:   token,
-		})
-		vk.Do(c.Context(), vk.B().Expire().Key(vKey).Seconds(int64(conf.AuthAge.Seconds())).Build())
-		return c.Next()
+	// 提取用户数据
+	uid := tks[3]
+	vKey := conf.key(TokenKey + uid)
+	userStr, err := store.Get(c.Context(), vKey)
+	if err != nil {
+		return zfiber.ErrInvalidToken, false
+	}
+	var auth Authorization[T]
+	if err = sonic.UnmarshalString(userStr, &auth); err != nil {
+		return zfiber.ErrInvalidToken, false
+	}
+	// 是否允许多地同时登陆
+	if !conf.MultipleCoexist && auth.Session != zcpt.Md5(token) {
+		return zfiber.ErrInvalidSession, false
 	}
+
+	// 旧版本的登录态没有csrf令牌，补充后写回
+	if auth.Csrf == "" {
+		auth.Csrf = newCsrfToken()
+		userStr, _ = sonic.MarshalString(&auth)
+		_ = store.Set(c.Context(), vKey, userStr, conf.AuthAge)
+	}
+
+	// 存储用户数据
+	c.Locals(LocalsUserKey, zutil.Ptr(auth.Value))
+	c.Locals(LocalsSessionKey, auth.Session)
+	c.Locals(LocalsCsrfKey, auth.Csrf)
+	c.Locals(LocalsFromCookieKey, cookie != "")
+	c.SetContext(zdb.WithActor(c.Context(), uid))
+
+	// 刷新Token有效期
+	c.Cookie(conf.cookie("auth", token, true))
+	c.Cookie(conf.cookie(conf.CsrfCookie, auth.Csrf, false))
+	_, _ = store.Expire(c.Context(), vKey, conf.AuthAge)
+	return zfiber.RespBean{}, true
 }
 
 func Login[T any](c fiber.Ctx, uid string, value T) zfiber.RespBean {
 	vKey := conf.key(TokenKey + uid)
 	// 判断是否可以多处登录
 	if !conf.MultipleCoexist {
-		vk.Do(c.Context(), vk.B().Del().Key(vKey).Build())
+		_ = store.Del(c.Context(), vKey)
 	}
 	// 生成登录态
 	tk := fmt.Sprintf("%s##%s##%s##%s##%d", zid.NextIdShort(), zcpt.Md5(c.Get(UserAgent)), c.IP(), uid, time.Now().Unix())
 	d, _ := zcpt.AesEncryptCBC([]byte(tk), []byte(AESKey))
 	token := base64.StdEncoding.EncodeToString(d)
-	c.Cookie(&fiber.Cookie{
-		Expires: time.Now().Add(conf.AuthAge),
-		MaxAge:  int(conf.AuthAge.Seconds()),
-		Name:    "auth",
-		Value:   token,
-	})
-	userStr, _ := sonic.MarshalString(&Authorization[T]{Session: zcpt.Md5(token), Value: value})
-	vk.Do(c.Context(), vk.B().Set().Key(vKey).Value(userStr).Ex(conf.AuthAge).Build())
+	session, csrf := zcpt.Md5(token), newCsrfToken()
+	c.Cookie(conf.cookie("auth", token, true))
+	c.Cookie(conf.cookie(conf.CsrfCookie, csrf, false))
+	userStr, _ := sonic.MarshalString(&Authorization[T]{Session: session, Csrf: csrf, Value: value})
+	_ = store.Set(c.Context(), vKey, userStr, conf.AuthAge)
 	return zfiber.NewData(map[string]string{
 		"token":  token,
+		"csrf":   csrf,
 		"expire": time.Now().Add(conf.AuthAge).Format(time.RFC3339),
 	})
 }
 
 func UpdateAuth[T any](c fiber.Ctx, uid string, value T) {
 	session := c.Locals(LocalsSessionKey).(string)
-	userStr, _ := sonic.MarshalString(&Authorization[T]{Session: session, Value: value})
+	csrf, _ := c.Locals(LocalsCsrfKey).(string)
+	userStr, _ := sonic.MarshalString(&Authorization[T]{Session: session, Csrf: csrf, Value: value})
 	vKey := conf.key(TokenKey + uid)
-	vk.Do(c.Context(), vk.B().Set().Key(vKey).Value(userStr).Ex(conf.AuthAge).Build())
+	_ = store.Set(c.Context(), vKey, userStr, conf.AuthAge)
 }
 
 func Auth[T any](c fiber.Ctx) (*T, error) {
@@ -0,0 +1,124 @@
+package zauth
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zch"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoginWithMemoryStore(t *testing.T) {
+	type user struct {
+		Name string `json:"name"`
+	}
+	zch.NewMemoryL2()
+	app := fiber.New()
+	app.Use(New[user](zch.S(), &Config{WhiteList: []string{"/login"}}))
+	app.Post("/login", func(c fiber.Ctx) error {
+		return zfiber.Abort(c, Login(c, "u1", user{Name: "zoe"}))
+	})
+	app.Get("/me", func(c fiber.Ctx) error {
+		u, err := Auth[user](c)
+		if err != nil {
+			return err
+		}
+		return zfiber.Abort(c, zfiber.NewData(u))
+	})
+
+	call := func(method, path, token string) zfiber.RespBean {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		var bean zfiber.RespBean
+		_ = json.Unmarshal(b, &bean)
+		return bean
+	}
+
+	if r := call(fiber.MethodGet, "/me", ""); r.Code != zfiber.ErrInvalidToken.Code {
+		t.Errorf("GET /me without token = %+v; want invalid token", r)
+	}
+	login := call(fiber.MethodPost, "/login", "")
+	token, _ := login.Data.(map[string]any)["token"].(string)
+	if token == "" {
+		t.Fatalf("POST /login = %+v", login)
+	}
+	me := call(fiber.MethodGet, "/me", token)
+	if name, _ := me.Data.(map[string]any)["name"].(string); name != "zoe" {
+		t.Errorf("GET /me = %+v; want zoe", me)
+	}
+}
+
+func TestCsrf(t *testing.T) {
+	zch.NewMemoryL2()
+	app := fiber.New()
+	app.Use(New[string](zch.S(), &Config{WhiteList: []string{"/login"}, CookieDomain: "example.com"}))
+	app.Use(CSRF())
+	app.Post("/login", func(c fiber.Ctx) error {
+		return zfiber.Abort(c, Login(c, "u1", "zoe"))
+	})
+	app.Post("/action", func(c fiber.Ctx) error {
+		return zfiber.Abort(c, zfiber.NewData(CsrfToken(c)))
+	})
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodPost, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := make(map[string]*http.Cookie)
+	for _, ck := range resp.Cookies() {
+		cookies[ck.Name] = ck
+	}
+	auth, csrf := cookies["auth"], cookies["csrf"]
+	if auth == nil || csrf == nil {
+		t.Fatalf("POST /login cookies = %v; want auth and csrf", resp.Cookies())
+	}
+	for _, ck := range []*http.Cookie{auth, csrf} {
+		if !ck.Secure || ck.SameSite != http.SameSiteLaxMode || ck.Domain != "example.com" || ck.Path != "/" {
+			t.Errorf("cookie %s = %+v; want Secure, SameSite=Lax, Domain=example.com, Path=/", ck.Name, ck)
+		}
+	}
+	if !auth.HttpOnly || csrf.HttpOnly {
+		t.Errorf("HttpOnly auth=%v csrf=%v; want true, false", auth.HttpOnly, csrf.HttpOnly)
+	}
+	if len(csrf.Value) != 64 {
+		t.Errorf("csrf token = %q; want 32 random bytes", csrf.Value)
+	}
+
+	action := func(header map[string]string, withCookie bool) int {
+		req := httptest.NewRequest(fiber.MethodPost, "/action", nil)
+		if withCookie {
+			req.AddCookie(&http.Cookie{Name: "auth", Value: auth.Value})
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if code := action(nil, true); code != fiber.StatusForbidden {
+		t.Errorf("POST /action by cookie without csrf = %d; want 403", code)
+	}
+	if code := action(map[string]string{"X-CSRF-Token": "bad"}, true); code != fiber.StatusForbidden {
+		t.Errorf("POST /action by cookie with bad csrf = %d; want 403", code)
+	}
+	if code := action(map[string]string{"X-CSRF-Token": csrf.Value}, true); code != fiber.StatusOK {
+		t.Errorf("POST /action by cookie with csrf = %d; want 200", code)
+	}
+	// header携带token的客户端不校验csrf
+	if code := action(map[string]string{"Authorization": auth.Value}, false); code != fiber.StatusOK {
+		t.Errorf("POST /action by header = %d; want 200", code)
+	}
+}
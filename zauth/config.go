@@ -3,35 +3,124 @@ package zauth
 import (
 	"fmt"
 	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
 	"github.com/zohu/zfiber/zutil"
 	"strings"
 	"time"
 )
 
 type Config struct {
-	Prefix          string        `json:"prefix" yaml:"prefix" note:"前缀"`
-	AuthAge         time.Duration `json:"auth_age" yaml:"auth_age" note:"过期时间"`
-	MultipleCoexist bool          `json:"multiple_coexist" yaml:"multiple_coexist" note:"是否允许多个设备同时登录"`
-	AllowIpChange   bool          `json:"allow_ip_change" yaml:"allow_ip_change" note:"是否允许ip变化"`
-	AllowUaChange   bool          `json:"allow_ua_change" yaml:"allow_ua_change" note:"是否允许ua变化"`
-	WhiteList       []string      `json:"white_list" yaml:"white_list" note:"白名单"`
+	Prefix           string        `json:"prefix" yaml:"prefix" note:"前缀"`
+	AuthAge          time.Duration `json:"auth_age" yaml:"auth_age" note:"过期时间"`
+	MultipleCoexist  bool          `json:"multiple_coexist" yaml:"multiple_coexist" note:"是否允许多个设备同时登录"`
+	AllowIpChange    bool          `json:"allow_ip_change" yaml:"allow_ip_change" note:"是否允许ip变化"`
+	AllowUaChange    bool          `json:"allow_ua_change" yaml:"allow_ua_change" note:"是否允许ua变化"`
+	WhiteList        []string      `json:"white_list" yaml:"white_list" note:"白名单，格式 [METHOD ]/path，支持*和:param"`
+	OptionalList     []string      `json:"optional_list" yaml:"optional_list" note:"可选登录名单，格式同白名单"`
+	CookieDomain     string        `json:"cookie_domain" yaml:"cookie_domain" note:"cookie域名，默认取服务域名"`
+	CookiePath       string        `json:"cookie_path" yaml:"cookie_path" note:"cookie路径"`
+	CookieSecure     string        `json:"cookie_secure" yaml:"cookie_secure" note:"cookie仅https传输,yes/no"`
+	CookieHttpOnly   string        `json:"cookie_http_only" yaml:"cookie_http_only" note:"cookie禁止js访问,yes/no"`
+	CookieSameSite   string        `json:"cookie_same_site" yaml:"cookie_same_site" note:"cookie跨站策略,lax/strict/none"`
+	CsrfHeader       string        `json:"csrf_header" yaml:"csrf_header" note:"csrf令牌请求头"`
+	CsrfCookie       string        `json:"csrf_cookie" yaml:"csrf_cookie" note:"csrf令牌cookie名"`
+	Totp             bool          `json:"totp" yaml:"totp" note:"是否启用TOTP两步验证，启用时totp_key必填"`
+	TotpIssuer       string        `json:"totp_issuer" yaml:"totp_issuer" note:"TOTP签发方，显示在验证器中"`
+	TotpKey          string        `json:"totp_key" yaml:"totp_key" validate:"omitempty,len=16|len=24|len=32" note:"TOTP密钥落库加密key，16/24/32位"`
+	TotpSkew         int           `json:"totp_skew" yaml:"totp_skew" note:"TOTP允许漂移的周期数"`
+	TotpChallengeAge time.Duration `json:"totp_challenge_age" yaml:"totp_challenge_age" note:"两步登录challenge有效期"`
+	ApiKey           bool          `json:"api_key" yaml:"api_key" note:"是否启用API Key鉴权，依赖zdb和zch"`
+	ApiKeyPrefix     string        `json:"api_key_prefix" yaml:"api_key_prefix" note:"API Key前缀"`
+	ApiKeyCacheAge   time.Duration `json:"api_key_cache_age" yaml:"api_key_cache_age" note:"API Key缓存时间"`
+	ApiKeyMissAge    time.Duration `json:"api_key_miss_age" yaml:"api_key_miss_age" note:"不存在的API Key缓存时间"`
+
+	rules []*rule
 }
 
 func (c *Config) Validate() error {
 	c.Prefix = zutil.FirstTruth(c.Prefix, "auth")
 	c.AuthAge = zutil.FirstTruth(c.AuthAge, time.Hour*2)
-	for i, p := range c.WhiteList {
-		c.WhiteList[i] = strings.TrimSpace(strings.TrimPrefix(p, "/"))
+	c.CookieDomain = zutil.FirstTruth(c.CookieDomain, zutil.Host(zfiber.Domain()))
+	c.CookiePath = zutil.FirstTruth(c.CookiePath, "/")
+	c.CookieSecure = zutil.FirstTruth(c.CookieSecure, "yes")
+	c.CookieHttpOnly = zutil.FirstTruth(c.CookieHttpOnly, "yes")
+	c.CookieSameSite = zutil.FirstTruth(c.CookieSameSite, fiber.CookieSameSiteLaxMode)
+	c.CsrfHeader = zutil.FirstTruth(c.CsrfHeader, "X-CSRF-Token")
+	c.CsrfCookie = zutil.FirstTruth(c.CsrfCookie, "csrf")
+	c.TotpIssuer = zutil.FirstTruth(c.TotpIssuer, "zfiber")
+	c.TotpSkew = zutil.FirstTruth(c.TotpSkew, 1)
+	c.TotpChallengeAge = zutil.FirstTruth(c.TotpChallengeAge, 5*time.Minute)
+	c.ApiKeyPrefix = zutil.FirstTruth(c.ApiKeyPrefix, "zk")
+	c.ApiKeyCacheAge = zutil.FirstTruth(c.ApiKeyCacheAge, 5*time.Minute)
+	c.ApiKeyMissAge = zutil.FirstTruth(c.ApiKeyMissAge, 30*time.Second)
+	c.rules = c.rules[:0]
+	for _, p := range c.WhiteList {
+		if r := parseRule(p, PolicyPublic); r != nil {
+			c.rules = append(c.rules, r)
+		}
+	}
+	for _, p := range c.OptionalList {
+		if r := parseRule(p, PolicyOptional); r != nil {
+			c.rules = append(c.rules, r)
+		}
+	}
+	if c.Totp && c.TotpKey == "" {
+		return ErrNoTotpKey
 	}
 	return validator.New().Struct(c)
 }
-func (c *Config) IsWhite(path string) bool {
-	for _, w := range c.WhiteList {
-		if strings.HasPrefix(w, strings.TrimPrefix(path, "/")) {
-			return true
+
+// Policy
+// @Description: 匹配请求的鉴权策略，先匹配Attach的规则，再匹配配置的名单，未命中任何规则则必须登录
+// @receiver c
+// @param method
+// @param path
+// @return Policy
+func (c *Config) Policy(method, path string) Policy {
+	attachMu.RLock()
+	defer attachMu.RUnlock()
+	for _, r := range attached {
+		if r.match(method, path) {
+			return r.policy
 		}
 	}
-	return false
+	for _, r := range c.rules {
+		if r.match(method, path) {
+			return r.policy
+		}
+	}
+	return PolicyRequired
+}
+
+// IsWhite
+// @Description: 是否白名单，仅匹配未限定METHOD的规则
+// @receiver c
+// @param path
+// @return bool
+func (c *Config) IsWhite(path string) bool {
+	return c.Policy("", path) == PolicyPublic
+}
+
+// cookie
+// @Description: 按配置生成cookie
+// @receiver c
+// @param name
+// @param value
+// @param httpOnly 是否禁止js访问，csrf令牌需要js读取
+// @return *fiber.Cookie
+func (c *Config) cookie(name, value string, httpOnly bool) *fiber.Cookie {
+	return &fiber.Cookie{
+		Expires:  time.Now().Add(c.AuthAge),
+		MaxAge:   int(c.AuthAge.Seconds()),
+		Name:     name,
+		Value:    value,
+		Path:     c.CookiePath,
+		Domain:   c.CookieDomain,
+		SameSite: c.CookieSameSite,
+		Secure:   c.CookieSecure == "yes",
+		HTTPOnly: httpOnly && c.CookieHttpOnly == "yes",
+	}
 }
 func (c *Config) key(k string) string {
 	return fmt.Sprintf("%s:%s", strings.TrimSuffix(c.Prefix, ":"), k)
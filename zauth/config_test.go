@@ -0,0 +1,69 @@
+package zauth
+
+import (
+	"github.com/gofiber/fiber/v3"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	c := &Config{
+		WhiteList:    []string{"/login", "public/*", "GET /files/:fid", "/static/*.png"},
+		OptionalList: []string{"/home"},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var args = []struct {
+		method string
+		path   string
+		result Policy
+	}{
+		{"GET", "/", PolicyRequired},
+		{"GET", "/log", PolicyRequired},
+		{"POST", "/login", PolicyPublic},
+		{"POST", "/login/x", PolicyRequired},
+		{"GET", "/public", PolicyPublic},
+		{"GET", "/public/a/b", PolicyPublic},
+		{"GET", "/files/123", PolicyPublic},
+		{"DELETE", "/files/123", PolicyRequired},
+		{"GET", "/files/123/x", PolicyRequired},
+		{"GET", "/static/a.png", PolicyPublic},
+		{"GET", "/static/a.js", PolicyRequired},
+		{"GET", "/home", PolicyOptional},
+	}
+	for _, arg := range args {
+		if r := c.Policy(arg.method, arg.path); r != arg.result {
+			t.Errorf("Policy(%s,%s) = %d; want %d", arg.method, arg.path, r, arg.result)
+		}
+	}
+	if c.IsWhite("/") {
+		t.Errorf("IsWhite(/) = true; want false")
+	}
+}
+
+func TestAttach(t *testing.T) {
+	defer func() { attached = nil }()
+	app := fiber.New()
+	// 先于配置校验挂载，校验后规则仍然保留
+	Attach(app.Group("/api/admin"), PolicyRequired)
+	Attach(app.Group("/api"), PolicyOptional, "GET /feed")
+	c := &Config{WhiteList: []string{"/api/*"}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var args = []struct {
+		method string
+		path   string
+		result Policy
+	}{
+		{"GET", "/api/admin/users", PolicyRequired},
+		{"GET", "/api/feed", PolicyOptional},
+		{"POST", "/api/feed", PolicyPublic},
+		{"GET", "/api/other", PolicyPublic},
+	}
+	for _, arg := range args {
+		if r := c.Policy(arg.method, arg.path); r != arg.result {
+			t.Errorf("Policy(%s,%s) = %d; want %d", arg.method, arg.path, r, arg.result)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package zauth
+
+import (
+	"context"
+	"errors"
+	"github.com/zohu/zfiber/zch"
+	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	limitFailKey    = "lf:"
+	limitBackoffKey = "lb:"
+	limitLockKey    = "ll:"
+)
+
+// LimiterConfig
+// @Description: 登录防爆破配置
+type LimiterConfig struct {
+	MaxFailures     int64                                          `json:"max_failures" yaml:"max_failures" note:"账号连续失败N次后锁定"`
+	CaptchaFailures int64                                          `json:"captcha_failures" yaml:"captcha_failures" note:"账号连续失败M次后要求验证码"`
+	IpMaxFailures   int64                                          `json:"ip_max_failures" yaml:"ip_max_failures" note:"同一IP失败次数上限"`
+	LockDuration    time.Duration                                  `json:"lock_duration" yaml:"lock_duration" note:"锁定时长"`
+	Window          time.Duration                                  `json:"window" yaml:"window" note:"失败计数窗口"`
+	BackoffBase     time.Duration                                  `json:"backoff_base" yaml:"backoff_base" note:"退避基数，第n次失败后需等待 base*2^(n-1)"`
+	OnLockout       func(ctx context.Context, event *LockoutEvent) `json:"-" yaml:"-"`
+}
+
+func (c *LimiterConfig) Validate() {
+	c.MaxFailures = zutil.FirstTruth(c.MaxFailures, 10)
+	c.CaptchaFailures = zutil.FirstTruth(c.CaptchaFailures, 3)
+	c.IpMaxFailures = zutil.FirstTruth(c.IpMaxFailures, 100)
+	c.LockDuration = zutil.FirstTruth(c.LockDuration, 30*time.Minute)
+	c.Window = zutil.FirstTruth(c.Window, time.Hour)
+	c.BackoffBase = zutil.FirstTruth(c.BackoffBase, time.Second)
+}
+
+// LockoutEvent
+// @Description: 锁定审计事件
+type LockoutEvent struct {
+	Account  string    `json:"account"`
+	Ip       string    `json:"ip"`
+	Failures int64     `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// LimitStatus
+// @Description: 登录限制状态
+type LimitStatus struct {
+	Locked          bool          `json:"locked" note:"是否已锁定"`
+	RetryAfter      time.Duration `json:"retry_after" note:"需等待的时长"`
+	CaptchaRequired bool          `json:"captcha_required" note:"是否需要验证码"`
+	Failures        int64         `json:"failures" note:"账号失败次数"`
+}
+
+// Allowed
+// @Description: 是否允许本次登录尝试
+// @receiver s
+// @return bool
+func (s *LimitStatus) Allowed() bool {
+	return !s.Locked && s.RetryAfter <= 0
+}
+
+type Limiter struct {
+	store zch.Store
+	conf  *LimiterConfig
+}
+
+// NewLimiter
+// @Description: 创建登录防爆破限制器
+// @param store
+// @param ops
+// @return *Limiter
+func NewLimiter(store zch.Store, ops *LimiterConfig) *Limiter {
+	if store == nil {
+		zlog.Fatalf("limiter store is nil")
+		return nil
+	}
+	if ops == nil {
+		ops = &LimiterConfig{}
+	}
+	ops.Validate()
+	return &Limiter{store: store, conf: ops}
+}
+
+// Check
+// @Description: 登录前检查，校验密码前调用
+// @receiver l
+// @param ctx
+// @param account
+// @param ip
+// @return *LimitStatus
+// @return error
+func (l *Limiter) Check(ctx context.Context, account, ip string) (*LimitStatus, error) {
+	st := &LimitStatus{}
+	for _, k := range []string{l.key(limitLockKey, "a", account), l.key(limitLockKey, "i", ip)} {
+		ttl, err := l.ttl(ctx, k)
+		if err != nil {
+			return nil, err
+		}
+		if ttl > 0 {
+			st.Locked = true
+			st.RetryAfter = max(st.RetryAfter, ttl)
+		}
+	}
+	ttl, err := l.ttl(ctx, l.key(limitBackoffKey, "a", account))
+	if err != nil {
+		return nil, err
+	}
+	st.RetryAfter = max(st.RetryAfter, ttl)
+	n, err := l.count(ctx, l.key(limitFailKey, "a", account))
+	if err != nil {
+		return nil, err
+	}
+	st.Failures = n
+	st.CaptchaRequired = n >= l.conf.CaptchaFailures
+	return st, nil
+}
+
+// Fail
+// @Description: 记录一次失败，达到阈值时锁定并发出审计事件
+// @receiver l
+// @param ctx
+// @param account
+// @param ip
+// @return *LimitStatus
+// @return error
+func (l *Limiter) Fail(ctx context.Context, account, ip string) (*LimitStatus, error) {
+	an, err := l.store.Incr(ctx, l.key(limitFailKey, "a", account), l.conf.Window)
+	if err != nil {
+		return nil, err
+	}
+	in, err := l.store.Incr(ctx, l.key(limitFailKey, "i", ip), l.conf.Window)
+	if err != nil {
+		return nil, err
+	}
+	st := &LimitStatus{Failures: an, CaptchaRequired: an >= l.conf.CaptchaFailures}
+
+	// 账号指数退避，IP只计数，避免同一出口下的用户互相影响
+	st.RetryAfter = l.backoff(an)
+	if err = l.store.Set(ctx, l.key(limitBackoffKey, "a", account), "1", st.RetryAfter); err != nil {
+		return nil, err
+	}
+
+	// 锁定
+	if an >= l.conf.MaxFailures {
+		if err = l.lock(ctx, l.key(limitLockKey, "a", account), &LockoutEvent{Account: account, Ip: ip, Failures: an}); err != nil {
+			return nil, err
+		}
+		st.Locked = true
+	}
+	if in >= l.conf.IpMaxFailures {
+		if err = l.lock(ctx, l.key(limitLockKey, "i", ip), &LockoutEvent{Ip: ip, Failures: in}); err != nil {
+			return nil, err
+		}
+		st.Locked = true
+	}
+	if st.Locked {
+		st.RetryAfter = max(st.RetryAfter, l.conf.LockDuration)
+	}
+	return st, nil
+}
+
+// Success
+// @Description: 登录成功或手动解锁时调用，重置账号计数和锁定；IP计数保留至窗口结束，避免攻击者用自有账号清零
+// @receiver l
+// @param ctx
+// @param account
+// @return error
+func (l *Limiter) Success(ctx context.Context, account string) error {
+	return l.store.Del(ctx,
+		l.key(limitFailKey, "a", account),
+		l.key(limitBackoffKey, "a", account),
+		l.key(limitLockKey, "a", account),
+	)
+}
+
+func (l *Limiter) lock(ctx context.Context, key string, event *LockoutEvent) error {
+	event.Until = time.Now().Add(l.conf.LockDuration)
+	if err := l.store.Set(ctx, key, "1", l.conf.LockDuration); err != nil {
+		return err
+	}
+	zlog.Warnf("login locked: account=%s ip=%s failures=%d until=%s", event.Account, event.Ip, event.Failures, event.Until.Format(time.DateTime))
+	if l.conf.OnLockout != nil {
+		l.conf.OnLockout(ctx, event)
+	}
+	return nil
+}
+
+// backoff
+// @Description: 第n次失败后的等待时长，最长不超过锁定时长
+// @receiver l
+// @param n
+// @return time.Duration
+func (l *Limiter) backoff(n int64) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	d := float64(l.conf.BackoffBase) * math.Pow(2, float64(n-1))
+	if d >= float64(l.conf.LockDuration) {
+		return l.conf.LockDuration
+	}
+	return time.Duration(d)
+}
+
+func (l *Limiter) key(kind, scope, id string) string {
+	return conf.key(kind + scope + ":" + id)
+}
+
+// ttl
+// @Description: 剩余有效期，不存在或不过期返回0
+// @receiver l
+// @param ctx
+// @param key
+// @return time.Duration
+// @return error
+func (l *Limiter) ttl(ctx context.Context, key string) (time.Duration, error) {
+	d, err := l.store.TTL(ctx, key)
+	if errors.Is(err, zch.ErrNotFound) || d < 0 {
+		return 0, nil
+	}
+	return d, err
+}
+
+func (l *Limiter) count(ctx context.Context, key string) (int64, error) {
+	v, err := l.store.Get(ctx, key)
+	if errors.Is(err, zch.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
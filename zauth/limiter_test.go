@@ -0,0 +1,56 @@
+package zauth
+
+import (
+	"context"
+	"github.com/zohu/zfiber/zch"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	var events []*LockoutEvent
+	l := NewLimiter(zch.NewMemoryStore(nil), &LimiterConfig{
+		MaxFailures:     3,
+		CaptchaFailures: 2,
+		BackoffBase:     time.Millisecond,
+		LockDuration:    time.Minute,
+		OnLockout: func(ctx context.Context, event *LockoutEvent) {
+			events = append(events, event)
+		},
+	})
+	st, err := l.Fail(ctx, "u1", "1.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Failures != 1 || st.CaptchaRequired || st.Locked || st.RetryAfter != time.Millisecond {
+		t.Errorf("first failure = %+v", st)
+	}
+	if st, _ = l.Check(ctx, "u1", "1.1.1.1"); st.Allowed() {
+		t.Errorf("check during backoff = %+v; want not allowed", st)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if st, _ = l.Check(ctx, "u1", "1.1.1.1"); !st.Allowed() {
+		t.Errorf("check after backoff = %+v; want allowed", st)
+	}
+	st, _ = l.Fail(ctx, "u1", "1.1.1.1")
+	if !st.CaptchaRequired || st.RetryAfter != 2*time.Millisecond {
+		t.Errorf("second failure = %+v", st)
+	}
+	st, _ = l.Fail(ctx, "u1", "1.1.1.1")
+	if !st.Locked || len(events) != 1 || events[0].Account != "u1" {
+		t.Errorf("third failure = %+v, events = %d", st, len(events))
+	}
+	if st, _ = l.Check(ctx, "u1", "1.1.1.1"); !st.Locked {
+		t.Errorf("check after lockout = %+v; want locked", st)
+	}
+	if st, _ = l.Check(ctx, "u2", "2.2.2.2"); !st.Allowed() || st.Failures != 0 {
+		t.Errorf("other account = %+v; want allowed", st)
+	}
+	if err = l.Success(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ = l.Check(ctx, "u1", "1.1.1.1"); !st.Allowed() || st.Failures != 0 {
+		t.Errorf("check after success = %+v; want reset", st)
+	}
+}
@@ -0,0 +1,525 @@
+package zauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zch"
+	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OidcStateKey    = "os:"
+	OidcStateCookie = "oidc_state"
+)
+
+var (
+	ErrOidcState   = errors.New("oidc state is invalid or expired")
+	ErrOidcIdToken = errors.New("oidc id_token is invalid")
+)
+
+// OidcConfig
+// @Description: OIDC依赖方配置
+type OidcConfig struct {
+	Issuer       string        `json:"issuer" yaml:"issuer" validate:"required" note:"身份提供方地址"`
+	ClientId     string        `json:"client_id" yaml:"client_id" validate:"required" note:"客户端ID"`
+	ClientSecret string        `json:"client_secret" yaml:"client_secret" note:"客户端密钥，公共客户端可为空"`
+	RedirectUrl  string        `json:"redirect_url" yaml:"redirect_url" validate:"required" note:"回调地址"`
+	Scopes       []string      `json:"scopes" yaml:"scopes" note:"授权范围，默认openid profile email"`
+	StateAge     time.Duration `json:"state_age" yaml:"state_age" note:"state有效期"`
+	JwksAge      time.Duration `json:"jwks_age" yaml:"jwks_age" note:"JWKS缓存时间"`
+	Leeway       time.Duration `json:"leeway" yaml:"leeway" note:"时钟偏差容忍"`
+}
+
+func (c *OidcConfig) Validate() error {
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	}
+	c.StateAge = zutil.FirstTruth(c.StateAge, 10*time.Minute)
+	c.JwksAge = zutil.FirstTruth(c.JwksAge, time.Hour)
+	c.Leeway = zutil.FirstTruth(c.Leeway, time.Minute)
+	return validator.New().Struct(c)
+}
+
+// OidcMapper
+// @Description: 将ID Token声明映射为登录用户
+type OidcMapper[T any] func(ctx context.Context, claims map[string]any) (uid string, value T, err error)
+
+type oidcMeta struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcState struct {
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+type Oidc[T any] struct {
+	conf   *OidcConfig
+	store  zch.Store
+	mapper OidcMapper[T]
+	client *http.Client
+	meta   *oidcMeta
+
+	mu     sync.RWMutex
+	keys   map[string]crypto.PublicKey
+	keysAt time.Time
+}
+
+// NewOidc
+// @Description: 创建OIDC依赖方，会请求discovery文档
+// @param ctx
+// @param ops
+// @param store
+// @param mapper
+// @return *Oidc[T]
+// @return error
+func NewOidc[T any](ctx context.Context, ops *OidcConfig, store zch.Store, mapper OidcMapper[T]) (*Oidc[T], error) {
+	if err := ops.Validate(); err != nil {
+		return nil, err
+	}
+	if store == nil || mapper == nil {
+		return nil, errors.New("oidc store and mapper are required")
+	}
+	o := &Oidc[T]{
+		conf:   ops,
+		store:  store,
+		mapper: mapper,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	meta := new(oidcMeta)
+	if err := o.getJSON(ctx, ops.Issuer+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, fmt.Errorf("oidc discovery failed: %w", err)
+	}
+	if meta.Issuer != ops.Issuer {
+		return nil, fmt.Errorf("oidc issuer mismatch: %s", meta.Issuer)
+	}
+	o.meta = meta
+	return o, nil
+}
+
+// AuthURL
+// @Description: 生成授权地址，state、nonce和PKCE verifier存入缓存；
+// 调用方需把state绑定到浏览器(如Redirect写入的cookie)，回调时校验后再Exchange
+// @receiver o
+// @param ctx
+// @return string 授权地址
+// @return string state
+// @return error
+func (o *Oidc[T]) AuthURL(ctx context.Context) (string, string, error) {
+	state, nonce, verifier := randomUrlSafe(24), randomUrlSafe(24), randomUrlSafe(48)
+	str, _ := sonic.MarshalString(&oidcState{Nonce: nonce, Verifier: verifier})
+	if err := o.store.Set(ctx, conf.key(OidcStateKey+state), str, o.conf.StateAge); err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.conf.ClientId)
+	q.Set("redirect_uri", o.conf.RedirectUrl)
+	q.Set("scope", strings.Join(o.conf.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(o.meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return o.meta.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// Exchange
+// @Description: 用授权码换取并校验ID Token，state只能使用一次
+// @receiver o
+// @param ctx
+// @param code
+// @param state
+// @return map[string]any ID Token声明
+// @return error
+func (o *Oidc[T]) Exchange(ctx context.Context, code, state string) (map[string]any, error) {
+	sKey := conf.key(OidcStateKey + state)
+	v, err := o.store.Get(ctx, sKey)
+	if err != nil || state == "" {
+		return nil, ErrOidcState
+	}
+	// state只能使用一次，比较并删除防止并发重放
+	if ok, _ := o.store.Release(ctx, sKey, v); !ok {
+		return nil, ErrOidcState
+	}
+	var st oidcState
+	if err = sonic.UnmarshalString(v, &st); err != nil {
+		return nil, ErrOidcState
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.conf.RedirectUrl)
+	form.Set("client_id", o.conf.ClientId)
+	form.Set("code_verifier", st.Verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if o.conf.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.conf.ClientId), url.QueryEscape(o.conf.ClientSecret))
+	}
+	var token struct {
+		IdToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err = o.doJSON(req, &token); err != nil {
+		return nil, fmt.Errorf("oidc token exchange failed: %w", err)
+	}
+	if token.IdToken == "" {
+		return nil, fmt.Errorf("oidc token exchange failed: %s", token.Error)
+	}
+	return o.VerifyIdToken(ctx, token.IdToken, st.Nonce)
+}
+
+// VerifyIdToken
+// @Description: 校验ID Token的签名、iss、aud、exp和nonce
+// @receiver o
+// @param ctx
+// @param raw
+// @param nonce
+// @return map[string]any
+// @return error
+func (o *Oidc[T]) VerifyIdToken(ctx context.Context, raw, nonce string) (map[string]any, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrOidcIdToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrOidcIdToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrOidcIdToken
+	}
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOidcIdToken, err)
+	}
+
+	claims := map[string]any{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrOidcIdToken
+	}
+	now := time.Now()
+	if iss, _ := claims["iss"].(string); iss != o.meta.Issuer {
+		return nil, fmt.Errorf("%w: iss", ErrOidcIdToken)
+	}
+	if !audContains(claims["aud"], o.conf.ClientId) {
+		return nil, fmt.Errorf("%w: aud", ErrOidcIdToken)
+	}
+	if exp, ok := claims["exp"].(float64); !ok || now.Add(-o.conf.Leeway).Unix() > int64(exp) {
+		return nil, fmt.Errorf("%w: exp", ErrOidcIdToken)
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(o.conf.Leeway).Unix() < int64(iat) {
+		return nil, fmt.Errorf("%w: iat", ErrOidcIdToken)
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("%w: nonce", ErrOidcIdToken)
+	}
+	return claims, nil
+}
+
+// Redirect
+// @Description: 跳转到身份提供方登录页，state的摘要写入HttpOnly cookie绑定到浏览器
+// @receiver o
+// @param c
+// @return error
+func (o *Oidc[T]) Redirect(c fiber.Ctx) error {
+	u, state, err := o.AuthURL(c.Context())
+	if err != nil {
+		zlog.Errorf("oidc auth url failed: %v", err)
+		return zfiber.Abort(c, zfiber.ErrNil)
+	}
+	c.Cookie(o.stateCookie(stateDigest(state), o.conf.StateAge))
+	return c.Redirect().Status(http.StatusFound).To(u)
+}
+
+// Callback
+// @Description: 回调处理，校验通过后映射用户并走zauth.Login建立登录态
+// @receiver o
+// @param c
+// @return error
+func (o *Oidc[T]) Callback(c fiber.Ctx) error {
+	// state必须与发起登录的浏览器cookie一致，防止登录CSRF
+	state, bound := c.Query("state"), c.Cookies(OidcStateCookie)
+	c.Cookie(o.stateCookie("", -time.Second))
+	if e := c.Query("error"); e != "" {
+		return zfiber.Abort(c, zfiber.ErrInvalidToken.WithMessage(e))
+	}
+	if bound == "" || subtle.ConstantTimeCompare([]byte(bound), []byte(stateDigest(state))) != 1 {
+		zlog.Warnf("oidc callback failed: %v", ErrOidcState)
+		return zfiber.Abort(c, zfiber.ErrInvalidToken)
+	}
+	claims, err := o.Exchange(c.Context(), c.Query("code"), state)
+	if err != nil {
+		zlog.Warnf("oidc callback failed: %v", err)
+		return zfiber.Abort(c, zfiber.ErrInvalidToken)
+	}
+	uid, value, err := o.mapper(c.Context(), claims)
+	if err != nil {
+		zlog.Warnf("oidc map claims failed: %v", err)
+		return zfiber.Abort(c, zfiber.ErrInvalidToken)
+	}
+	return zfiber.Abort(c, Login[T](c, uid, value))
+}
+
+// stateCookie
+// @Description: 绑定state的cookie，回调是跨站跳转，SameSite为lax
+// @receiver o
+// @param value
+// @param age 负数时删除
+// @return *fiber.Cookie
+func (o *Oidc[T]) stateCookie(value string, age time.Duration) *fiber.Cookie {
+	return &fiber.Cookie{
+		Name:     OidcStateCookie,
+		Value:    value,
+		Expires:  time.Now().Add(age),
+		MaxAge:   int(age.Seconds()),
+		Path:     conf.CookiePath,
+		Domain:   conf.CookieDomain,
+		SameSite: fiber.CookieSameSiteLaxMode,
+		Secure:   conf.CookieSecure == "yes",
+		HTTPOnly: true,
+	}
+}
+
+func stateDigest(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// key
+// @Description: 从缓存的JWKS中取公钥，kid未知时刷新，刷新间隔至少1分钟
+// @receiver o
+// @param ctx
+// @param kid
+// @return crypto.PublicKey
+// @return error
+func (o *Oidc[T]) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	o.mu.RLock()
+	k, ok := o.keys[kid]
+	fresh := time.Since(o.keysAt) < o.conf.JwksAge
+	recent := time.Since(o.keysAt) < time.Minute
+	o.mu.RUnlock()
+	if ok && fresh {
+		return k, nil
+	}
+	if !ok && recent {
+		return nil, fmt.Errorf("%w: unknown kid %s", ErrOidcIdToken, kid)
+	}
+	if err := o.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if k, ok = o.keys[kid]; !ok {
+		return nil, fmt.Errorf("%w: unknown kid %s", ErrOidcIdToken, kid)
+	}
+	return k, nil
+}
+
+func (o *Oidc[T]) refreshKeys(ctx context.Context) error {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := o.getJSON(ctx, o.meta.JwksUri, &set); err != nil {
+		return fmt.Errorf("oidc jwks failed: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	o.mu.Lock()
+	o.keys = keys
+	o.keysAt = time.Now()
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *Oidc[T]) getJSON(ctx context.Context, u string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	return o.doJSON(req, dst)
+}
+
+func (o *Oidc[T]) doJSON(req *http.Request, dst any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return sonic.Unmarshal(b, dst)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %s", k.Kty)
+	}
+}
+
+// verifySignature
+// @Description: 支持RS256/RS384/RS512/ES256/ES384
+// @param alg
+// @param key
+// @param signed
+// @param sig
+// @return error
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("alg %s mismatch rsa key", alg)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(sig) != 2*size {
+			return fmt.Errorf("alg %s mismatch ec key", alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("ecdsa verification failed")
+		}
+		return nil
+	default:
+		return errors.New("unsupported key")
+	}
+}
+
+func decodeSegment(seg string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return sonic.Unmarshal(b, dst)
+}
+
+func audContains(aud any, clientId string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientId
+	case []any:
+		for _, a := range v {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomUrlSafe(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,232 @@
+package zauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zch"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// fakeIdp
+// @Description: 本地模拟的身份提供方，签发RS256的ID Token
+type fakeIdp struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newFakeIdp(t *testing.T) *fakeIdp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdp{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != "good-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.claims)})
+	})
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdp) sign(t *testing.T, claims map[string]any) string {
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	p, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOidc(t *testing.T) {
+	idp := newFakeIdp(t)
+	defer idp.Close()
+
+	type user struct {
+		Email string
+	}
+	ctx := context.Background()
+	o, err := NewOidc[user](ctx, &OidcConfig{
+		Issuer:      idp.URL,
+		ClientId:    "client",
+		RedirectUrl: "http://localhost/callback",
+	}, zch.NewMemoryStore(nil), func(ctx context.Context, claims map[string]any) (string, user, error) {
+		email, _ := claims["email"].(string)
+		return claims["sub"].(string), user{Email: email}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorize := func() string {
+		u, _, err := o.AuthURL(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pu, _ := url.Parse(u)
+		q := pu.Query()
+		if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "client" {
+			t.Fatalf("AuthURL = %s", u)
+		}
+		idp.challenge = q.Get("code_challenge")
+		idp.nonce = q.Get("nonce")
+		idp.claims = map[string]any{
+			"iss":   idp.URL,
+			"aud":   "client",
+			"sub":   "u-1",
+			"email": "u1@example.com",
+			"nonce": idp.nonce,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Minute).Unix(),
+		}
+		return q.Get("state")
+	}
+
+	state := authorize()
+	claims, err := o.Exchange(ctx, "good-code", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, u, err := o.mapper(ctx, claims)
+	if err != nil || uid != "u-1" || u.Email != "u1@example.com" {
+		t.Errorf("mapper = %s, %+v, %v", uid, u, err)
+	}
+	// state只能使用一次
+	if _, err = o.Exchange(ctx, "good-code", state); !errors.Is(err, ErrOidcState) {
+		t.Errorf("reused state err = %v; want ErrOidcState", err)
+	}
+
+	// nonce不匹配
+	state = authorize()
+	idp.claims["nonce"] = "other"
+	if _, err = o.Exchange(ctx, "good-code", state); !errors.Is(err, ErrOidcIdToken) {
+		t.Errorf("bad nonce err = %v; want ErrOidcIdToken", err)
+	}
+	// aud不匹配
+	state = authorize()
+	idp.claims["aud"] = []string{"other"}
+	if _, err = o.Exchange(ctx, "good-code", state); !errors.Is(err, ErrOidcIdToken) {
+		t.Errorf("bad aud err = %v; want ErrOidcIdToken", err)
+	}
+	// 过期
+	state = authorize()
+	idp.claims["exp"] = time.Now().Add(-time.Hour).Unix()
+	if _, err = o.Exchange(ctx, "good-code", state); !errors.Is(err, ErrOidcIdToken) {
+		t.Errorf("expired err = %v; want ErrOidcIdToken", err)
+	}
+	// PKCE verifier错误
+	state = authorize()
+	idp.challenge = "tampered"
+	if _, err = o.Exchange(ctx, "good-code", state); err == nil {
+		t.Errorf("bad verifier err = nil; want error")
+	}
+	// 篡改签名
+	tk := idp.sign(t, idp.claims)
+	if _, err = o.VerifyIdToken(ctx, tk[:len(tk)-4]+"AAAA", idp.nonce); !errors.Is(err, ErrOidcIdToken) {
+		t.Errorf("tampered signature err = %v; want ErrOidcIdToken", err)
+	}
+}
+
+func TestOidcCallbackState(t *testing.T) {
+	idp := newFakeIdp(t)
+	defer idp.Close()
+	_ = conf.Validate()
+
+	ctx := context.Background()
+	o, err := NewOidc[string](ctx, &OidcConfig{
+		Issuer:      idp.URL,
+		ClientId:    "client",
+		RedirectUrl: "http://localhost/callback",
+	}, zch.NewMemoryStore(nil), func(ctx context.Context, claims map[string]any) (string, string, error) {
+		return claims["sub"].(string), "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New()
+	app.Get("/login", o.Redirect)
+	app.Get("/callback", o.Callback)
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := url.Parse(resp.Header.Get("Location"))
+	state := loc.Query().Get("state")
+	var bound *http.Cookie
+	for _, ck := range resp.Cookies() {
+		if ck.Name == OidcStateCookie {
+			bound = ck
+		}
+	}
+	if bound == nil || !bound.HttpOnly || bound.Value != stateDigest(state) {
+		t.Fatalf("Redirect cookie = %+v; want HttpOnly digest of state", bound)
+	}
+
+	callback := func(cookie string) zfiber.RespBean {
+		req := httptest.NewRequest(fiber.MethodGet, "/callback?code=good-code&state="+url.QueryEscape(state), nil)
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: OidcStateCookie, Value: cookie})
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		var bean zfiber.RespBean
+		_ = json.Unmarshal(b, &bean)
+		return bean
+	}
+	for name, cookie := range map[string]string{"no cookie": "", "other browser": stateDigest("other")} {
+		if r := callback(cookie); r.Code != zfiber.ErrInvalidToken.Code {
+			t.Errorf("Callback(%s) = %+v; want invalid token", name, r)
+		}
+	}
+	// 被拒绝的回调不消耗state
+	if _, err = o.store.Get(ctx, conf.key(OidcStateKey+state)); err != nil {
+		t.Errorf("state consumed by rejected callback: %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package zauth
+
+import (
+	"path"
+	"strings"
+)
+
+type Policy int
+
+const (
+	PolicyRequired Policy = iota // 必须登录
+	PolicyOptional               // 可选登录，携带token时解析用户，否则放行
+	PolicyPublic                 // 无需登录
+)
+
+// rule
+// @Description: 路由策略，pattern支持 /public/*、/files/:fid、/static/*.png
+type rule struct {
+	method   string
+	segments []string
+	policy   Policy
+}
+
+// parseRule
+// @Description: 解析规则，格式为 "[METHOD ]/path"，METHOD可省略
+// @param raw
+// @param policy
+// @return *rule
+func parseRule(raw string, policy Policy) *rule {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	r := &rule{policy: policy}
+	if fields := strings.Fields(raw); len(fields) == 2 {
+		r.method = strings.ToUpper(fields[0])
+		raw = fields[1]
+	}
+	r.segments = splitPath(raw)
+	return r
+}
+
+// match
+// @Description: 判断请求是否命中规则
+// @receiver r
+// @param method
+// @param p
+// @return bool
+func (r *rule) match(method, p string) bool {
+	if r.method != "" && r.method != strings.ToUpper(method) {
+		return false
+	}
+	segs := splitPath(p)
+	for i, s := range r.segments {
+		// 末尾的*匹配剩余全部路径
+		if s == "*" && i == len(r.segments)-1 {
+			return true
+		}
+		if i >= len(segs) {
+			return false
+		}
+		switch {
+		case strings.HasPrefix(s, ":"):
+			if segs[i] == "" {
+				return false
+			}
+		case strings.ContainsAny(s, "*?["):
+			if ok, _ := path.Match(s, segs[i]); !ok {
+				return false
+			}
+		default:
+			if s != segs[i] {
+				return false
+			}
+		}
+	}
+	return len(segs) == len(r.segments)
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
@@ -0,0 +1,20 @@
+package zauth
+
+import (
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+)
+
+// TenantClaim
+// @Description: 从登录信息解析租户，配合 zfiber.Tenant 使用，需放在认证中间件之后
+// @param fn
+// @return zfiber.TenantResolver
+func TenantClaim[T any](fn func(u *T) string) zfiber.TenantResolver {
+	return func(c fiber.Ctx) string {
+		u, err := Auth[T](c)
+		if err != nil {
+			return ""
+		}
+		return fn(u)
+	}
+}
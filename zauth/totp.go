@@ -0,0 +1,257 @@
+package zauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zcpt"
+	"github.com/zohu/zfiber/zid"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TotpPeriod = 30
+	TotpDigits = 6
+
+	TotpMaxAttempts = 5
+
+	TotpUsedKey      = "tu:"
+	TotpChallengeKey = "tc:"
+)
+
+var ErrNoTotpKey = errors.New("zauth: totp_key is required when totp is enabled")
+
+var (
+	ErrInvalidChallenge = zfiber.NewFlag(401, "二次验证已失效，请重新登录")
+	ErrInvalidTotp      = zfiber.NewFlag(400, "动态验证码错误")
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTotpSecret
+// @Description: 生成TOTP密钥，base32编码
+// @return string
+func NewTotpSecret() string {
+	b := make([]byte, 20)
+	_, _ = rand.Read(b)
+	return b32.EncodeToString(b)
+}
+
+// TotpURI
+// @Description: 生成otpauth://绑定地址，可转二维码供验证器扫码
+// @param account
+// @param secret
+// @return string
+func TotpURI(account, secret string) string {
+	label := url.PathEscape(conf.TotpIssuer + ":" + account)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", conf.TotpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(TotpDigits))
+	q.Set("period", fmt.Sprint(TotpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, q.Encode())
+}
+
+// totpKey
+// @Description: 落库加密key，未配置时返回错误，避免用公开的默认key加密
+// @return []byte
+// @return error
+func totpKey() ([]byte, error) {
+	if conf.TotpKey == "" {
+		return nil, ErrNoTotpKey
+	}
+	return []byte(conf.TotpKey), nil
+}
+
+// EncryptTotpSecret
+// @Description: AES-GCM加密TOTP密钥用于落库
+// @param secret
+// @return string
+// @return error
+func EncryptTotpSecret(secret string) (string, error) {
+	key, err := totpKey()
+	if err != nil {
+		return "", err
+	}
+	d, err := zcpt.AesEncryptGCM([]byte(secret), key, nil)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(d), nil
+}
+
+// DecryptTotpSecret
+// @Description: 解密落库的TOTP密钥
+// @param encrypted
+// @return string
+// @return error
+func DecryptTotpSecret(encrypted string) (string, error) {
+	d, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	key, err := totpKey()
+	if err != nil {
+		return "", err
+	}
+	d, err = zcpt.AesDecryptGCM(d, key, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(d), nil
+}
+
+// VerifyTotp
+// @Description: 校验动态验证码，允许前后TotpSkew个周期的时钟漂移，同一周期的验证码只能使用一次
+// @param c
+// @param uid
+// @param secret 明文密钥
+// @param code
+// @return bool
+func VerifyTotp(c fiber.Ctx, uid, secret, code string) bool {
+	key, err := b32.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return false
+	}
+	step := time.Now().Unix() / TotpPeriod
+	for i := -conf.TotpSkew; i <= conf.TotpSkew; i++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step+int64(i))), []byte(code)) != 1 {
+			continue
+		}
+		// 防重放，一个周期只允许使用一次
+		ttl := time.Duration(TotpPeriod*(2*conf.TotpSkew+1)) * time.Second
+		vKey := conf.key(fmt.Sprintf("%s%s:%d", TotpUsedKey, uid, step+int64(i)))
+		ok, err := store.SetNX(c.Context(), vKey, "1", ttl)
+		return err == nil && ok
+	}
+	return false
+}
+
+// totpCode
+// @Description: RFC 6238 HMAC-SHA1
+// @param key
+// @param step
+// @return string
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TotpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TotpDigits, v%mod)
+}
+
+// NewRecoveryCodes
+// @Description: 生成一次性恢复码，明文展示给用户一次，落库保存哈希
+// @param uid
+// @param n
+// @return codes 明文
+// @return hashes 哈希
+func NewRecoveryCodes(uid string, n int) (codes []string, hashes []string) {
+	for i := 0; i < n; i++ {
+		b := make([]byte, 5)
+		_, _ = rand.Read(b)
+		code := strings.ToLower(b32.EncodeToString(b))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, zcpt.NewPwd(uid, code))
+	}
+	return codes, hashes
+}
+
+// UseRecoveryCode
+// @Description: 校验恢复码，成功时返回剔除该码后的哈希列表，调用方需落库
+// @param uid
+// @param hashes
+// @param code
+// @return []string
+// @return bool
+func UseRecoveryCode(uid string, hashes []string, code string) ([]string, bool) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, h := range hashes {
+		if zcpt.VerifyPwd(uid, h, code) {
+			rest := append([]string{}, hashes[:i]...)
+			return append(rest, hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
+
+type challenge[T any] struct {
+	Uid   string `json:"uid"`
+	Value T      `json:"value"`
+	Ip    string `json:"ip"`
+	Ua    string `json:"ua"`
+}
+
+// LoginPending
+// @Description: 两步登录第一步，密码校验通过后调用，返回待二次验证的challenge，此时未建立登录态
+// @param c
+// @param uid
+// @param value
+// @return zfiber.RespBean
+func LoginPending[T any](c fiber.Ctx, uid string, value T) zfiber.RespBean {
+	token := zid.NextIdShort() + zcpt.Md5(NewTotpSecret())
+	str, _ := sonic.MarshalString(&challenge[T]{Uid: uid, Value: value, Ip: c.IP(), Ua: zcpt.Md5(c.Get(UserAgent))})
+	_ = store.Set(c.Context(), conf.key(TotpChallengeKey+token), str, conf.TotpChallengeAge)
+	return zfiber.NewData(map[string]any{
+		"challenge": token,
+		"pending":   "2fa",
+		"expire":    time.Now().Add(conf.TotpChallengeAge).Format(time.RFC3339),
+	})
+}
+
+// LoginConfirm
+// @Description: 两步登录第二步，check校验动态验证码或恢复码，通过后建立登录态；challenge只能使用一次，失败超过TotpMaxAttempts次作废
+// @param c
+// @param token challenge
+// @param check
+// @return zfiber.RespBean
+func LoginConfirm[T any](c fiber.Ctx, token string, check func(uid string) bool) zfiber.RespBean {
+	vKey := conf.key(TotpChallengeKey + token)
+	str, err := store.Get(c.Context(), vKey)
+	if err != nil {
+		return ErrInvalidChallenge
+	}
+	var ch challenge[T]
+	if err = sonic.UnmarshalString(str, &ch); err != nil {
+		return ErrInvalidChallenge
+	}
+	if !conf.AllowIpChange && ch.Ip != c.IP() {
+		return ErrInvalidChallenge
+	}
+	if !conf.AllowUaChange && ch.Ua != zcpt.Md5(c.Get(UserAgent)) {
+		return ErrInvalidChallenge
+	}
+	if !check(ch.Uid) {
+		nKey := vKey + ":n"
+		n, _ := store.Incr(c.Context(), nKey, conf.TotpChallengeAge)
+		if n >= TotpMaxAttempts {
+			_ = store.Del(c.Context(), vKey, nKey)
+		}
+		return ErrInvalidTotp
+	}
+	// 比较并删除成功才算持有者，防止并发重复使用
+	if ok, _ := store.Release(c.Context(), vKey, str); !ok {
+		return ErrInvalidChallenge
+	}
+	return Login[T](c, ch.Uid, ch.Value)
+}
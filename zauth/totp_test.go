@@ -0,0 +1,185 @@
+package zauth
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v3"
+	"github.com/zohu/zfiber"
+	"github.com/zohu/zfiber/zch"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// RFC 6238 附录B，SHA1测试向量取后6位
+	key := []byte("12345678901234567890")
+	var args = []struct {
+		unix   int64
+		result string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, arg := range args {
+		if r := totpCode(key, arg.unix/TotpPeriod); r != arg.result {
+			t.Errorf("totpCode(%d) = %s; want %s", arg.unix, r, arg.result)
+		}
+	}
+}
+
+func TestTotpSecret(t *testing.T) {
+	conf = &Config{Totp: true, TotpKey: "0123456789abcdef"}
+	_ = conf.Validate()
+	secret := NewTotpSecret()
+	uri := TotpURI("admin@example.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, "secret="+secret) {
+		t.Errorf("TotpURI = %s", uri)
+	}
+	enc, err := EncryptTotpSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := DecryptTotpSecret(enc); err != nil || dec != secret {
+		t.Errorf("DecryptTotpSecret = %s, %v; want %s", dec, err, secret)
+	}
+}
+
+func TestTotpKeyRequired(t *testing.T) {
+	c := &Config{Totp: true}
+	if err := c.Validate(); !errors.Is(err, ErrNoTotpKey) {
+		t.Errorf("Validate() without totp_key = %v; want %v", err, ErrNoTotpKey)
+	}
+	conf = &Config{}
+	_ = conf.Validate()
+	if _, err := EncryptTotpSecret(NewTotpSecret()); !errors.Is(err, ErrNoTotpKey) {
+		t.Errorf("EncryptTotpSecret() without totp_key = %v; want %v", err, ErrNoTotpKey)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := NewRecoveryCodes("0001", 3)
+	if len(codes) != 3 || len(hashes) != 3 {
+		t.Fatalf("NewRecoveryCodes = %d, %d; want 3", len(codes), len(hashes))
+	}
+	rest, ok := UseRecoveryCode("0001", hashes, strings.ToUpper(codes[1]))
+	if !ok || len(rest) != 2 {
+		t.Errorf("UseRecoveryCode = %d, %v; want 2, true", len(rest), ok)
+	}
+	if _, ok = UseRecoveryCode("0001", rest, codes[1]); ok {
+		t.Errorf("UseRecoveryCode reused code; want false")
+	}
+	if _, ok = UseRecoveryCode("0002", hashes, codes[0]); ok {
+		t.Errorf("UseRecoveryCode other uid; want false")
+	}
+}
+
+// totpApp
+// @Description: 两步登录的测试应用，请求头X-Real-IP模拟客户端IP
+// @param t
+// @param secret
+// @return func(path, ip, ua string) zfiber.RespBean
+func totpApp(t *testing.T, secret string) func(path, ip, ua string) zfiber.RespBean {
+	store = zch.NewMemoryStore(nil)
+	conf = &Config{Totp: true, TotpKey: "0123456789abcdef"}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	app := fiber.New(fiber.Config{ProxyHeader: "X-Real-IP"})
+	app.Post("/pending", func(c fiber.Ctx) error {
+		return zfiber.Abort(c, LoginPending(c, "u1", "zoe"))
+	})
+	app.Post("/confirm", func(c fiber.Ctx) error {
+		return zfiber.Abort(c, LoginConfirm[string](c, c.Query("challenge"), func(uid string) bool {
+			return VerifyTotp(c, uid, secret, c.Query("code"))
+		}))
+	})
+	app.Post("/verify", func(c fiber.Ctx) error {
+		if !VerifyTotp(c, "u1", secret, c.Query("code")) {
+			return zfiber.Abort(c, ErrInvalidTotp)
+		}
+		return zfiber.Abort(c, zfiber.NewData("ok"))
+	})
+	return func(path, ip, ua string) zfiber.RespBean {
+		req := httptest.NewRequest(fiber.MethodPost, path, nil)
+		req.Header.Set("X-Real-IP", ip)
+		req.Header.Set(UserAgent, ua)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		var bean zfiber.RespBean
+		_ = json.Unmarshal(b, &bean)
+		return bean
+	}
+}
+
+func currentTotp(t *testing.T, secret string) string {
+	key, err := b32.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/TotpPeriod)
+}
+
+func TestVerifyTotpReplay(t *testing.T) {
+	secret := NewTotpSecret()
+	call := totpApp(t, secret)
+	code := currentTotp(t, secret)
+	if r := call("/verify?code="+code, "10.0.0.1", "ua"); r.Code != 1 {
+		t.Errorf("VerifyTotp(%s) = %+v; want ok", code, r)
+	}
+	if r := call("/verify?code="+code, "10.0.0.1", "ua"); r.Code != ErrInvalidTotp.Code {
+		t.Errorf("VerifyTotp(%s) replay = %+v; want invalid totp", code, r)
+	}
+}
+
+func TestLoginConfirm(t *testing.T) {
+	secret := NewTotpSecret()
+	call := totpApp(t, secret)
+	pending := func() string {
+		r := call("/pending", "10.0.0.1", "ua")
+		ch, _ := r.Data.(map[string]any)["challenge"].(string)
+		if ch == "" {
+			t.Fatalf("LoginPending = %+v", r)
+		}
+		return ch
+	}
+	wrong := "000000"
+	if currentTotp(t, secret) == wrong {
+		wrong = "111111"
+	}
+
+	// 绑定IP和UA
+	ch := pending()
+	if r := call("/confirm?challenge="+ch+"&code="+currentTotp(t, secret), "10.0.0.2", "ua"); r.Code != ErrInvalidChallenge.Code {
+		t.Errorf("LoginConfirm from other ip = %+v; want invalid challenge", r)
+	}
+	if r := call("/confirm?challenge="+ch+"&code="+currentTotp(t, secret), "10.0.0.1", "other"); r.Code != ErrInvalidChallenge.Code {
+		t.Errorf("LoginConfirm from other ua = %+v; want invalid challenge", r)
+	}
+	// 只能使用一次
+	r := call("/confirm?challenge="+ch+"&code="+currentTotp(t, secret), "10.0.0.1", "ua")
+	if tk, _ := r.Data.(map[string]any)["token"].(string); tk == "" {
+		t.Fatalf("LoginConfirm = %+v; want token", r)
+	}
+	if r = call("/confirm?challenge="+ch+"&code="+wrong, "10.0.0.1", "ua"); r.Code != ErrInvalidChallenge.Code {
+		t.Errorf("LoginConfirm reused challenge = %+v; want invalid challenge", r)
+	}
+
+	// 失败次数达到上限后作废
+	ch = pending()
+	for i := 0; i < TotpMaxAttempts; i++ {
+		if r = call("/confirm?challenge="+ch+"&code="+wrong, "10.0.0.1", "ua"); r.Code != ErrInvalidTotp.Code {
+			t.Errorf("LoginConfirm wrong code #%d = %+v; want invalid totp", i+1, r)
+		}
+	}
+	if r = call("/confirm?challenge="+ch+"&code="+currentTotp(t, secret), "10.0.0.1", "ua"); r.Code != ErrInvalidChallenge.Code {
+		t.Errorf("LoginConfirm after %d failures = %+v; want invalid challenge", TotpMaxAttempts, r)
+	}
+}
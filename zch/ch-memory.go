@@ -1,9 +1,12 @@
 package zch
 
 import (
+	"container/list"
 	"fmt"
+	"github.com/zohu/zfiber/zmap"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,45 +27,67 @@ const (
 	DefaultExpiration time.Duration = 0
 )
 
+const (
+	EvictionLRU     = "lru"
+	EvictionTinyLFU = "tinylfu"
+)
+
+// MemoryOptions
+// @Description: 容量限制，均为0时不限制
+type MemoryOptions struct {
+	MaxEntries int    `note:"最大条目数"`
+	MaxBytes   int64  `note:"最大字节数，按key和value长度计算"`
+	Eviction   string `note:"淘汰策略,lru/tinylfu"`
+}
+
+// MemoryStats
+// @Description: 命中、淘汰统计
+type MemoryStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+}
+
 type Memory struct {
 	*memory
 }
 
 type memory struct {
 	defaultExpiration time.Duration
-	items             map[string]Item
-	mu                sync.RWMutex
+	shards            []*shard
 	janitor           *janitor
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
 }
 
-func (c *memory) Set(k string, x string, d time.Duration) {
-	var e int64
-	if d == DefaultExpiration {
-		d = c.defaultExpiration
-	}
-	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
-	}
-	c.mu.Lock()
-	c.items[k] = Item{
-		value:      x,
-		expiration: e,
+func (c *memory) shard(k string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
 	}
-	c.mu.Unlock()
+	return c.shards[zmap.Fnv32(k)%uint32(len(c.shards))]
 }
 
-func (c *memory) set(k string, x string, d time.Duration) {
-	var e int64
+func (c *memory) expiration(d time.Duration) int64 {
 	if d == DefaultExpiration {
 		d = c.defaultExpiration
 	}
 	if d > 0 {
-		e = time.Now().Add(d).UnixNano()
-	}
-	c.items[k] = Item{
-		value:      x,
-		expiration: e,
+		return time.Now().Add(d).UnixNano()
 	}
+	return 0
+}
+
+func (c *memory) Set(k string, x string, d time.Duration) {
+	s := c.shard(k)
+	s.mu.Lock()
+	s.set(k, x, c.expiration(d))
+	s.mu.Unlock()
 }
 
 func (c *memory) SetDefault(k string, x string) {
@@ -70,114 +95,212 @@ func (c *memory) SetDefault(k string, x string) {
 }
 
 func (c *memory) SetNX(k string, x string, d time.Duration) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	_, found := c.get(k)
-	if found {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.get(k, time.Now().UnixNano()); found {
 		return fmt.Errorf("item %s already exists", k)
 	}
-	c.set(k, x, d)
+	s.set(k, x, c.expiration(d))
 	return nil
 }
 
 func (c *memory) Replace(k string, x string, d time.Duration) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	_, found := c.get(k)
-	if !found {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.get(k, time.Now().UnixNano()); !found {
 		return fmt.Errorf("item %s doesn't exist", k)
 	}
-	c.set(k, x, d)
+	s.set(k, x, c.expiration(d))
 	return nil
 }
 
 func (c *memory) Get(k string) (string, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	item, found := c.items[k]
-	if !found {
-		return "", false
-	}
-	if item.expiration > 0 {
-		if time.Now().UnixNano() > item.expiration {
-			return "", false
-		}
-	}
-	return item.value, true
+	v, _, ok := c.GetWithExpiration(k)
+	return v, ok
 }
 
 func (c *memory) GetWithExpiration(k string) (string, time.Time, bool) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	item, found := c.items[k]
-	if !found {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, found := s.get(k, time.Now().UnixNano())
+	// hash/set/zset不是字符串值
+	if !found || el.Value.(*entry).data != nil {
+		c.misses.Add(1)
 		return "", time.Time{}, false
 	}
+	c.hits.Add(1)
+	s.touch(el)
+	e := el.Value.(*entry)
+	if e.expiration > 0 {
+		return e.value, time.Unix(0, e.expiration), true
+	}
+	return e.value, time.Time{}, true
+}
 
-	if item.expiration > 0 {
-		if time.Now().UnixNano() > item.expiration {
-			return "", time.Time{}, false
-		}
-		return item.value, time.Unix(0, item.expiration), true
+func (c *memory) Delete(k string) {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[k]; ok {
+		s.remove(el)
+	}
+}
+
+// compareAndDelete
+// @Description: 值等于old时删除
+// @receiver c
+// @param k
+// @param old
+// @return bool
+func (c *memory) compareAndDelete(k, old string) bool {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.get(k, time.Now().UnixNano())
+	if !ok || el.Value.(*entry).value != old {
+		return false
 	}
-	return item.value, time.Time{}, true
+	s.remove(el)
+	return true
 }
 
-func (c *memory) get(k string) (string, bool) {
-	item, found := c.items[k]
-	if !found {
-		return "", false
+// compareAndExpire
+// @Description: 值等于old时重置过期时间
+// @receiver c
+// @param k
+// @param old
+// @param d
+// @return bool
+func (c *memory) compareAndExpire(k, old string, d time.Duration) bool {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.get(k, time.Now().UnixNano())
+	if !ok || el.Value.(*entry).value != old {
+		return false
 	}
-	if item.expiration > 0 {
-		if time.Now().UnixNano() > item.expiration {
-			return "", false
+	el.Value.(*entry).expiration = c.expiration(d)
+	return true
+}
+
+// mutate
+// @Description: 持锁修改条目，不存在时fn收到新条目，fn返回错误时不写入
+// @receiver c
+// @param k
+// @param fn
+// @return error
+func (c *memory) mutate(k string, fn func(e *entry) error) error {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.get(k, time.Now().UnixNano())
+	if !ok {
+		e := &entry{key: k}
+		if err := fn(e); err != nil {
+			return err
 		}
+		s.insert(e)
+		return nil
+	}
+	e := el.Value.(*entry)
+	before := e.size()
+	if err := fn(e); err != nil {
+		return err
 	}
-	return item.value, true
+	s.update(el, before)
+	return nil
 }
 
-func (c *memory) Delete(k string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	delete(c.items, k)
+// view
+// @Description: 持锁读取条目，不存在返回ErrNotFound
+// @receiver c
+// @param k
+// @param fn
+// @return error
+func (c *memory) view(k string, fn func(e *entry) error) error {
+	s := c.shard(k)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.get(k, time.Now().UnixNano())
+	if !ok {
+		c.misses.Add(1)
+		return ErrNotFound
+	}
+	c.hits.Add(1)
+	s.touch(el)
+	return fn(el.Value.(*entry))
 }
 
 func (c *memory) DeleteExpired() {
 	now := time.Now().UnixNano()
-	for k, v := range c.items {
-		if v.expiration > 0 && now > v.expiration {
-			c.Delete(k)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, el := range s.items {
+			if el.Value.(*entry).expired(now) {
+				s.remove(el)
+				c.expirations.Add(1)
+			}
 		}
+		s.mu.Unlock()
 	}
 }
 
 func (c *memory) Items() map[string]Item {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	m := make(map[string]Item, len(c.items))
+	m := make(map[string]Item, c.ItemCount())
 	now := time.Now().UnixNano()
-	for k, v := range c.items {
-		if v.expiration > 0 {
-			if now > v.expiration {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, el := range s.items {
+			e := el.Value.(*entry)
+			if e.expired(now) {
 				continue
 			}
+			m[k] = Item{value: e.value, expiration: e.expiration}
 		}
-		m[k] = v
+		s.mu.Unlock()
 	}
 	return m
 }
 
 func (c *memory) ItemCount() int {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	n := len(c.items)
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += len(s.items)
+		s.mu.Unlock()
+	}
 	return n
 }
 
 func (c *memory) Flush() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.items = map[string]Item{}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		s.reset()
+		s.mu.Unlock()
+	}
+}
+
+// Stats
+// @Description: 命中、淘汰统计及当前容量
+// @receiver c
+// @return MemoryStats
+func (c *memory) Stats() MemoryStats {
+	st := MemoryStats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		st.Entries += len(s.items)
+		st.Bytes += s.bytes
+		s.mu.Unlock()
+	}
+	return st
 }
 
 type janitor struct {
@@ -211,19 +334,31 @@ func runJanitor(c *memory, ci time.Duration) {
 	go j.Run(c)
 }
 
-func newMemory(de time.Duration, m map[string]Item) *memory {
+func newMemory(de time.Duration, ops MemoryOptions) *memory {
 	if de == 0 {
 		de = -1
 	}
 	c := &memory{
 		defaultExpiration: de,
-		items:             m,
+	}
+	// 条目上限较小时分片会导致单片容量过小、淘汰不准
+	n := zmap.ShardCount
+	if ops.MaxEntries > 0 && ops.MaxEntries < n*16 {
+		n = 1
+	}
+	c.shards = make([]*shard, n)
+	for i := range c.shards {
+		c.shards[i] = newShard(c, ops, n)
 	}
 	return c
 }
 
-func newMemoryWithJanitor(de time.Duration, ci time.Duration, m map[string]Item) *Memory {
-	c := newMemory(de, m)
+func newMemoryWithJanitor(de time.Duration, ci time.Duration, ops MemoryOptions, m map[string]Item) *Memory {
+	c := newMemory(de, ops)
+	for k, v := range m {
+		s := c.shard(k)
+		s.set(k, v.value, v.expiration)
+	}
 	C := &Memory{c}
 	if ci > 0 {
 		runJanitor(c, ci)
@@ -232,11 +367,331 @@ func newMemoryWithJanitor(de time.Duration, ci time.Duration, m map[string]Item)
 	return C
 }
 
-func NewMemory(defaultExpiration, cleanupInterval time.Duration) *Memory {
-	items := make(map[string]Item)
-	return newMemoryWithJanitor(defaultExpiration, cleanupInterval, items)
+// NewMemory
+// @Description: 创建本地缓存，不传ops时不限制容量
+// @param defaultExpiration
+// @param cleanupInterval
+// @param ops
+// @return *Memory
+func NewMemory(defaultExpiration, cleanupInterval time.Duration, ops ...MemoryOptions) *Memory {
+	var o MemoryOptions
+	if len(ops) > 0 {
+		o = ops[0]
+	}
+	return newMemoryWithJanitor(defaultExpiration, cleanupInterval, o, nil)
 }
 
 func NewMemoryFrom(defaultExpiration, cleanupInterval time.Duration, items map[string]Item) *Memory {
-	return newMemoryWithJanitor(defaultExpiration, cleanupInterval, items)
+	return newMemoryWithJanitor(defaultExpiration, cleanupInterval, MemoryOptions{}, items)
+}
+
+type entry struct {
+	key        string
+	value      string
+	data       any // hash/set/zset，见ch-types.go
+	expiration int64
+	seg        int
+	bytes      int64
+}
+
+func (e *entry) size() int64 {
+	return e.bytes
+}
+
+// resize
+// @Description: 重新计算条目大小，修改value或data后调用
+// @receiver e
+func (e *entry) resize() {
+	n := len(e.key) + len(e.value)
+	switch d := e.data.(type) {
+	case map[string]string:
+		for k, v := range d {
+			n += len(k) + len(v)
+		}
+	case map[string]struct{}:
+		for k := range d {
+			n += len(k)
+		}
+	case map[string]float64:
+		for k := range d {
+			n += len(k) + 8
+		}
+	}
+	e.bytes = int64(n)
+}
+
+func (e *entry) expired(now int64) bool {
+	return e.expiration > 0 && now > e.expiration
+}
+
+// W-TinyLFU的三个分区，LRU只使用window
+const (
+	segWindow = iota
+	segProbation
+	segProtected
+)
+
+const (
+	windowRatio    = 0.01
+	protectedRatio = 0.8 * (1 - windowRatio)
+)
+
+type segment struct {
+	l     *list.List
+	bytes int64
+}
+
+// shard
+// @Description: 每个分片独立加锁和淘汰，容量为总量均分
+type shard struct {
+	c     *memory
+	mu    sync.Mutex
+	items map[string]*list.Element
+	segs  [3]segment
+	bytes int64
+
+	maxEntries int
+	maxBytes   int64
+	tinylfu    bool
+	sketch     *sketch
+	// 最近一次从window淘汰到probation的条目，与probation队尾比较频率决定去留
+	candidate *list.Element
+}
+
+func newShard(c *memory, ops MemoryOptions, n int) *shard {
+	s := &shard{
+		c:       c,
+		tinylfu: ops.Eviction == EvictionTinyLFU,
+	}
+	if ops.MaxEntries > 0 {
+		s.maxEntries = (ops.MaxEntries + n - 1) / n
+	}
+	if ops.MaxBytes > 0 {
+		s.maxBytes = (ops.MaxBytes + int64(n) - 1) / int64(n)
+	}
+	if s.tinylfu {
+		width := s.maxEntries
+		if width == 0 {
+			width = int(s.maxBytes / 256)
+		}
+		s.sketch = newSketch(width)
+	}
+	s.reset()
+	return s
+}
+
+func (s *shard) reset() {
+	s.items = make(map[string]*list.Element)
+	for i := range s.segs {
+		s.segs[i] = segment{l: list.New()}
+	}
+	s.bytes = 0
+	s.candidate = nil
+}
+
+// get
+// @Description: 调用方需持有锁，过期条目在此惰性删除
+// @receiver s
+// @param k
+// @param now
+// @return *list.Element
+// @return bool
+func (s *shard) get(k string, now int64) (*list.Element, bool) {
+	el, ok := s.items[k]
+	if !ok {
+		return nil, false
+	}
+	if el.Value.(*entry).expired(now) {
+		s.remove(el)
+		s.c.expirations.Add(1)
+		return nil, false
+	}
+	return el, true
+}
+
+func (s *shard) set(k string, x string, expiration int64) {
+	if el, ok := s.items[k]; ok {
+		e := el.Value.(*entry)
+		before := e.size()
+		e.value, e.data, e.expiration = x, nil, expiration
+		s.update(el, before)
+		return
+	}
+	s.insert(&entry{key: k, value: x, expiration: expiration})
+}
+
+func (s *shard) insert(e *entry) {
+	if s.sketch != nil {
+		s.sketch.add(e.key)
+	}
+	e.seg = segWindow
+	e.resize()
+	s.items[e.key] = s.segs[segWindow].l.PushFront(e)
+	s.segs[segWindow].bytes += e.size()
+	s.bytes += e.size()
+	s.evict()
+}
+
+// update
+// @Description: 条目被原地修改后更新容量统计
+// @receiver s
+// @param el
+// @param before 修改前的大小
+func (s *shard) update(el *list.Element, before int64) {
+	e := el.Value.(*entry)
+	e.resize()
+	delta := e.size() - before
+	s.segs[e.seg].bytes += delta
+	s.bytes += delta
+	s.touch(el)
+	s.evict()
+}
+
+// touch
+// @Description: 访问后调整位置，probation中再次访问的条目晋升到protected
+// @receiver s
+// @param el
+func (s *shard) touch(el *list.Element) {
+	e := el.Value.(*entry)
+	if s.sketch != nil {
+		s.sketch.add(e.key)
+	}
+	if e.seg != segProbation {
+		s.segs[e.seg].l.MoveToFront(el)
+		return
+	}
+	s.move(el, segProtected)
+	for s.overSeg(segProtected, protectedRatio) {
+		s.move(s.segs[segProtected].l.Back(), segProbation)
+	}
+}
+
+func (s *shard) move(el *list.Element, to int) *list.Element {
+	e := el.Value.(*entry)
+	s.segs[e.seg].l.Remove(el)
+	s.segs[e.seg].bytes -= e.size()
+	e.seg = to
+	nel := s.segs[to].l.PushFront(e)
+	s.segs[to].bytes += e.size()
+	s.items[e.key] = nel
+	if s.candidate == el {
+		s.candidate = nel
+	}
+	return nel
+}
+
+func (s *shard) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	s.segs[e.seg].l.Remove(el)
+	s.segs[e.seg].bytes -= e.size()
+	s.bytes -= e.size()
+	delete(s.items, e.key)
+	if s.candidate == el {
+		s.candidate = nil
+	}
+}
+
+func (s *shard) over() bool {
+	return (s.maxEntries > 0 && len(s.items) > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+func (s *shard) overSeg(seg int, ratio float64) bool {
+	sg := &s.segs[seg]
+	if sg.l.Len() <= 1 {
+		return false
+	}
+	return (s.maxEntries > 0 && sg.l.Len() > max(1, int(float64(s.maxEntries)*ratio))) ||
+		(s.maxBytes > 0 && sg.bytes > int64(float64(s.maxBytes)*ratio))
+}
+
+func (s *shard) evict() {
+	if s.tinylfu {
+		for s.overSeg(segWindow, windowRatio) {
+			s.candidate = s.move(s.segs[segWindow].l.Back(), segProbation)
+		}
+	}
+	for s.over() {
+		victim := s.victim()
+		if victim == nil {
+			return
+		}
+		s.remove(victim)
+		s.c.evictions.Add(1)
+	}
+}
+
+// victim
+// @Description: LRU淘汰window队尾；W-TinyLFU淘汰probation队尾与候选中访问频率较低者
+// @receiver s
+// @return *list.Element
+func (s *shard) victim() *list.Element {
+	var v *list.Element
+	for _, seg := range []int{segProbation, segProtected, segWindow} {
+		if v = s.segs[seg].l.Back(); v != nil {
+			break
+		}
+	}
+	if !s.tinylfu || v == nil {
+		return v
+	}
+	c := s.candidate
+	if c == nil || c == v || c.Value.(*entry).seg != segProbation {
+		return v
+	}
+	if s.sketch.estimate(c.Value.(*entry).key) <= s.sketch.estimate(v.Value.(*entry).key) {
+		return c
+	}
+	return v
+}
+
+// sketch
+// @Description: Count-Min Sketch，估算访问频率，计数达到阈值后减半以淘汰历史热点
+type sketch struct {
+	rows  [4][]uint8
+	mask  uint32
+	adds  int
+	reset int
+}
+
+func newSketch(width int) *sketch {
+	w := 64
+	for w < width {
+		w <<= 1
+	}
+	s := &sketch{mask: uint32(w - 1), reset: w * 10}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+func (s *sketch) index(h uint32, i int) uint32 {
+	// 双重哈希生成各行下标
+	return (h + uint32(i)*((h>>16)|1)) & s.mask
+}
+
+func (s *sketch) add(k string) {
+	h := zmap.Fnv32(k)
+	for i := range s.rows {
+		if idx := s.index(h, i); s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	if s.adds++; s.adds >= s.reset {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.adds /= 2
+	}
+}
+
+func (s *sketch) estimate(k string) uint8 {
+	h := zmap.Fnv32(k)
+	est := uint8(15)
+	for i := range s.rows {
+		est = min(est, s.rows[i][s.index(h, i)])
+	}
+	return est
 }
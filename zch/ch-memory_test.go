@@ -0,0 +1,62 @@
+package zch
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryEviction(t *testing.T) {
+	m := NewMemory(time.Hour, 0, MemoryOptions{MaxEntries: 3, Eviction: EvictionLRU})
+	m.Set("a", "1", 0)
+	m.Set("b", "2", 0)
+	m.Set("c", "3", 0)
+	m.Get("a")
+	m.Set("d", "4", 0)
+	if _, ok := m.Get("b"); ok {
+		t.Errorf("lru Get(b) = ok; want evicted")
+	}
+	if _, ok := m.Get("a"); !ok {
+		t.Errorf("lru Get(a) = missing; want kept")
+	}
+	st := m.Stats()
+	if st.Entries != 3 || st.Evictions != 1 || st.Hits != 2 || st.Misses != 1 {
+		t.Errorf("Stats() = %+v", st)
+	}
+
+	// 字节上限
+	m = NewMemory(time.Hour, 0, MemoryOptions{MaxBytes: 100 * 32, Eviction: EvictionLRU})
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), strings.Repeat("x", 20), 0)
+	}
+	if st = m.Stats(); st.Bytes > 100*32 {
+		t.Errorf("Stats().Bytes = %d; want <= %d", st.Bytes, 100*32)
+	}
+
+	// 热点key不会被一次性扫描冲掉
+	m = NewMemory(time.Hour, 0, MemoryOptions{MaxEntries: 100, Eviction: EvictionTinyLFU})
+	for i := 0; i < 20; i++ {
+		m.Set("hot"+strconv.Itoa(i%5), "v", 0)
+		m.Get("hot" + strconv.Itoa(i%5))
+	}
+	for i := 0; i < 1000; i++ {
+		m.Set("scan"+strconv.Itoa(i), "v", 0)
+	}
+	for i := 0; i < 5; i++ {
+		if _, ok := m.Get("hot" + strconv.Itoa(i)); !ok {
+			t.Errorf("tinylfu Get(hot%d) = missing; want kept", i)
+		}
+	}
+	if n := m.ItemCount(); n > 100 {
+		t.Errorf("ItemCount() = %d; want <= 100", n)
+	}
+
+	// 过期
+	m = NewMemory(time.Millisecond, 0)
+	m.Set("e", "1", 0)
+	time.Sleep(2 * time.Millisecond)
+	if _, ok := m.Get("e"); ok || m.Stats().Expirations != 1 {
+		t.Errorf("expired Get(e) = %v, stats %+v", ok, m.Stats())
+	}
+}
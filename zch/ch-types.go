@@ -0,0 +1,511 @@
+package zch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrWrongType = errors.New("zch: operation against a key holding the wrong kind of value")
+
+// Z
+// @Description: 有序集合成员
+type Z struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// dirty
+// @Description: 字符串值在后端被修改，删除本地L1并通知其他实例
+// @receiver l
+// @param ctx
+// @param key
+func (l *L2) dirty(ctx context.Context, key string) {
+	if l.mode == InvalidationTracking {
+		return
+	}
+	l.m.Delete(key)
+	l.invalidate(ctx, key)
+}
+
+// Incr
+// @Description: 自增1
+// @receiver l
+// @param ctx
+// @param key
+// @param ttl 首次创建时的过期时间，0则不过期
+// @return int64
+// @return error
+func (l *L2) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return l.IncrBy(ctx, key, 1, ttl)
+}
+
+// IncrBy
+// @Description: 自增n
+// @receiver l
+// @param ctx
+// @param key
+// @param n
+// @param ttl 首次创建时的过期时间，0则不过期
+// @return int64
+// @return error
+func (l *L2) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	v, err := l.store.IncrBy(ctx, key, n, ttl)
+	if err != nil {
+		return 0, err
+	}
+	l.dirty(ctx, key)
+	return v, nil
+}
+
+// HSet
+// @Description: 写入hash，value为结构体时按json tag作为字段名，非字符串字段json序列化
+// @receiver l
+// @param ctx
+// @param key
+// @param value 结构体或map[string]string
+// @return error
+func (l *L2) HSet(ctx context.Context, key string, value any) error {
+	return l.store.HSet(ctx, key, value)
+}
+
+// HGet
+// @Description: 读取hash字段，不存在返回ErrNotFound
+// @receiver l
+// @param ctx
+// @param key
+// @param field
+// @return string
+// @return error
+func (l *L2) HGet(ctx context.Context, key, field string) (string, error) {
+	return l.store.HGet(ctx, key, field)
+}
+
+// HGetAll
+// @Description: 读取整个hash到结构体或*map[string]string，不存在返回ErrNotFound
+// @receiver l
+// @param ctx
+// @param key
+// @param dst
+// @return error
+func (l *L2) HGetAll(ctx context.Context, key string, dst any) error {
+	return l.store.HGetAll(ctx, key, dst)
+}
+
+// SAdd
+// @Description: 添加集合成员
+// @receiver l
+// @param ctx
+// @param key
+// @param members
+// @return int64 新增的成员数
+// @return error
+func (l *L2) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	return l.store.SAdd(ctx, key, members...)
+}
+
+// SMembers
+// @Description: 集合全部成员，不存在返回空
+// @receiver l
+// @param ctx
+// @param key
+// @return []string
+// @return error
+func (l *L2) SMembers(ctx context.Context, key string) ([]string, error) {
+	return l.store.SMembers(ctx, key)
+}
+
+// ZAdd
+// @Description: 添加或更新有序集合成员
+// @receiver l
+// @param ctx
+// @param key
+// @param members
+// @return int64 新增的成员数
+// @return error
+func (l *L2) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	return l.store.ZAdd(ctx, key, members...)
+}
+
+// ZRangeWithScores
+// @Description: 按分数从低到高取排名start到stop的成员，负数表示倒数
+// @receiver l
+// @param ctx
+// @param key
+// @param start
+// @param stop
+// @return []Z
+// @return error
+func (l *L2) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	return l.store.ZRangeWithScores(ctx, key, start, stop)
+}
+
+// ZRevRangeWithScores
+// @Description: 按分数从高到低取排名start到stop的成员，用于排行榜
+// @receiver l
+// @param ctx
+// @param key
+// @param start
+// @param stop
+// @return []Z
+// @return error
+func (l *L2) ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	return l.store.ZRevRangeWithScores(ctx, key, start, stop)
+}
+
+// Expire
+// @Description: 设置过期时间
+// @receiver l
+// @param ctx
+// @param key
+// @param ttl
+// @return bool key不存在返回false
+// @return error
+func (l *L2) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	ok, err := l.store.Expire(ctx, key, ttl)
+	if err != nil {
+		return false, err
+	}
+	l.dirty(ctx, key)
+	return ok, nil
+}
+
+// TTL
+// @Description: 剩余有效期，永不过期返回NoExpiration，不存在返回ErrNotFound
+// @receiver l
+// @param ctx
+// @param key
+// @return time.Duration
+// @return error
+func (l *L2) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return l.store.TTL(ctx, key)
+}
+
+func (c *memory) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return c.IncrBy(ctx, key, 1, ttl)
+}
+
+func (c *memory) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	var v int64
+	err := c.mutate(key, func(e *entry) error {
+		if e.data != nil {
+			return ErrWrongType
+		}
+		if e.value != "" {
+			cur, err := strconv.ParseInt(e.value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("zch: value of %s is not an integer", key)
+			}
+			v = cur
+		}
+		v += n
+		e.value = strconv.FormatInt(v, 10)
+		if e.expiration == 0 && ttl > 0 {
+			e.expiration = time.Now().Add(ttl).UnixNano()
+		}
+		return nil
+	})
+	return v, err
+}
+
+func (c *memory) HSet(ctx context.Context, key string, value any) error {
+	m, err := toHash(value)
+	if err != nil {
+		return err
+	}
+	return c.mutate(key, func(e *entry) error {
+		h, err := dataOf(e, func() map[string]string { return map[string]string{} })
+		if err != nil {
+			return err
+		}
+		for f, v := range m {
+			h[f] = v
+		}
+		return nil
+	})
+}
+
+func (c *memory) HGet(ctx context.Context, key, field string) (string, error) {
+	var v string
+	err := c.view(key, func(e *entry) error {
+		h, err := dataOf[map[string]string](e, nil)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if v, ok = h[field]; !ok {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return v, err
+}
+
+func (c *memory) HGetAll(ctx context.Context, key string, dst any) error {
+	var m map[string]string
+	err := c.view(key, func(e *entry) error {
+		h, err := dataOf[map[string]string](e, nil)
+		if err != nil {
+			return err
+		}
+		m = make(map[string]string, len(h))
+		for f, v := range h {
+			m[f] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fromHash(m, dst)
+}
+
+func (c *memory) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	var n int64
+	err := c.mutate(key, func(e *entry) error {
+		s, err := dataOf(e, func() map[string]struct{} { return map[string]struct{}{} })
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if _, ok := s[m]; !ok {
+				s[m] = struct{}{}
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (c *memory) SMembers(ctx context.Context, key string) ([]string, error) {
+	var list []string
+	err := c.view(key, func(e *entry) error {
+		s, err := dataOf[map[string]struct{}](e, nil)
+		if err != nil {
+			return err
+		}
+		for m := range s {
+			list = append(list, m)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return []string{}, nil
+	}
+	slices.Sort(list)
+	return list, err
+}
+
+func (c *memory) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	var n int64
+	err := c.mutate(key, func(e *entry) error {
+		z, err := dataOf(e, func() map[string]float64 { return map[string]float64{} })
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if _, ok := z[m.Member]; !ok {
+				n++
+			}
+			z[m.Member] = m.Score
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (c *memory) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	return c.zrange(key, start, stop, false)
+}
+
+func (c *memory) ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	return c.zrange(key, start, stop, true)
+}
+
+// zrange
+// @Description: 与valkey一致，分数相同时按成员字典序
+// @receiver c
+// @param key
+// @param start
+// @param stop
+// @param rev
+// @return []Z
+// @return error
+func (c *memory) zrange(key string, start, stop int64, rev bool) ([]Z, error) {
+	var list []Z
+	err := c.view(key, func(e *entry) error {
+		z, err := dataOf[map[string]float64](e, nil)
+		if err != nil {
+			return err
+		}
+		for m, s := range z {
+			list = append(list, Z{Member: m, Score: s})
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return []Z{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(list, func(a, b Z) int {
+		if a.Score != b.Score {
+			if a.Score < b.Score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Member, b.Member)
+	})
+	if rev {
+		slices.Reverse(list)
+	}
+	n := int64(len(list))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	start, stop = max(start, 0), min(stop, n-1)
+	if start > stop {
+		return []Z{}, nil
+	}
+	return list[start : stop+1], nil
+}
+
+func (c *memory) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	err := c.view(key, func(e *entry) error {
+		e.expiration = time.Now().Add(ttl).UnixNano()
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *memory) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := c.view(key, func(e *entry) error {
+		if e.expiration == 0 {
+			ttl = NoExpiration
+		} else {
+			ttl = time.Until(time.Unix(0, e.expiration))
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// dataOf
+// @Description: 取条目中的hash/set/zset，create不为nil时为空条目创建
+// @param e
+// @param create
+// @return M
+// @return error
+func dataOf[M map[string]string | map[string]struct{} | map[string]float64](e *entry, create func() M) (M, error) {
+	if d, ok := e.data.(M); ok {
+		return d, nil
+	}
+	if create != nil && e.data == nil && e.value == "" {
+		d := create()
+		e.data = d
+		return d, nil
+	}
+	var zero M
+	return zero, ErrWrongType
+}
+
+// toHash
+// @Description: 结构体转hash字段，字段名取json tag
+// @param v
+// @return map[string]string
+// @return error
+func toHash(v any) (map[string]string, error) {
+	if m, ok := v.(map[string]string); ok {
+		return m, nil
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("zch: hash value must be struct or map[string]string, got %T", v)
+	}
+	m := make(map[string]string)
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name, ok := hashField(rt.Field(i))
+		if !ok {
+			continue
+		}
+		fv := rv.Field(i)
+		if fv.Kind() == reflect.String {
+			m[name] = fv.String()
+			continue
+		}
+		b, err := sonic.Marshal(fv.Interface())
+		if err != nil {
+			return nil, err
+		}
+		m[name] = string(b)
+	}
+	return m, nil
+}
+
+// fromHash
+// @Description: hash字段写入结构体或*map[string]string
+// @param m
+// @param dst
+// @return error
+func fromHash(m map[string]string, dst any) error {
+	if p, ok := dst.(*map[string]string); ok {
+		*p = m
+		return nil
+	}
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("zch: hash dst must be pointer to struct or *map[string]string, got %T", dst)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		name, ok := hashField(rt.Field(i))
+		if !ok {
+			continue
+		}
+		raw, ok := m[name]
+		if !ok {
+			continue
+		}
+		fv := rv.Field(i)
+		if fv.Kind() == reflect.String {
+			fv.SetString(raw)
+			continue
+		}
+		if err := sonic.UnmarshalString(raw, fv.Addr().Interface()); err != nil {
+			return fmt.Errorf("zch: hash field %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func hashField(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return f.Name, true
+}
@@ -0,0 +1,71 @@
+package zch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryTypes(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(time.Hour, 0)
+
+	if v, _ := m.Incr(ctx, "cnt", time.Minute); v != 1 {
+		t.Errorf("Incr = %d; want 1", v)
+	}
+	if v, _ := m.IncrBy(ctx, "cnt", 5, time.Hour); v != 6 {
+		t.Errorf("IncrBy = %d; want 6", v)
+	}
+	if ttl, _ := m.TTL(ctx, "cnt"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL(cnt) = %v; want first ttl kept", ttl)
+	}
+
+	type profile struct {
+		Name  string   `json:"name"`
+		Age   int      `json:"age"`
+		Tags  []string `json:"tags"`
+		Skip  string   `json:"-"`
+		inner string
+	}
+	if err := m.HSet(ctx, "u:1", profile{Name: "zoe", Age: 18, Tags: []string{"a"}, Skip: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	var p profile
+	if err := m.HGetAll(ctx, "u:1", &p); err != nil || p.Name != "zoe" || p.Age != 18 || len(p.Tags) != 1 || p.Skip != "" {
+		t.Errorf("HGetAll = %+v, %v", p, err)
+	}
+	if v, _ := m.HGet(ctx, "u:1", "age"); v != "18" {
+		t.Errorf("HGet(age) = %s; want 18", v)
+	}
+	if _, err := m.HGet(ctx, "u:1", "none"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("HGet(none) = %v; want ErrNotFound", err)
+	}
+	if _, err := m.SAdd(ctx, "u:1", "x"); !errors.Is(err, ErrWrongType) {
+		t.Errorf("SAdd(hash) = %v; want ErrWrongType", err)
+	}
+
+	if n, _ := m.SAdd(ctx, "s", "b", "a", "b"); n != 2 {
+		t.Errorf("SAdd = %d; want 2", n)
+	}
+	if s, _ := m.SMembers(ctx, "s"); len(s) != 2 || s[0] != "a" {
+		t.Errorf("SMembers = %v", s)
+	}
+
+	_, _ = m.ZAdd(ctx, "rank", Z{"a", 3}, Z{"b", 1}, Z{"c", 2})
+	_, _ = m.ZAdd(ctx, "rank", Z{"b", 5})
+	if z, _ := m.ZRevRangeWithScores(ctx, "rank", 0, 1); len(z) != 2 || z[0].Member != "b" || z[1].Member != "a" {
+		t.Errorf("ZRevRangeWithScores = %v", z)
+	}
+	if z, _ := m.ZRangeWithScores(ctx, "rank", -1, -1); len(z) != 1 || z[0].Member != "b" {
+		t.Errorf("ZRangeWithScores(-1,-1) = %v", z)
+	}
+
+	if ok, _ := m.Expire(ctx, "s", time.Millisecond); !ok {
+		t.Errorf("Expire(s) = false")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if _, err := m.TTL(ctx, "s"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("TTL(expired) = %v; want ErrNotFound", err)
+	}
+}
@@ -2,9 +2,14 @@ package zch
 
 import (
 	"context"
+	"errors"
 	"github.com/go-playground/validator/v10"
 	"github.com/valkey-io/valkey-go"
 	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -14,15 +19,53 @@ type Config struct {
 	Addrs         []string `json:"addrs" yaml:"addrs" validate:"required" note:"地址"`
 	Db            int      `json:"db" yaml:"db" note:"数据库"`
 	Password      string   `json:"password" yaml:"password" note:"密码"`
+	Invalidation  string   `json:"invalidation" yaml:"invalidation" validate:"omitempty,oneof=tracking pubsub none" note:"L1失效同步方式,tracking/pubsub/none"`
+	Channel       string   `json:"channel" yaml:"channel" note:"pubsub失效广播频道"`
+	Codec         string   `json:"codec" yaml:"codec" note:"GetAs/SetAs序列化方式,json/msgpack/gob"`
+	Prefix        string   `json:"prefix" yaml:"prefix" note:"命名空间键前缀,用于区分应用和环境,如 app:prod:"`
+	Compress      int      `json:"compress" yaml:"compress" note:"GetAs/SetAs超过该字节数时压缩,0不压缩"`
+	L1MaxEntries  int      `json:"l1_max_entries" yaml:"l1_max_entries" note:"L1最大条目数,0不限制"`
+	L1MaxBytes    int64    `json:"l1_max_bytes" yaml:"l1_max_bytes" note:"L1最大字节数,默认64MB"`
+	L1Eviction    string   `json:"l1_eviction" yaml:"l1_eviction" validate:"omitempty,oneof=lru tinylfu" note:"L1淘汰策略,lru/tinylfu"`
+	Snapshot      string   `json:"snapshot" yaml:"snapshot" note:"L1快照文件,启动时加载并定期保存,为空不启用;仅none模式生效,pubsub/tracking模式忽略"`
+	SnapshotEvery string   `json:"snapshot_every" yaml:"snapshot_every" note:"快照保存间隔,默认5m"`
 }
 
 func (c *Config) Validate() error {
+	c.Invalidation = zutil.FirstTruth(c.Invalidation, InvalidationTracking)
+	c.Channel = zutil.FirstTruth(c.Channel, "zch:invalidate")
+	c.Codec = zutil.FirstTruth(c.Codec, CodecJSON)
+	c.L1MaxBytes = zutil.FirstTruth(c.L1MaxBytes, 64<<20)
+	c.L1Eviction = zutil.FirstTruth(c.L1Eviction, EvictionTinyLFU)
+	c.SnapshotEvery = zutil.FirstTruth(c.SnapshotEvery, "5m")
 	return validator.New().Struct(c)
 }
 
+const (
+	InvalidationTracking = "tracking" // valkey客户端缓存(RESP3 tracking)，由服务端推送失效
+	InvalidationPubsub   = "pubsub"   // 写入方广播失效消息，各实例删除本地L1
+	InvalidationNone     = "none"     // 不同步，L1过期前可能读到旧值
+)
+
 type L2 struct {
-	m *Memory
-	v valkey.Client
+	m     *Memory
+	v     valkey.Client
+	store Store
+
+	mode    string
+	channel string
+	id      string
+	prefix  string
+
+	snapshot     string
+	snapshotStop chan struct{}
+	snapshotDone chan struct{}
+	closeOnce    sync.Once
+
+	codec             Codec
+	compressThreshold int
+
+	locker *Locker
 }
 
 var l2 *L2
@@ -49,6 +92,8 @@ func NewL2(conf *Config, opts ...valkey.ClientOption) *L2 {
 			InitAddress: conf.Addrs,
 			Password:    conf.Password,
 			SelectDB:    conf.Db,
+			// tracking模式的客户端缓存沿用L1的字节上限
+			CacheSizeEachConn: int(conf.L1MaxBytes),
 		},
 	}
 	expire, err := time.ParseDuration(ops.Expiration)
@@ -65,13 +110,140 @@ func NewL2(conf *Config, opts ...valkey.ClientOption) *L2 {
 	if internal == 0 {
 		internal = time.Minute * 5
 	}
+	codec, err := codecOf(conf.Codec)
+	if err != nil {
+		zlog.Fatalf("%v", err)
+	}
 	if l2 == nil {
 		l2 = &L2{
-			m: NewMemory(expire, internal),
-			v: NewValkey(ops.ValkeyOptions),
+			m: NewMemory(expire, internal, MemoryOptions{
+				MaxEntries: conf.L1MaxEntries,
+				MaxBytes:   conf.L1MaxBytes,
+				Eviction:   conf.L1Eviction,
+			}),
+			mode:              conf.Invalidation,
+			channel:           conf.Channel,
+			prefix:            conf.Prefix,
+			id:                strconv.FormatInt(time.Now().UnixNano(), 36),
+			codec:             codec,
+			compressThreshold: conf.Compress,
 		}
+		l2.v = l2.newValkey(ops.ValkeyOptions)
+		l2.store = NewValkeyStore(l2.v)
+		l2.locker = NewLocker(l2.store, conf.Prefix)
+		if l2.mode == InvalidationPubsub {
+			go l2.subscribe()
+		}
+		l2.restore(conf)
+	}
+	zlog.Infof("init zch success, invalidation=%s", l2.mode)
+	return l2
+}
+
+// restore
+// @Description: 加载L1快照并定期保存，冷启动时避免请求全部穿透到valkey；
+// 停机期间的写入和失效广播都会丢失，快照内的值可能旧于valkey直到条目过期，
+// 只有本就接受过期前脏读的none模式加载，pubsub和tracking模式忽略
+// @receiver l
+// @param conf
+func (l *L2) restore(conf *Config) {
+	if conf.Snapshot == "" {
+		return
+	}
+	if l.mode != InvalidationNone {
+		zlog.Warnf("zch snapshot ignored in %s mode", l.mode)
+		return
+	}
+	every, err := time.ParseDuration(conf.SnapshotEvery)
+	if err != nil || every <= 0 {
+		zlog.Fatalf("parse snapshot interval error: %v", err)
+	}
+	if err = l.m.LoadFile(conf.Snapshot); err != nil {
+		zlog.Warnf("zch load snapshot failed: %v", err)
+	}
+	l.snapshot = conf.Snapshot
+	l.snapshotStop, l.snapshotDone = make(chan struct{}), make(chan struct{})
+	go l.snapshotLoop(conf.Snapshot, every)
+}
+
+// newValkey
+// @Description: tracking模式需要RESP3，服务端不支持时降级为pubsub
+// @receiver l
+// @param opt
+// @return valkey.Client
+func (l *L2) newValkey(opt valkey.ClientOption) valkey.Client {
+	if l.mode != InvalidationTracking {
+		opt.DisableCache = true
+		return NewValkey(opt)
+	}
+	client, err := valkey.NewClient(opt)
+	if errors.Is(err, valkey.ErrNoCache) {
+		zlog.Warnf("valkey client-side caching unsupported, fallback to pubsub")
+		l.mode = InvalidationPubsub
+		opt.DisableCache = true
+		return NewValkey(opt)
+	}
+	if err != nil {
+		zlog.Fatalf("valkey client failed: %v", err)
+	}
+	return client
+}
+
+// subscribe
+// @Description: 订阅失效广播，断线重连后清空L1，避免漏掉的消息导致脏读
+// @receiver l
+func (l *L2) subscribe() {
+	ctx := context.Background()
+	for {
+		err := l.v.Receive(ctx, l.v.B().Subscribe().Channel(l.channel).Build(), func(msg valkey.PubSubMessage) {
+			id, key, ok := strings.Cut(msg.Message, "|")
+			if !ok || id == l.id {
+				return
+			}
+			if pattern, ok := strings.CutPrefix(key, patternMark); ok {
+				l.m.DeleteByPattern(pattern)
+			} else {
+				l.m.Delete(key)
+			}
+		})
+		if errors.Is(err, valkey.ErrClosing) {
+			return
+		}
+		zlog.Warnf("zch invalidation subscribe interrupted: %v", err)
+		l.m.Flush()
+		time.Sleep(time.Second)
+	}
+}
+
+// invalidate
+// @Description: 通知其他实例删除L1
+// @receiver l
+// @param ctx
+// @param key
+func (l *L2) invalidate(ctx context.Context, key string) {
+	if l.mode != InvalidationPubsub {
+		return
+	}
+	if err := l.v.Do(ctx, l.v.B().Publish().Channel(l.channel).Message(l.id+"|"+key).Build()).Error(); err != nil {
+		zlog.Warnf("zch publish invalidation failed: %v", err)
+	}
+}
+
+// NewMemoryL2
+// @Description: 以进程内Store替换全局二级缓存，无需valkey即可测试依赖zch的代码
+// @param ops
+// @return *L2
+func NewMemoryL2(ops ...MemoryOptions) *L2 {
+	codec, _ := codecOf(CodecJSON)
+	store := NewMemoryStore(NewMemory(NoExpiration, time.Minute, ops...))
+	l2 = &L2{
+		m:      NewMemory(time.Hour, time.Minute, ops...),
+		store:  store,
+		mode:   InvalidationNone,
+		id:     strconv.FormatInt(time.Now().UnixNano(), 36),
+		codec:  codec,
+		locker: NewLocker(store),
 	}
-	zlog.Infof("init zch success")
 	return l2
 }
 
@@ -88,36 +260,74 @@ func M() *Memory {
 	return l2.m
 }
 func V() valkey.Client {
-	if l2 == nil {
+	if l2 == nil || l2.v == nil {
 		zlog.Fatalf("Please call NewL2 before using V")
 	}
 	return l2.v
 }
 
+// S
+// @Description: 二级缓存的后端
+// @return Store
+func S() Store {
+	if l2 == nil {
+		zlog.Fatalf("Please call NewL2 before using S")
+	}
+	return l2.store
+}
+
 func (l *L2) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
-	if err := l.v.Do(ctx, l.v.B().Set().Key(key).Value(value).Ex(expiration).Build()).Error(); err == nil {
-		l.m.Set(key, value, l1(expiration))
-		return nil
-	} else {
+	if err := l.store.Set(ctx, key, value, expiration); err != nil {
 		return err
 	}
+	if l.mode != InvalidationTracking {
+		l.m.Set(key, value, l1(expiration))
+		l.invalidate(ctx, key)
+	}
+	return nil
+}
+
+// SetNX
+// @Description: 键不存在时写入，用于回源后回填缓存，避免覆盖并发写入的新值
+// @receiver l
+// @param ctx
+// @param key
+// @param value
+// @param expiration
+// @return bool 是否写入
+// @return error
+func (l *L2) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	ok, err := l.store.SetNX(ctx, key, value, expiration)
+	if err != nil || !ok {
+		return ok, err
+	}
+	if l.mode != InvalidationTracking {
+		l.m.Set(key, value, l1(expiration))
+		l.invalidate(ctx, key)
+	}
+	return true, nil
 }
 
 func (l *L2) Get(ctx context.Context, key string) (interface{}, error) {
+	if l.mode == InvalidationTracking {
+		// 客户端缓存有效期取服务端剩余TTL和l1上限中较小者
+		v, err := l.v.DoCache(ctx, l.v.B().Get().Key(key).Cache(), l1(time.Hour)).ToString()
+		if err != nil {
+			return nil, notFound(err)
+		}
+		return v, nil
+	}
 	if v, ok := l.m.Get(key); ok {
 		return v, nil
-	} else {
-		if v, err := l.v.Do(ctx, l.v.B().Get().Key(key).Build()).ToString(); err == nil {
-
-			exp, err := l.v.Do(ctx, l.v.B().Ttl().Key(key).Build()).ToInt64()
-			if err == nil && exp > 0 {
-				l.m.Set(key, v, l1(time.Second*time.Duration(exp)))
-			}
-			return v, nil
-		} else {
-			return nil, err
-		}
 	}
+	v, err := l.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if exp, err := l.store.TTL(ctx, key); err == nil && exp > 0 {
+		l.m.Set(key, v, l1(exp))
+	}
+	return v, nil
 }
 
 // Del
@@ -128,11 +338,15 @@ func (l *L2) Get(ctx context.Context, key string) (interface{}, error) {
 // @return error
 func (l *L2) Del(ctx context.Context, key string) error {
 	l.m.Delete(key)
-	return l.v.Do(ctx, l.v.B().Del().Key(key).Build()).Error()
+	if err := l.store.Del(ctx, key); err != nil {
+		return err
+	}
+	l.invalidate(ctx, key)
+	return nil
 }
 
 // Flush
-// @Description: 释放二级缓存
+// @Description: 清空本地L1，不影响valkey；删除valkey中的键使用DelByPattern或Namespace.Flush
 // @receiver l
 // @param ctx
 // @return error
@@ -141,6 +355,14 @@ func (l *L2) Flush(ctx context.Context) error {
 	return nil
 }
 
+// Stats
+// @Description: L1命中、淘汰统计，tracking模式下L1由valkey客户端缓存承担，此处不计
+// @receiver l
+// @return MemoryStats
+func (l *L2) Stats() MemoryStats {
+	return l.m.Stats()
+}
+
 // l1
 // @Description: 计算l1缓存的过期时间, l1总是比l2短一些, 且最长是30min，减少内存占用且防止NX虚锁
 // @param expiration
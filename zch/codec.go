@@ -0,0 +1,177 @@
+package zch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/valkey-io/valkey-go"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("zch: key not found")
+
+// Codec
+// @Description: 序列化方式，可通过RegisterCodec扩展
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+const (
+	CodecJSON    = "json"
+	CodecMsgpack = "msgpack"
+	CodecGob     = "gob"
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return sonic.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return sonic.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var codecs sync.Map
+
+func init() {
+	RegisterCodec(CodecJSON, jsonCodec{})
+	RegisterCodec(CodecMsgpack, msgpackCodec{})
+	RegisterCodec(CodecGob, gobCodec{})
+}
+
+// RegisterCodec
+// @Description: 注册序列化方式，Config.Codec按名称选择
+// @param name
+// @param c
+func RegisterCodec(name string, c Codec) {
+	codecs.Store(name, c)
+}
+
+func codecOf(name string) (Codec, error) {
+	if c, ok := codecs.Load(name); ok {
+		return c.(Codec), nil
+	}
+	return nil, fmt.Errorf("zch: unknown codec %s", name)
+}
+
+// 值的首字节标记是否压缩
+const (
+	flagRaw  byte = 0
+	flagGzip byte = 1
+)
+
+// encode
+// @Description: 序列化，超过阈值时gzip压缩
+// @param c
+// @param threshold 0则不压缩
+// @param v
+// @return []byte
+// @return error
+func encode(c Codec, threshold int, v any) ([]byte, error) {
+	b, err := c.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if threshold <= 0 || len(b) < threshold {
+		return append([]byte{flagRaw}, b...), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(flagGzip)
+	w := gzip.NewWriter(&buf)
+	if _, err = w.Write(b); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(c Codec, data []byte, v any) error {
+	if len(data) == 0 {
+		return errors.New("zch: empty value")
+	}
+	switch data[0] {
+	case flagRaw:
+		return c.Unmarshal(data[1:], v)
+	case flagGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return c.Unmarshal(b, v)
+	default:
+		return fmt.Errorf("zch: unknown value flag %d, value not written by SetAs", data[0])
+	}
+}
+
+// SetAs
+// @Description: 按配置的序列化方式写入二级缓存
+// @param ctx
+// @param key
+// @param value
+// @param expiration
+// @return error
+func SetAs[T any](ctx context.Context, key string, value T, expiration time.Duration) error {
+	l := L()
+	b, err := encode(l.codec, l.compressThreshold, value)
+	if err != nil {
+		return err
+	}
+	return l.Set(ctx, key, string(b), expiration)
+}
+
+// GetAs
+// @Description: 读取SetAs写入的值，不存在返回ErrNotFound
+// @param ctx
+// @param key
+// @return T
+// @return error
+func GetAs[T any](ctx context.Context, key string) (T, error) {
+	var v T
+	l := L()
+	raw, err := l.Get(ctx, key)
+	if err != nil {
+		return v, err
+	}
+	err = decode(l.codec, []byte(raw.(string)), &v)
+	return v, err
+}
+
+// notFound
+// @Description: 将valkey的nil转换为ErrNotFound
+// @param err
+// @return error
+func notFound(err error) error {
+	if valkey.IsValkeyNil(err) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package zch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	type item struct {
+		Name  string
+		Count int
+		Tags  []string
+	}
+	in := item{Name: strings.Repeat("zch", 100), Count: 3, Tags: []string{"a", "b"}}
+	for _, name := range []string{CodecJSON, CodecMsgpack, CodecGob} {
+		c, err := codecOf(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, threshold := range []int{0, 64} {
+			b, err := encode(c, threshold, in)
+			if err != nil {
+				t.Fatalf("%s encode: %v", name, err)
+			}
+			if want := map[bool]byte{true: flagGzip, false: flagRaw}[threshold > 0]; b[0] != want {
+				t.Errorf("%s threshold=%d flag = %d; want %d", name, threshold, b[0], want)
+			}
+			var out item
+			if err = decode(c, b, &out); err != nil {
+				t.Fatalf("%s decode: %v", name, err)
+			}
+			if out.Name != in.Name || out.Count != in.Count || len(out.Tags) != 2 {
+				t.Errorf("%s threshold=%d roundtrip = %+v", name, threshold, out)
+			}
+		}
+	}
+	if _, err := codecOf("xml"); err == nil {
+		t.Errorf("codecOf(xml) = nil error; want error")
+	}
+	var out item
+	if err := decode(jsonCodec{}, []byte(`{"Name":"x"}`), &out); err == nil {
+		t.Errorf("decode plain json = nil error; want error")
+	}
+}
@@ -0,0 +1,220 @@
+package zch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"golang.org/x/sync/singleflight"
+	"math"
+	"math/rand/v2"
+	"reflect"
+	"time"
+)
+
+// Loader
+// @Description: 缓存未命中时的加载函数，返回ErrNotFound时会缓存空值
+type Loader[T any] func(ctx context.Context) (T, error)
+
+// LoadOptions
+// @Description: GetOrLoad的可选配置
+type LoadOptions struct {
+	Lock        bool          `note:"是否用分布式锁保证只有一个实例回源"`
+	LockTtl     time.Duration `note:"锁的有效期，需大于回源耗时"`
+	LockWait    time.Duration `note:"未抢到锁时等待其他实例回源的最长时间，超时后自行回源"`
+	NegativeTtl time.Duration `note:"空值缓存时间，防止缓存穿透"`
+	Beta        float64       `note:"XFetch提前刷新系数，越大越早刷新，小于0关闭"`
+}
+
+func (o *LoadOptions) Validate() {
+	o.LockTtl = zutil.FirstTruth(o.LockTtl, 10*time.Second)
+	o.LockWait = zutil.FirstTruth(o.LockWait, 3*time.Second)
+	o.NegativeTtl = zutil.FirstTruth(o.NegativeTtl, 30*time.Second)
+	o.Beta = zutil.FirstTruth(o.Beta, 1)
+}
+
+// envelope
+// @Description: 缓存值及其元数据
+type envelope[T any] struct {
+	V T     `json:"v" msgpack:"v"`
+	N bool  `json:"n,omitempty" msgpack:"n,omitempty"` // 空值
+	D int64 `json:"d" msgpack:"d"`                     // 回源耗时，毫秒
+	E int64 `json:"e" msgpack:"e"`                     // 过期时间，毫秒时间戳，0为不过期
+}
+
+// early
+// @Description: XFetch，按回源耗时和随机数概率性地提前刷新，避免同时过期；不过期的值不刷新
+// @receiver e
+// @param beta
+// @return bool
+func (e *envelope[T]) early(beta float64) bool {
+	if beta < 0 || e.N || e.E <= 0 {
+		return false
+	}
+	gap := float64(e.D) * beta * -math.Log(1-rand.Float64())
+	return float64(time.Now().UnixMilli())+gap >= float64(e.E)
+}
+
+var flight singleflight.Group
+
+// flightKey
+// @Description: 合并回源的键，同一个key以不同类型读取时不能共享结果
+// @param key
+// @return string
+func flightKey[T any](key string) string {
+	return reflect.TypeFor[T]().String() + "|" + key
+}
+
+// GetOrLoad
+// @Description: 旁路缓存，未命中时回源并写入，同进程内并发合并为一次回源
+// @param ctx
+// @param key
+// @param ttl
+// @param loader
+// @param ops
+// @return T
+// @return error 回源返回ErrNotFound或命中空值时返回ErrNotFound
+func GetOrLoad[T any](ctx context.Context, key string, ttl time.Duration, loader Loader[T], ops ...LoadOptions) (T, error) {
+	var zero T
+	o := LoadOptions{}
+	if len(ops) > 0 {
+		o = ops[0]
+	}
+	o.Validate()
+	l := L()
+	fk := flightKey[T](key)
+
+	if env, err := getEnvelope[T](ctx, l, key); err == nil {
+		if env.early(o.Beta) {
+			// 后台刷新，期间继续返回旧值
+			go func() {
+				_, _, _ = flight.Do("refresh:"+fk, func() (any, error) {
+					return load(context.WithoutCancel(ctx), l, key, ttl, loader, &o, false)
+				})
+			}()
+		}
+		if env.N {
+			return zero, ErrNotFound
+		}
+		return env.V, nil
+	} else if !errors.Is(err, ErrNotFound) {
+		zlog.Warnf("zch get %s failed, will reload: %v", key, err)
+	}
+
+	v, err, _ := flight.Do(fk, func() (any, error) {
+		return load(context.WithoutCancel(ctx), l, key, ttl, loader, &o, true)
+	})
+	if err != nil || v == nil {
+		return zero, err
+	}
+	t, ok := v.(T)
+	if !ok {
+		return zero, fmt.Errorf("zch: load %s got %T, want %T", key, v, zero)
+	}
+	return t, nil
+}
+
+// load
+// @Description: 回源并写入缓存
+// @param ctx
+// @param l
+// @param key
+// @param ttl
+// @param loader
+// @param o
+// @param wait 未抢到锁时是否等待其他实例的结果，后台刷新不等待
+// @return any
+// @return error
+func load[T any](ctx context.Context, l *L2, key string, ttl time.Duration, loader Loader[T], o *LoadOptions, wait bool) (any, error) {
+	if o.Lock {
+		mu, err := l.locker.TryLock(ctx, key, o.LockTtl)
+		switch {
+		case err == nil:
+			defer func() {
+				if err := mu.Unlock(ctx); err != nil {
+					zlog.Warnf("zch unlock %s failed: %v", key, err)
+				}
+			}()
+		case !errors.Is(err, ErrLockNotAcquired):
+			zlog.Warnf("zch lock %s failed: %v", key, err)
+		case !wait:
+			return nil, nil
+		default:
+			if env, err := waitEnvelope[T](ctx, l, key, o.LockWait); err == nil {
+				if env.N {
+					return nil, ErrNotFound
+				}
+				return env.V, nil
+			}
+		}
+	}
+
+	start := time.Now()
+	v, err := loader(ctx)
+	cost := time.Since(start)
+	if errors.Is(err, ErrNotFound) {
+		if err := setEnvelope(ctx, l, key, &envelope[T]{N: true}, o.NegativeTtl); err != nil {
+			zlog.Warnf("zch set negative %s failed: %v", key, err)
+		}
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = setEnvelope(ctx, l, key, &envelope[T]{V: v, D: cost.Milliseconds()}, ttl); err != nil {
+		zlog.Warnf("zch set %s failed: %v", key, err)
+	}
+	return v, nil
+}
+
+// waitEnvelope
+// @Description: 等待其他实例回源写入
+// @param ctx
+// @param l
+// @param key
+// @param timeout
+// @return *envelope[T]
+// @return error
+func waitEnvelope[T any](ctx context.Context, l *L2, key string, timeout time.Duration) (*envelope[T], error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline.C:
+			return nil, ErrNotFound
+		case <-ticker.C:
+			if env, err := getEnvelope[T](ctx, l, key); err == nil {
+				return env, nil
+			}
+		}
+	}
+}
+
+func getEnvelope[T any](ctx context.Context, l *L2, key string) (*envelope[T], error) {
+	raw, err := l.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	env := new(envelope[T])
+	if err = decode(l.codec, []byte(raw.(string)), env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func setEnvelope[T any](ctx context.Context, l *L2, key string, env *envelope[T], ttl time.Duration) error {
+	env.E = 0
+	if ttl > 0 {
+		env.E = time.Now().Add(ttl).UnixMilli()
+	}
+	b, err := encode(l.codec, l.compressThreshold, env)
+	if err != nil {
+		return err
+	}
+	return l.Set(ctx, key, string(b), ttl)
+}
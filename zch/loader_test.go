@@ -0,0 +1,137 @@
+package zch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeEarly(t *testing.T) {
+	now := time.Now().UnixMilli()
+	tests := []struct {
+		name string
+		env  envelope[string]
+		beta float64
+		want bool
+	}{
+		{"expired", envelope[string]{D: 10, E: now - 1}, 1, true},
+		{"far from expiry", envelope[string]{D: 10, E: now + int64(time.Hour/time.Millisecond)}, 1, false},
+		{"disabled", envelope[string]{D: 10, E: now - 1}, -1, false},
+		{"negative", envelope[string]{N: true, E: now - 1}, 1, false},
+		{"no expiry", envelope[string]{D: int64(time.Hour / time.Millisecond)}, 100, false},
+	}
+	for _, tt := range tests {
+		if got := tt.env.early(tt.beta); got != tt.want {
+			t.Errorf("early(%s) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetOrLoadSingleflight(t *testing.T) {
+	NewMemoryL2()
+	ctx := context.Background()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		<-release
+		return "v", nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := GetOrLoad(ctx, "sf", time.Minute, loader); err != nil || v != "v" {
+				t.Errorf("GetOrLoad(sf) = %s, %v; want v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	// 同一个key以其他类型读取时不共享回源结果
+	n, err := GetOrLoad(ctx, "sf", time.Minute, func(ctx context.Context) (int, error) { return 7, nil })
+	if err != nil || n != 7 {
+		t.Errorf("GetOrLoad[int](sf) = %d, %v; want 7", n, err)
+	}
+	close(release)
+	wg.Wait()
+	if c := calls.Load(); c != 1 {
+		t.Errorf("loader calls = %d; want 1", c)
+	}
+}
+
+func TestGetOrLoadNegative(t *testing.T) {
+	NewMemoryL2()
+	ctx := context.Background()
+	var calls atomic.Int32
+	loader := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		return "", ErrNotFound
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := GetOrLoad(ctx, "missing", time.Minute, loader); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetOrLoad(missing) = %v; want %v", err, ErrNotFound)
+		}
+	}
+	if c := calls.Load(); c != 1 {
+		t.Errorf("loader calls = %d; want 1", c)
+	}
+}
+
+func TestGetOrLoadNoExpiry(t *testing.T) {
+	l := NewMemoryL2()
+	ctx := context.Background()
+	var calls atomic.Int32
+	loader := func(ctx context.Context) (string, error) {
+		calls.Add(1)
+		return "v", nil
+	}
+	for i := 0; i < 5; i++ {
+		if v, err := GetOrLoad(ctx, "forever", 0, loader, LoadOptions{Beta: 100}); err != nil || v != "v" {
+			t.Errorf("GetOrLoad(forever) = %s, %v; want v", v, err)
+		}
+	}
+	if env, err := getEnvelope[string](ctx, l, "forever"); err != nil || env.E != 0 {
+		t.Errorf("envelope = %+v, %v; want E=0", env, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if c := calls.Load(); c != 1 {
+		t.Errorf("loader calls = %d; want 1", c)
+	}
+}
+
+func TestGetOrLoadEarlyRefresh(t *testing.T) {
+	l := NewMemoryL2()
+	ctx := context.Background()
+	// 回源耗时远大于剩余有效期，必然提前刷新
+	if err := setEnvelope(ctx, l, "early", &envelope[string]{V: "old", D: int64(time.Hour / time.Millisecond)}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	refreshed := make(chan struct{})
+	loader := func(ctx context.Context) (string, error) {
+		defer close(refreshed)
+		return "new", nil
+	}
+	if v, err := GetOrLoad(ctx, "early", time.Minute, loader, LoadOptions{Beta: 100}); err != nil || v != "old" {
+		t.Errorf("GetOrLoad(early) = %s, %v; want old while refreshing", v, err)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatalf("background refresh not started")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		env, err := getEnvelope[string](ctx, l, "early")
+		if err == nil && env.V == "new" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("refreshed value = %+v, %v; want new", env, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,225 @@
+package zch
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/valkey-io/valkey-go"
+	"github.com/zohu/zfiber/zlog"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+)
+
+const LockPrefix = "lock:"
+
+var (
+	ErrLockNotAcquired = errors.New("zch: lock not acquired")
+	ErrLockNotHeld     = errors.New("zch: lock not held")
+	ErrLockTtl         = errors.New("zch: lock ttl must be positive")
+)
+
+// LockStore
+// @Description: 锁的存储，所有操作都需校验持有者token
+type LockStore interface {
+	Acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	Extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, key, token string) (bool, error)
+}
+
+// Locker
+// @Description: 分布式锁
+type Locker struct {
+	store      LockStore
+	prefix     string
+	backoffMin time.Duration
+	backoffMax time.Duration
+}
+
+// NewLocker
+// @Description: 创建分布式锁，键格式为 {prefix}lock:{name}
+// @param store
+// @param prefix 键前缀，通常为Config.Prefix
+// @return *Locker
+func NewLocker(store LockStore, prefix ...string) *Locker {
+	l := &Locker{
+		store:      store,
+		backoffMin: 20 * time.Millisecond,
+		backoffMax: time.Second,
+	}
+	if len(prefix) > 0 {
+		l.prefix = prefix[0]
+	}
+	return l
+}
+
+// Mutex
+// @Description: 持有中的锁，持有期间自动续期
+type Mutex struct {
+	store LockStore
+	key   string
+	token string
+	ttl   time.Duration
+
+	stop     chan struct{}
+	lost     chan struct{}
+	stopOnce sync.Once
+	lostOnce sync.Once
+}
+
+// Lock
+// @Description: 阻塞获取锁，退避重试直到成功或ctx结束
+// @receiver l
+// @param ctx
+// @param name
+// @param ttl 锁的有效期，必须大于0，持有期间每ttl/3续期一次
+// @return *Mutex
+// @return error
+func (l *Locker) Lock(ctx context.Context, name string, ttl time.Duration) (*Mutex, error) {
+	if ttl <= 0 {
+		return nil, ErrLockTtl
+	}
+	backoff := l.backoffMin
+	for {
+		mu, err := l.TryLock(ctx, name, ttl)
+		if !errors.Is(err, ErrLockNotAcquired) {
+			return mu, err
+		}
+		// 加随机抖动，避免竞争者同时重试
+		wait := backoff/2 + mrand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, l.backoffMax)
+	}
+}
+
+// TryLock
+// @Description: 尝试获取锁，已被持有时返回ErrLockNotAcquired
+// @receiver l
+// @param ctx
+// @param name
+// @param ttl 必须大于0，不过期的锁在持有者崩溃后无法释放
+// @return *Mutex
+// @return error
+func (l *Locker) TryLock(ctx context.Context, name string, ttl time.Duration) (*Mutex, error) {
+	if ttl <= 0 {
+		return nil, ErrLockTtl
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	mu := &Mutex{
+		store: l.store,
+		key:   l.prefix + LockPrefix + name,
+		token: hex.EncodeToString(b),
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+		lost:  make(chan struct{}),
+	}
+	ok, err := l.store.Acquire(ctx, mu.key, mu.token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLockNotAcquired
+	}
+	go mu.renew()
+	return mu, nil
+}
+
+// Unlock
+// @Description: 释放锁，锁已过期或被他人持有时返回ErrLockNotHeld
+// @receiver m
+// @param ctx
+// @return error
+func (m *Mutex) Unlock(ctx context.Context) error {
+	m.stopOnce.Do(func() { close(m.stop) })
+	ok, err := m.store.Release(ctx, m.key, m.token)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Lost
+// @Description: 续期失败（锁已过期或被他人持有）时关闭，持有者应停止临界区操作
+// @receiver m
+// @return <-chan struct{}
+func (m *Mutex) Lost() <-chan struct{} {
+	return m.lost
+}
+
+// renew
+// @Description: 每ttl/3续期一次，网络错误时在有效期内重试
+// @receiver m
+func (m *Mutex) renew() {
+	ticker := time.NewTicker(max(m.ttl/3, 10*time.Millisecond))
+	defer ticker.Stop()
+	deadline := time.Now().Add(m.ttl)
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), m.ttl/3+time.Second)
+			ok, err := m.store.Extend(ctx, m.key, m.token, m.ttl)
+			cancel()
+			switch {
+			case err == nil && ok:
+				deadline = time.Now().Add(m.ttl)
+				continue
+			case err != nil && time.Now().Before(deadline):
+				zlog.Warnf("zch extend lock %s failed: %v", m.key, err)
+				continue
+			}
+			m.lostOnce.Do(func() { close(m.lost) })
+			return
+		}
+	}
+}
+
+// Lock
+// @Description: 使用二级缓存的valkey阻塞获取锁
+// @param ctx
+// @param name
+// @param ttl
+// @return *Mutex
+// @return error
+func Lock(ctx context.Context, name string, ttl time.Duration) (*Mutex, error) {
+	return L().locker.Lock(ctx, name, ttl)
+}
+
+// TryLock
+// @Description: 使用二级缓存的valkey尝试获取锁
+// @param ctx
+// @param name
+// @param ttl
+// @return *Mutex
+// @return error
+func TryLock(ctx context.Context, name string, ttl time.Duration) (*Mutex, error) {
+	return L().locker.TryLock(ctx, name, ttl)
+}
+
+// NewValkeyLockStore
+// @Description: 基于SET NX PX和Lua比较删除的锁存储
+// @param client
+// @return LockStore
+func NewValkeyLockStore(client valkey.Client) LockStore {
+	return NewValkeyStore(client)
+}
+
+// NewMemoryLockStore
+// @Description: 进程内锁存储，用于测试和单节点部署
+// @param m
+// @return LockStore
+func NewMemoryLockStore(m *Memory) LockStore {
+	return NewMemoryStore(m)
+}
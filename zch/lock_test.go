@@ -0,0 +1,71 @@
+package zch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLocker(t *testing.T) {
+	ctx := context.Background()
+	locker := NewLocker(NewMemoryLockStore(NewMemory(time.Hour, time.Minute)))
+
+	mu, err := locker.TryLock(ctx, "job", 60*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = locker.TryLock(ctx, "job", time.Second); !errors.Is(err, ErrLockNotAcquired) {
+		t.Errorf("TryLock(held) = %v; want ErrLockNotAcquired", err)
+	}
+	// 超过ttl仍被续期持有
+	time.Sleep(150 * time.Millisecond)
+	if _, err = locker.TryLock(ctx, "job", time.Second); !errors.Is(err, ErrLockNotAcquired) {
+		t.Errorf("TryLock(renewed) = %v; want ErrLockNotAcquired", err)
+	}
+
+	// 阻塞等待直到释放
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = mu.Unlock(ctx)
+	}()
+	mu2, err := locker.Lock(ctx, "job", time.Second)
+	if err != nil {
+		t.Fatalf("Lock after unlock = %v", err)
+	}
+	if err = mu.Unlock(ctx); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("Unlock(stale) = %v; want ErrLockNotHeld", err)
+	}
+
+	// ctx取消
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err = locker.Lock(cctx, "job", time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Lock(canceled) = %v; want DeadlineExceeded", err)
+	}
+	if err = mu2.Unlock(ctx); err != nil {
+		t.Errorf("Unlock = %v", err)
+	}
+}
+
+func TestLockerTtlAndPrefix(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(NewMemory(time.Hour, time.Minute))
+	locker := NewLocker(store, "app:")
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if _, err := locker.TryLock(ctx, "job", ttl); !errors.Is(err, ErrLockTtl) {
+			t.Errorf("TryLock(ttl=%v) = %v; want %v", ttl, err, ErrLockTtl)
+		}
+		if _, err := locker.Lock(ctx, "job", ttl); !errors.Is(err, ErrLockTtl) {
+			t.Errorf("Lock(ttl=%v) = %v; want %v", ttl, err, ErrLockTtl)
+		}
+	}
+	mu, err := locker.TryLock(ctx, "job", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mu.Unlock(ctx)
+	if _, err = store.Get(ctx, "app:lock:job"); err != nil {
+		t.Errorf("lock key app:lock:job = %v; want held", err)
+	}
+}
@@ -0,0 +1,221 @@
+package zch
+
+import (
+	"context"
+	"errors"
+	"github.com/zohu/zfiber/zlog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Namespace
+// @Description: 带版本的键空间，Bump后旧版本的键全部失效，无需SCAN；缓存结构体变更时可Bump或改名
+type Namespace struct {
+	l      *L2
+	name   string
+	verKey string
+}
+
+// NS
+// @Description: 全局二级缓存下的命名空间
+// @param name
+// @return *Namespace
+func NS(name string) *Namespace {
+	return L().NS(name)
+}
+
+// NS
+// @Description: 命名空间，键格式为 {Config.Prefix}{name}:v{version}:{key}
+// @receiver l
+// @param name
+// @return *Namespace
+func (l *L2) NS(name string) *Namespace {
+	return &Namespace{
+		l:      l,
+		name:   name,
+		verKey: l.prefix + "zch:ns:" + name,
+	}
+}
+
+// Key
+// @Description: 当前版本下的完整键
+// @receiver n
+// @param ctx
+// @param key
+// @return string
+func (n *Namespace) Key(ctx context.Context, key string) string {
+	return n.l.prefix + n.name + ":v" + n.version(ctx) + ":" + key
+}
+
+func (n *Namespace) Get(ctx context.Context, key string) (interface{}, error) {
+	return n.l.Get(ctx, n.Key(ctx, key))
+}
+
+func (n *Namespace) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	return n.l.Set(ctx, n.Key(ctx, key), value, expiration)
+}
+
+func (n *Namespace) Del(ctx context.Context, key string) error {
+	return n.l.Del(ctx, n.Key(ctx, key))
+}
+
+// Bump
+// @Description: 版本号加一，命名空间内的旧键不再被读取，随各自TTL过期
+// @receiver n
+// @param ctx
+// @return int64 新版本号
+// @return error
+func (n *Namespace) Bump(ctx context.Context) (int64, error) {
+	v, err := n.l.store.Incr(ctx, n.verKey, 0)
+	if err != nil {
+		return 0, err
+	}
+	n.l.dirty(ctx, n.verKey)
+	return v, nil
+}
+
+// Flush
+// @Description: 删除命名空间内所有版本的键
+// @receiver n
+// @param ctx
+// @return int64 删除的键数
+// @return error
+func (n *Namespace) Flush(ctx context.Context) (int64, error) {
+	return n.l.DelByPattern(ctx, escapeGlob(n.l.prefix+n.name+":")+"*")
+}
+
+// version
+// @Description: 当前版本号，本地缓存；pubsub模式Bump会广播失效可缓存较久，none模式最多延迟1秒
+// @receiver n
+// @param ctx
+// @return string
+func (n *Namespace) version(ctx context.Context) string {
+	if n.l.mode == InvalidationTracking {
+		v, err := n.l.Get(ctx, n.verKey)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				zlog.Warnf("zch get namespace %s version failed: %v", n.name, err)
+			}
+			return "0"
+		}
+		return v.(string)
+	}
+	if v, ok := n.l.m.Get(n.verKey); ok {
+		return v
+	}
+	v, err := n.l.store.Get(ctx, n.verKey)
+	if errors.Is(err, ErrNotFound) {
+		v = "0"
+	} else if err != nil {
+		zlog.Warnf("zch get namespace %s version failed: %v", n.name, err)
+		return "0"
+	}
+	ttl := time.Second
+	if n.l.mode == InvalidationPubsub {
+		ttl = 10 * time.Minute
+	}
+	n.l.m.Set(n.verKey, v, ttl)
+	return v
+}
+
+// DelByPattern
+// @Description: 按glob模式删除L1和后端中的键，valkey使用SCAN+UNLINK分批执行，不阻塞服务端
+// @receiver l
+// @param ctx
+// @param pattern 同valkey的MATCH语法，支持* ? [abc]
+// @return int64 后端删除的键数
+// @return error
+func (l *L2) DelByPattern(ctx context.Context, pattern string) (int64, error) {
+	l.m.DeleteByPattern(pattern)
+	n, err := l.store.DelByPattern(ctx, pattern)
+	if err != nil {
+		return n, err
+	}
+	l.invalidate(ctx, patternMark+pattern)
+	return n, nil
+}
+
+// DeleteByPattern
+// @Description: 按glob模式删除
+// @receiver c
+// @param pattern
+// @return int 删除的条目数
+func (c *memory) DeleteByPattern(pattern string) int {
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, el := range s.items {
+			if re.MatchString(k) {
+				s.remove(el)
+				n++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// patternMark
+// @Description: 失效广播中标记按模式删除
+const patternMark = "\x00"
+
+// globRegexp
+// @Description: valkey glob转正则，按模式删除的频率低，每次编译不缓存，避免动态模式无限增长
+// @param pattern
+// @return *regexp.Regexp
+// @return error
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+j]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			b.WriteString("[" + class + "]")
+			i += j
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// escapeGlob
+// @Description: 转义glob特殊字符
+// @param s
+// @return string
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(`*?[]\`, s[i]) >= 0 {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
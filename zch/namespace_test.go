@@ -0,0 +1,60 @@
+package zch
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"u?er", "user", true},
+		{"k[ab]", "kb", true},
+		{"k[^ab]", "ka", false},
+		{"k[a-c]", "kc", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"缓存:*", "缓存:1", true},
+	}
+	for _, tt := range tests {
+		re, err := globRegexp(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := re.MatchString(tt.key); got != tt.want {
+			t.Errorf("globRegexp(%s).Match(%s) = %v; want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	ctx := context.Background()
+	l := NewMemoryL2()
+	ns := l.NS("user")
+	if err := ns.Set(ctx, "1", "zoe", 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := ns.Get(ctx, "1"); v != "zoe" {
+		t.Errorf("Get = %v; want zoe", v)
+	}
+	if v, _ := ns.Bump(ctx); v != 1 {
+		t.Errorf("Bump = %d; want 1", v)
+	}
+	if _, err := ns.Get(ctx, "1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Bump = %v; want ErrNotFound", err)
+	}
+	_ = ns.Set(ctx, "2", "x", 0)
+	_ = l.Set(ctx, "other", "y", 0)
+	if n, _ := ns.Flush(ctx); n != 2 {
+		t.Errorf("Flush = %d; want 2", n)
+	}
+	if v, _ := l.Get(ctx, "other"); v != "y" {
+		t.Errorf("Get(other) = %v; want kept", v)
+	}
+}
@@ -0,0 +1,265 @@
+package zch
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/valkey-io/valkey-go"
+	"github.com/zohu/zfiber/zlog"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotVersion = 1
+
+type snapshotItem struct {
+	Key        string
+	Value      string
+	Hash       map[string]string
+	Set        []string
+	ZSet       map[string]float64
+	Expiration int64 // 绝对时间，停机期间同样计入TTL
+}
+
+type snapshot struct {
+	Version int
+	At      time.Time
+	Items   []snapshotItem
+}
+
+// Save
+// @Description: 导出快照，保留各条目的过期时间
+// @receiver c
+// @param w
+// @return error
+func (c *memory) Save(w io.Writer) error {
+	snap := snapshot{Version: snapshotVersion, At: time.Now()}
+	now := time.Now().UnixNano()
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, el := range s.items {
+			e := el.Value.(*entry)
+			if e.expired(now) {
+				continue
+			}
+			item := snapshotItem{Key: k, Value: e.value, Expiration: e.expiration}
+			switch d := e.data.(type) {
+			case map[string]string:
+				item.Hash = make(map[string]string, len(d))
+				for f, v := range d {
+					item.Hash[f] = v
+				}
+			case map[string]struct{}:
+				for m := range d {
+					item.Set = append(item.Set, m)
+				}
+			case map[string]float64:
+				item.ZSet = make(map[string]float64, len(d))
+				for m, v := range d {
+					item.ZSet[m] = v
+				}
+			}
+			snap.Items = append(snap.Items, item)
+		}
+		s.mu.Unlock()
+	}
+	return gob.NewEncoder(w).Encode(&snap)
+}
+
+// Load
+// @Description: 导入快照，已过期的条目跳过，同名条目被覆盖
+// @receiver c
+// @param r
+// @return error
+func (c *memory) Load(r io.Reader) error {
+	var snap snapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("zch: unsupported snapshot version %d", snap.Version)
+	}
+	now := time.Now().UnixNano()
+	for _, item := range snap.Items {
+		e := &entry{key: item.Key, value: item.Value, expiration: item.Expiration}
+		if e.expired(now) {
+			continue
+		}
+		switch {
+		case item.Hash != nil:
+			e.data = item.Hash
+		case item.Set != nil:
+			set := make(map[string]struct{}, len(item.Set))
+			for _, m := range item.Set {
+				set[m] = struct{}{}
+			}
+			e.data = set
+		case item.ZSet != nil:
+			e.data = item.ZSet
+		}
+		s := c.shard(item.Key)
+		s.mu.Lock()
+		if el, ok := s.items[item.Key]; ok {
+			s.remove(el)
+		}
+		s.insert(e)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// SaveFile
+// @Description: 快照写入文件，先写临时文件再重命名，避免中途崩溃留下损坏的快照
+// @receiver c
+// @param path
+// @return error
+func (c *memory) SaveFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err = c.Save(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadFile
+// @Description: 从文件导入快照，文件不存在时忽略
+// @receiver c
+// @param path
+// @return error
+func (c *memory) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Load(f)
+}
+
+// snapshotLoop
+// @Description: 定期保存L1快照，Close时退出
+// @receiver l
+// @param path
+// @param interval
+func (l *L2) snapshotLoop(path string, interval time.Duration) {
+	defer close(l.snapshotDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.snapshotStop:
+			return
+		case <-ticker.C:
+		}
+		if err := l.m.SaveFile(path); err != nil {
+			zlog.Warnf("zch save snapshot failed: %v", err)
+		}
+	}
+}
+
+// SaveSnapshot
+// @Description: 立即保存L1快照，未配置Snapshot时忽略，用于停机前调用
+// @receiver l
+// @return error
+func (l *L2) SaveSnapshot() error {
+	if l.snapshot == "" {
+		return nil
+	}
+	return l.m.SaveFile(l.snapshot)
+}
+
+// Close
+// @Description: 停止定期快照并保存最后一次，再关闭valkey连接；需在请求处理完后调用，重复调用无副作用
+// @receiver l
+// @return error
+func (l *L2) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		if l.snapshotStop != nil {
+			close(l.snapshotStop)
+			<-l.snapshotDone
+		}
+		err = l.SaveSnapshot()
+		if l.v != nil {
+			l.v.Close()
+		}
+	})
+	return err
+}
+
+// Warm
+// @Description: 全局二级缓存预热
+// @param ctx
+// @param keys
+// @return error
+func Warm(ctx context.Context, keys ...string) error {
+	return L().Warm(ctx, keys...)
+}
+
+// Warm
+// @Description: 从后端批量预取热点key到L1，不存在的key跳过
+// @receiver l
+// @param ctx
+// @param keys
+// @return error
+func (l *L2) Warm(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if l.v == nil {
+		for _, k := range keys {
+			if _, err := l.Get(ctx, k); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	}
+	if l.mode == InvalidationTracking {
+		cmds := make([]valkey.CacheableTTL, 0, len(keys))
+		for _, k := range keys {
+			cmds = append(cmds, valkey.CT(l.v.B().Get().Key(k).Cache(), l1(time.Hour)))
+		}
+		for _, r := range l.v.DoMultiCache(ctx, cmds...) {
+			if err := r.Error(); err != nil && !valkey.IsValkeyNil(err) {
+				return err
+			}
+		}
+		return nil
+	}
+	cmds := make(valkey.Commands, 0, len(keys)*2)
+	for _, k := range keys {
+		cmds = append(cmds, l.v.B().Get().Key(k).Build(), l.v.B().Pttl().Key(k).Build())
+	}
+	resps := l.v.DoMulti(ctx, cmds...)
+	for i, k := range keys {
+		v, err := resps[i*2].ToString()
+		if valkey.IsValkeyNil(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ms, err := resps[i*2+1].AsInt64(); err == nil && ms > 0 {
+			l.m.Set(k, v, l1(time.Duration(ms)*time.Millisecond))
+		}
+	}
+	return nil
+}
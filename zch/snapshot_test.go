@@ -0,0 +1,64 @@
+package zch
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemorySnapshot(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory(time.Hour, 0)
+	m.Set("a", "1", time.Minute)
+	m.Set("b", "2", NoExpiration)
+	m.Set("gone", "x", time.Millisecond)
+	_, _ = m.SAdd(ctx, "s", "x", "y")
+	time.Sleep(5 * time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	n := NewMemory(time.Hour, 0)
+	if err := n.Load(&buf); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	if v, ok := n.Get("a"); !ok || v != "1" {
+		t.Errorf("Get(a) = %s, %v; want 1, true", v, ok)
+	}
+	if ttl, _ := n.TTL(ctx, "a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL(a) = %v; want (0, 1m]", ttl)
+	}
+	if ttl, _ := n.TTL(ctx, "b"); ttl != NoExpiration {
+		t.Errorf("TTL(b) = %v; want %v", ttl, NoExpiration)
+	}
+	if _, ok := n.Get("gone"); ok {
+		t.Errorf("Get(gone) = ok; want expired")
+	}
+	if s, _ := n.SMembers(ctx, "s"); len(s) != 2 {
+		t.Errorf("SMembers(s) = %v; want 2 members", s)
+	}
+}
+
+func TestSnapshotClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "l1.snap")
+	l := NewMemoryL2()
+	l.restore(&Config{Snapshot: path, SnapshotEvery: "10ms"})
+	l.m.Set("a", "1", NoExpiration)
+	time.Sleep(30 * time.Millisecond)
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	// Close等待快照协程退出，之后不再写文件
+	_ = os.Remove(path)
+	time.Sleep(30 * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("snapshot written after Close(): %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("Close() again = %v", err)
+	}
+}
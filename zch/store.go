@@ -0,0 +1,304 @@
+package zch
+
+import (
+	"context"
+	"github.com/valkey-io/valkey-go"
+	"strconv"
+	"time"
+)
+
+// Store
+// @Description: 缓存后端，valkey和进程内实现语义一致，ttl为0表示不过期
+type Store interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+	Del(ctx context.Context, keys ...string) error
+	DelByPattern(ctx context.Context, pattern string) (int64, error)
+
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	TTL(ctx context.Context, key string) (time.Duration, error)
+
+	HSet(ctx context.Context, key string, value any) error
+	HGet(ctx context.Context, key, field string) (string, error)
+	HGetAll(ctx context.Context, key string, dst any) error
+	SAdd(ctx context.Context, key string, members ...string) (int64, error)
+	SMembers(ctx context.Context, key string) ([]string, error)
+	ZAdd(ctx context.Context, key string, members ...Z) (int64, error)
+	ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error)
+	ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error)
+
+	LockStore
+}
+
+// ========================= valkey =========================
+
+type valkeyStore struct {
+	v valkey.Client
+}
+
+// NewValkeyStore
+// @Description: valkey后端
+// @param client
+// @return Store
+func NewValkeyStore(client valkey.Client) Store {
+	return &valkeyStore{v: client}
+}
+
+func (s *valkeyStore) Get(ctx context.Context, key string) (string, error) {
+	v, err := s.v.Do(ctx, s.v.B().Get().Key(key).Build()).ToString()
+	return v, notFound(err)
+}
+func (s *valkeyStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return s.v.Do(ctx, s.v.B().Set().Key(key).Value(value).Build()).Error()
+	}
+	return s.v.Do(ctx, s.v.B().Set().Key(key).Value(value).Px(ttl).Build()).Error()
+}
+func (s *valkeyStore) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	var ok bool
+	var err error
+	if ttl <= 0 {
+		ok, err = s.v.Do(ctx, s.v.B().Set().Key(key).Value(value).Nx().Build()).AsBool()
+	} else {
+		ok, err = s.v.Do(ctx, s.v.B().Set().Key(key).Value(value).Nx().Px(ttl).Build()).AsBool()
+	}
+	if valkey.IsValkeyNil(err) {
+		return false, nil
+	}
+	return ok, err
+}
+func (s *valkeyStore) Del(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.v.Do(ctx, s.v.B().Del().Key(keys...).Build()).Error()
+}
+
+// scanBatch
+// @Description: 每批SCAN/UNLINK的键数
+const scanBatch = 500
+
+func (s *valkeyStore) DelByPattern(ctx context.Context, pattern string) (int64, error) {
+	var n int64
+	// 集群模式需逐个主节点SCAN，副本的键与主节点重复，UNLINK按键路由
+	for _, node := range s.v.Nodes() {
+		if !isPrimary(ctx, node) {
+			continue
+		}
+		var cursor uint64
+		for {
+			e, err := node.Do(ctx, node.B().Scan().Cursor(cursor).Match(pattern).Count(scanBatch).Build()).AsScanEntry()
+			if err != nil {
+				return n, err
+			}
+			if len(e.Elements) > 0 {
+				cmds := make(valkey.Commands, 0, len(e.Elements))
+				for _, k := range e.Elements {
+					cmds = append(cmds, s.v.B().Unlink().Key(k).Build())
+				}
+				for _, r := range s.v.DoMulti(ctx, cmds...) {
+					d, err := r.AsInt64()
+					if err != nil {
+						return n, err
+					}
+					n += d
+				}
+			}
+			if cursor = e.Cursor; cursor == 0 {
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// isPrimary
+// @Description: 按ROLE判断是否主节点，查询失败时按主节点处理，宁可多扫一遍也不漏删
+// @param ctx
+// @param node
+// @return bool
+func isPrimary(ctx context.Context, node valkey.Client) bool {
+	role, err := node.Do(ctx, node.B().Role().Build()).ToArray()
+	if err != nil || len(role) == 0 {
+		return true
+	}
+	r, err := role[0].ToString()
+	return err != nil || r == "master"
+}
+
+// incrScript
+// @Description: 自增，key没有过期时间时设置ttl，保证计数窗口从首次写入开始
+var incrScript = valkey.NewLuaScript(`local v = redis.call("INCRBY", KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call("PTTL", KEYS[1]) < 0 then redis.call("PEXPIRE", KEYS[1], ARGV[2]) end
+return v`)
+
+func (s *valkeyStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return s.IncrBy(ctx, key, 1, ttl)
+}
+func (s *valkeyStore) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+	return incrScript.Exec(ctx, s.v, []string{key}, []string{strconv.FormatInt(n, 10), strconv.FormatInt(ttl.Milliseconds(), 10)}).AsInt64()
+}
+func (s *valkeyStore) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	n, err := s.v.Do(ctx, s.v.B().Pexpire().Key(key).Milliseconds(ttl.Milliseconds()).Build()).AsInt64()
+	return n == 1, err
+}
+func (s *valkeyStore) TTL(ctx context.Context, key string) (time.Duration, error) {
+	ms, err := s.v.Do(ctx, s.v.B().Pttl().Key(key).Build()).AsInt64()
+	if err != nil {
+		return 0, err
+	}
+	switch ms {
+	case -2:
+		return 0, ErrNotFound
+	case -1:
+		return NoExpiration, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func (s *valkeyStore) HSet(ctx context.Context, key string, value any) error {
+	m, err := toHash(value)
+	if err != nil {
+		return err
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	cmd := s.v.B().Hset().Key(key).FieldValue()
+	for f, v := range m {
+		cmd = cmd.FieldValue(f, v)
+	}
+	return s.v.Do(ctx, cmd.Build()).Error()
+}
+func (s *valkeyStore) HGet(ctx context.Context, key, field string) (string, error) {
+	v, err := s.v.Do(ctx, s.v.B().Hget().Key(key).Field(field).Build()).ToString()
+	return v, notFound(err)
+}
+func (s *valkeyStore) HGetAll(ctx context.Context, key string, dst any) error {
+	m, err := s.v.Do(ctx, s.v.B().Hgetall().Key(key).Build()).AsStrMap()
+	if err != nil {
+		return err
+	}
+	if len(m) == 0 {
+		return ErrNotFound
+	}
+	return fromHash(m, dst)
+}
+func (s *valkeyStore) SAdd(ctx context.Context, key string, members ...string) (int64, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	return s.v.Do(ctx, s.v.B().Sadd().Key(key).Member(members...).Build()).AsInt64()
+}
+func (s *valkeyStore) SMembers(ctx context.Context, key string) ([]string, error) {
+	return s.v.Do(ctx, s.v.B().Smembers().Key(key).Build()).AsStrSlice()
+}
+func (s *valkeyStore) ZAdd(ctx context.Context, key string, members ...Z) (int64, error) {
+	if len(members) == 0 {
+		return 0, nil
+	}
+	cmd := s.v.B().Zadd().Key(key).ScoreMember()
+	for _, m := range members {
+		cmd = cmd.ScoreMember(m.Score, m.Member)
+	}
+	return s.v.Do(ctx, cmd.Build()).AsInt64()
+}
+func (s *valkeyStore) ZRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	cmd := s.v.B().Zrange().Key(key).Min(strconv.FormatInt(start, 10)).Max(strconv.FormatInt(stop, 10)).Withscores().Build()
+	return zscores(s.v.Do(ctx, cmd).AsZScores())
+}
+func (s *valkeyStore) ZRevRangeWithScores(ctx context.Context, key string, start, stop int64) ([]Z, error) {
+	cmd := s.v.B().Zrange().Key(key).Min(strconv.FormatInt(start, 10)).Max(strconv.FormatInt(stop, 10)).Rev().Withscores().Build()
+	return zscores(s.v.Do(ctx, cmd).AsZScores())
+}
+
+func zscores(list []valkey.ZScore, err error) ([]Z, error) {
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Z, len(list))
+	for i, z := range list {
+		res[i] = Z{Member: z.Member, Score: z.Score}
+	}
+	return res, nil
+}
+
+var (
+	unlockScript = valkey.NewLuaScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+	extendScript = valkey.NewLuaScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`)
+)
+
+func (s *valkeyStore) Acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return s.SetNX(ctx, key, token, ttl)
+}
+func (s *valkeyStore) Extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	n, err := extendScript.Exec(ctx, s.v, []string{key}, []string{token, strconv.FormatInt(ttl.Milliseconds(), 10)}).AsInt64()
+	return n == 1, err
+}
+func (s *valkeyStore) Release(ctx context.Context, key, token string) (bool, error) {
+	n, err := unlockScript.Exec(ctx, s.v, []string{key}, []string{token}).AsInt64()
+	return n == 1, err
+}
+
+// ========================= memory =========================
+
+type memoryStore struct {
+	*Memory
+}
+
+// NewMemoryStore
+// @Description: 进程内后端，用于测试和单节点部署，m为nil时新建不限容量的Memory
+// @param m
+// @return Store
+func NewMemoryStore(m *Memory) Store {
+	if m == nil {
+		m = NewMemory(NoExpiration, time.Minute)
+	}
+	return &memoryStore{Memory: m}
+}
+
+// ttl
+// @Description: Store的0表示不过期，Memory的0表示默认过期时间
+// @param d
+// @return time.Duration
+func (s *memoryStore) ttl(d time.Duration) time.Duration {
+	if d <= 0 {
+		return NoExpiration
+	}
+	return d
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (string, error) {
+	if v, ok := s.Memory.Get(key); ok {
+		return v, nil
+	}
+	return "", ErrNotFound
+}
+func (s *memoryStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	s.Memory.Set(key, value, s.ttl(ttl))
+	return nil
+}
+func (s *memoryStore) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	return s.Memory.SetNX(key, value, s.ttl(ttl)) == nil, nil
+}
+func (s *memoryStore) Del(ctx context.Context, keys ...string) error {
+	for _, k := range keys {
+		s.Memory.Delete(k)
+	}
+	return nil
+}
+func (s *memoryStore) DelByPattern(ctx context.Context, pattern string) (int64, error) {
+	return int64(s.Memory.DeleteByPattern(pattern)), nil
+}
+func (s *memoryStore) Acquire(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return s.SetNX(ctx, key, token, ttl)
+}
+func (s *memoryStore) Extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return s.compareAndExpire(key, token, ttl), nil
+}
+func (s *memoryStore) Release(ctx context.Context, key, token string) (bool, error) {
+	return s.compareAndDelete(key, token), nil
+}
@@ -127,3 +127,44 @@ func AesDecryptCFB(encrypted, key []byte) (decrypted []byte, err error) {
 	stream.XORKeyStream(encrypted, encrypted)
 	return encrypted, nil
 }
+
+// ========================= GCM =========================
+
+// AesEncryptGCM
+// @Description: 带认证的加密，随机nonce放在密文前；相同明文每次密文不同
+// @param data
+// @param key 16/24/32字节
+// @param additional 附加认证数据，解密时需相同，可为nil
+// @return encrypted
+// @return err
+func AesEncryptGCM(data, key, additional []byte) (encrypted []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, additional), nil
+}
+
+func AesDecryptGCM(encrypted, key, additional []byte) (decrypted []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, errors.New("aes decrypt error")
+	}
+	nonce, encrypted := encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, encrypted, additional)
+}
@@ -67,3 +67,17 @@ func TestAes(t *testing.T) {
 		}
 	}
 }
+
+func TestAesGCM(t *testing.T) {
+	key := []byte("1234567890123456")
+	d, err := AesEncryptGCM([]byte("hello world"), key, []byte("phone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := AesDecryptGCM(d, key, []byte("phone")); err != nil || string(s) != "hello world" {
+		t.Errorf("AesDecryptGCM() = %s, %v; want hello world", s, err)
+	}
+	if _, err := AesDecryptGCM(d, key, []byte("email")); err == nil {
+		t.Errorf("AesDecryptGCM() with other additional data = nil; want error")
+	}
+}
@@ -0,0 +1,18 @@
+package zcpt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HmacSha256
+// @Description: hex(hmac_sha256(key, data))
+// @param data
+// @param key
+// @return string
+func HmacSha256(data, key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,346 @@
+package zdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// Auditable
+// @Description: 实现该接口的模型在创建、更新、删除时写入审计日志，返回不记录的列名，如密码
+type Auditable interface {
+	AuditOmit() []string
+}
+
+// AuditLog
+// @Description: 审计日志，与业务变更在同一事务写入
+type AuditLog struct {
+	Id        int64                        `json:"id,string" gorm:"primaryKey"`
+	Table     string                       `json:"table" gorm:"column:table_name;not null;index:idx_audit_log_record,priority:1;comment:表名"`
+	RecordId  string                       `json:"record_id" gorm:"not null;index:idx_audit_log_record,priority:2;comment:主键,联合主键逗号分隔"`
+	Action    string                       `json:"action" gorm:"not null;comment:操作,create/update/delete"`
+	Diff      JSON[map[string]AuditChange] `json:"diff" gorm:"not null;comment:变更的列"`
+	Actor     string                       `json:"actor" gorm:"not null;default:'';comment:操作人"`
+	RequestId string                       `json:"request_id" gorm:"not null;default:'';comment:请求ID"`
+	CreatedAt time.Time                    `json:"created_at" gorm:"not null"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_log"
+}
+
+// AuditChange
+// @Description: 列的变更，值按接口输出的JSON记录，Encrypted列为脱敏值
+type AuditChange struct {
+	Old json.RawMessage `json:"old,omitempty"`
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+type actorKey struct{}
+type requestIdKey struct{}
+
+// WithActor
+// @Description: 把操作人写入ctx，用于审计日志和deleted_by，zauth认证后自动写入
+// @param ctx
+// @param actor
+// @return context.Context
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom
+// @Description: ctx中的操作人
+// @param ctx
+// @return string
+func ActorFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	a, _ := ctx.Value(actorKey{}).(string)
+	return a
+}
+
+// WithRequestId
+// @Description: 把请求ID写入ctx，用于审计日志
+// @param ctx
+// @param id
+// @return context.Context
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestIdFrom
+// @Description: ctx中的请求ID
+// @param ctx
+// @return string
+func RequestIdFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// History
+// @Description: 记录的变更历史，按时间倒序
+// @param ctx
+// @param id 主键，联合主键逗号分隔
+// @param limit <=0时不限制
+// @return []AuditLog
+// @return error
+func History[M any](ctx context.Context, id any, limit int) ([]AuditLog, error) {
+	db := DB(ctx)
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(new(M)); err != nil {
+		return nil, err
+	}
+	q := db.Where("table_name = ? AND record_id = ?", stmt.Schema.Table, fmt.Sprint(id)).Order("id DESC")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	var logs []AuditLog
+	return logs, q.Find(&logs).Error
+}
+
+// ========================= callbacks =========================
+
+const auditBeforeKey = "zdb:audit_before"
+
+// registerAudit
+// @Description: 注册审计回调；更新和删除前锁定并读取旧值，之后按主键读取新值比较，全表更新或删除不记录
+// @param db
+// @return error
+func registerAudit(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().After("gorm:create").Before("gorm:commit_or_rollback_transaction").Register("zdb:audit", func(tx *gorm.DB) {
+			auditAfter(tx, AuditCreate)
+		}),
+		cb.Update().Before("gorm:update").Register("zdb:audit_before", auditBefore),
+		cb.Update().After("gorm:update").Before("gorm:commit_or_rollback_transaction").Register("zdb:audit", func(tx *gorm.DB) {
+			auditAfter(tx, AuditUpdate)
+		}),
+		cb.Delete().Before("gorm:delete").Register("zdb:audit_before", auditBefore),
+		cb.Delete().After("gorm:delete").Before("gorm:commit_or_rollback_transaction").Register("zdb:audit", func(tx *gorm.DB) {
+			auditAfter(tx, AuditDelete)
+		}),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// auditOmit
+// @Description: 模型是否需要审计，及不记录的列
+// @param sch
+// @return map[string]bool
+// @return bool
+func auditOmit(sch *schema.Schema) (map[string]bool, bool) {
+	if sch == nil {
+		return nil, false
+	}
+	a, ok := reflect.New(sch.ModelType).Interface().(Auditable)
+	if !ok {
+		return nil, false
+	}
+	omit := make(map[string]bool)
+	for _, col := range a.AuditOmit() {
+		omit[col] = true
+	}
+	return omit, true
+}
+
+// auditBefore
+// @Description: 按语句条件和模型主键锁定并读取旧值
+// @param tx
+func auditBefore(tx *gorm.DB) {
+	stmt := tx.Statement
+	if tx.Error != nil {
+		return
+	}
+	if _, ok := auditOmit(stmt.Schema); !ok {
+		return
+	}
+	var conds []clause.Expression
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			conds = append(conds, where.Exprs...)
+		}
+	}
+	for _, rv := range []reflect.Value{stmt.ReflectValue, reflect.ValueOf(stmt.Model)} {
+		if !rv.IsValid() {
+			continue
+		}
+		if in, ok := primaryIn(stmt, rv); ok {
+			conds = append(conds, in)
+		}
+	}
+	if len(conds) == 0 {
+		return
+	}
+	before := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+	if err := auditSession(tx).Table(stmt.Table).Clauses(clause.Where{Exprs: conds}, clause.Locking{Strength: "UPDATE"}).Find(before.Interface()).Error; err != nil {
+		_ = tx.AddError(err)
+		return
+	}
+	tx.InstanceSet(auditBeforeKey, before.Elem())
+}
+
+// auditAfter
+// @Description: 比较旧值和新值写入审计日志
+// @param tx
+// @param action
+func auditAfter(tx *gorm.DB, action string) {
+	stmt := tx.Statement
+	if tx.Error != nil || tx.RowsAffected == 0 {
+		return
+	}
+	omit, ok := auditOmit(stmt.Schema)
+	if !ok {
+		return
+	}
+	// 新值：创建时取模型，更新时按旧值的主键重新读取，删除时为空
+	olds, news := map[string]reflect.Value{}, map[string]reflect.Value{}
+	var ids []string
+	collect := func(rv reflect.Value, into map[string]reflect.Value) {
+		each(rv, func(item reflect.Value) {
+			id := recordId(stmt, item)
+			if _, seen := olds[id]; !seen {
+				if _, seen = news[id]; !seen {
+					ids = append(ids, id)
+				}
+			}
+			into[id] = item
+		})
+	}
+	if action == AuditCreate {
+		collect(stmt.ReflectValue, news)
+	} else {
+		v, ok := tx.InstanceGet(auditBeforeKey)
+		if !ok {
+			return
+		}
+		before := v.(reflect.Value)
+		collect(before, olds)
+		if action == AuditUpdate && before.Len() > 0 {
+			in, _ := primaryIn(stmt, before)
+			after := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+			if err := auditSession(tx).Unscoped().Table(stmt.Table).Clauses(clause.Where{Exprs: []clause.Expression{in}}).Find(after.Interface()).Error; err != nil {
+				_ = tx.AddError(err)
+				return
+			}
+			collect(after.Elem(), news)
+		}
+	}
+	actor, requestId := ActorFrom(stmt.Context), RequestIdFrom(stmt.Context)
+	var logs []AuditLog
+	for _, id := range ids {
+		diff := auditDiff(stmt, omit, olds[id], news[id])
+		if len(diff) == 0 {
+			continue
+		}
+		logs = append(logs, AuditLog{
+			Table:     stmt.Schema.Table,
+			RecordId:  id,
+			Action:    action,
+			Diff:      NewJSON(diff),
+			Actor:     actor,
+			RequestId: requestId,
+		})
+	}
+	if len(logs) == 0 {
+		return
+	}
+	if err := auditSession(tx).Create(&logs).Error; err != nil {
+		_ = tx.AddError(fmt.Errorf("zdb: write audit log: %w", err))
+	}
+}
+
+// auditSession
+// @Description: 复用语句所在的事务，不触发模型钩子
+// @param tx
+// @return *gorm.DB
+func auditSession(tx *gorm.DB) *gorm.DB {
+	db := tx.Session(&gorm.Session{NewDB: true, SkipHooks: true})
+	if tx.Statement.Unscoped {
+		db = db.Unscoped()
+	}
+	return db
+}
+
+// auditDiff
+// @Description: 变化的列，before或after无效时记录全部列
+// @param stmt
+// @param omit
+// @param before
+// @param after
+// @return map[string]AuditChange
+func auditDiff(stmt *gorm.Statement, omit map[string]bool, before, after reflect.Value) map[string]AuditChange {
+	diff := make(map[string]AuditChange)
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" || omit[field.DBName] {
+			continue
+		}
+		var change AuditChange
+		if before.IsValid() {
+			v, _ := field.ValueOf(stmt.Context, before)
+			change.Old, _ = sonic.Marshal(v)
+		}
+		if after.IsValid() {
+			v, _ := field.ValueOf(stmt.Context, after)
+			change.New, _ = sonic.Marshal(v)
+		}
+		if before.IsValid() && after.IsValid() && string(change.Old) == string(change.New) {
+			continue
+		}
+		diff[field.DBName] = change
+	}
+	return diff
+}
+
+// primaryIn
+// @Description: rv中非零主键的IN条件
+// @param stmt
+// @param rv
+// @return clause.Expression
+// @return bool
+func primaryIn(stmt *gorm.Statement, rv reflect.Value) (clause.Expression, bool) {
+	if len(stmt.Schema.PrimaryFields) == 0 {
+		return nil, false
+	}
+	_, values := schema.GetIdentityFieldValuesMap(stmt.Context, reflect.Indirect(rv), stmt.Schema.PrimaryFields)
+	column, vars := schema.ToQueryValues(clause.CurrentTable, stmt.Schema.PrimaryFieldDBNames, values)
+	if len(vars) == 0 {
+		return nil, false
+	}
+	return clause.IN{Column: column, Values: vars}, true
+}
+
+// recordId
+// @Description: 主键值，联合主键逗号分隔
+// @param stmt
+// @param item
+// @return string
+func recordId(stmt *gorm.Statement, item reflect.Value) string {
+	ids := make([]string, 0, len(stmt.Schema.PrimaryFields))
+	for _, f := range stmt.Schema.PrimaryFields {
+		v, _ := f.ValueOf(stmt.Context, item)
+		ids = append(ids, fmt.Sprint(v))
+	}
+	return strings.Join(ids, ",")
+}
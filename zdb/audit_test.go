@@ -0,0 +1,74 @@
+package zdb
+
+import (
+	"context"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type auditedUser struct {
+	Id       int64
+	Name     string
+	Password string
+	SoftDelete
+}
+
+func (auditedUser) AuditOmit() []string {
+	return []string{"password"}
+}
+
+func dryRun(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatalf("open = %v", err)
+	}
+	return db
+}
+
+func TestAuditDiff(t *testing.T) {
+	db := dryRun(t)
+	if err := registerAudit(db); err != nil {
+		t.Fatalf("registerAudit() = %v", err)
+	}
+	if err := db.Create(&auditedUser{Name: "a"}).Error; err != nil {
+		t.Errorf("Create() with audit = %v", err)
+	}
+	stmt := &gorm.Statement{DB: db, Context: context.Background()}
+	if err := stmt.Parse(&auditedUser{}); err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	omit, ok := auditOmit(stmt.Schema)
+	if !ok || !omit["password"] {
+		t.Fatalf("auditOmit() = %v, %v; want password omitted", omit, ok)
+	}
+	before := auditedUser{Id: 7, Name: "a", Password: "x"}
+	after := auditedUser{Id: 7, Name: "b", Password: "y"}
+	diff := auditDiff(stmt, omit, reflect.ValueOf(before), reflect.ValueOf(after))
+	if len(diff) != 1 || string(diff["name"].Old) != `"a"` || string(diff["name"].New) != `"b"` {
+		t.Errorf("auditDiff() = %v; want only name a -> b", diff)
+	}
+	if got := recordId(stmt, reflect.ValueOf(after)); got != "7" {
+		t.Errorf("recordId() = %s; want 7", got)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	db := dryRun(t)
+	ctx := WithActor(context.Background(), "u1")
+	stmt := db.WithContext(ctx).Delete(&auditedUser{Id: 7}).Statement
+	sql := stmt.SQL.String()
+	for _, want := range []string{`UPDATE "audited_users" SET "deleted_at"=$1,"deleted_by"=$2`, `"id" = $3`, `"deleted_at" IS NULL`} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("Delete() SQL = %s; want contains %s", sql, want)
+		}
+	}
+	if len(stmt.Vars) < 2 || stmt.Vars[1] != "u1" {
+		t.Errorf("Delete() vars = %v; want deleted_by u1", stmt.Vars)
+	}
+	if sql = db.Find(&[]auditedUser{}).Statement.SQL.String(); !strings.Contains(sql, `"deleted_at" IS NULL`) {
+		t.Errorf("Find() SQL = %s; want soft delete condition", sql)
+	}
+}
@@ -8,19 +8,27 @@ import (
 )
 
 type Config struct {
-	Host                    string        `json:"host" yaml:"host" validate:"required" note:"数据库地址"`
-	Port                    string        `json:"port" yaml:"port" validate:"required" note:"数据库端口"`
-	User                    string        `json:"user" yaml:"user" validate:"required" note:"数据库用户"`
-	Password                string        `json:"password" yaml:"password" validate:"required" note:"数据库密码"`
-	Db                      string        `json:"db" yaml:"db" validate:"required" note:"数据库名"`
-	Config                  string        `json:"config" yaml:"config" note:"数据库配置"`
-	MaxIdle                 int           `json:"max_idle" yaml:"max_idle" note:"最大闲置连接数"`
-	MaxAlive                int           `json:"max_alive" yaml:"max_alive" note:"最大存活连接数"`
-	MaxAliveLife            time.Duration `json:"max_alive_life" yaml:"max_alive_life" note:"最大存活时间"`
-	LogSlow                 int           `json:"log_slow" yaml:"log_slow" note:"慢阈值，秒"`
-	LogIgnoreRecordNotFound string        `json:"log_ignore_record_not_found" yaml:"log_ignore_record_not_found" note:"忽略无记录错误,yes/no"`
-	Debug                   bool          `json:"debug" yaml:"debug" note:"是否开启debug日志"`
-	Extension               []string      `json:"extension" yaml:"extension" note:"扩展配置"`
+	Host                    string         `json:"host" yaml:"host" validate:"required" note:"数据库地址"`
+	Port                    string         `json:"port" yaml:"port" validate:"required" note:"数据库端口"`
+	User                    string         `json:"user" yaml:"user" validate:"required" note:"数据库用户"`
+	Password                string         `json:"password" yaml:"password" validate:"required" note:"数据库密码"`
+	Db                      string         `json:"db" yaml:"db" validate:"required" note:"数据库名"`
+	Config                  string         `json:"config" yaml:"config" note:"数据库配置"`
+	MaxIdle                 int            `json:"max_idle" yaml:"max_idle" note:"最大闲置连接数"`
+	MaxAlive                int            `json:"max_alive" yaml:"max_alive" note:"最大存活连接数"`
+	MaxAliveLife            time.Duration  `json:"max_alive_life" yaml:"max_alive_life" note:"最大存活时间"`
+	LogSlow                 int            `json:"log_slow" yaml:"log_slow" note:"慢阈值，秒"`
+	LogIgnoreRecordNotFound string         `json:"log_ignore_record_not_found" yaml:"log_ignore_record_not_found" note:"忽略无记录错误,yes/no"`
+	Debug                   bool           `json:"debug" yaml:"debug" note:"是否开启debug日志"`
+	Extension               []string       `json:"extension" yaml:"extension" note:"扩展配置"`
+	Replicas                []Replica      `json:"replicas" yaml:"replicas" validate:"omitempty,dive" note:"只读副本,SELECT走副本,写入和事务走主库"`
+	Balance                 string         `json:"balance" yaml:"balance" validate:"omitempty,oneof=round_robin least_latency" note:"副本负载均衡,round_robin/least_latency"`
+	StickyWindow            time.Duration  `json:"sticky_window" yaml:"sticky_window" note:"同一请求写入后读主库的时长,默认5s"`
+	Tenant                  *TenantConfig  `json:"tenant" yaml:"tenant" note:"多租户,为空不启用"`
+	Encrypt                 *EncryptConfig `json:"encrypt" yaml:"encrypt" note:"字段加密密钥,为空不能使用Encrypted"`
+	Audit                   string         `json:"audit" yaml:"audit" note:"实现了Auditable的模型的变更写入audit_log,yes/no"`
+	Migrate                 string         `json:"migrate" yaml:"migrate" note:"启动时执行已注册的迁移,多实例由advisory锁互斥,yes/no"`
+	AutoMigrate             string         `json:"auto_migrate" yaml:"auto_migrate" note:"启动时按模型AutoMigrate(含zfile/zauth内置表),无法删改列和回滚,生产环境建议no并用迁移建表,默认yes"`
 }
 
 func (c *Config) Validate() error {
@@ -30,6 +38,14 @@ func (c *Config) Validate() error {
 	c.MaxAliveLife = zutil.FirstTruth(c.MaxAliveLife, time.Hour)
 	c.LogSlow = zutil.FirstTruth(c.LogSlow, 5)
 	c.LogIgnoreRecordNotFound = zutil.FirstTruth(c.LogIgnoreRecordNotFound, "yes")
+	c.Balance = zutil.FirstTruth(c.Balance, BalanceRoundRobin)
+	c.StickyWindow = zutil.FirstTruth(c.StickyWindow, 5*time.Second)
+	c.Audit = zutil.FirstTruth(c.Audit, "no")
+	c.Migrate = zutil.FirstTruth(c.Migrate, "yes")
+	c.AutoMigrate = zutil.FirstTruth(c.AutoMigrate, "yes")
+	if c.Tenant != nil {
+		c.Tenant.Validate(c.Db)
+	}
 	return validator.New().Struct(c)
 }
 func (c *Config) Dsn(database string) string {
@@ -30,6 +30,11 @@ func newDB(config Config, database string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("链接数据库失败 %s", err.Error())
 	}
+	if len(config.Replicas) > 0 {
+		if err = useReplicas(db, config, database); err != nil {
+			return nil, fmt.Errorf("注册只读副本失败 %s", err.Error())
+		}
+	}
 	d, _ := db.DB()
 	d.SetMaxIdleConns(config.MaxIdle)
 	d.SetMaxOpenConns(config.MaxAlive)
@@ -39,3 +44,17 @@ func newDB(config Config, database string) (*gorm.DB, error) {
 	}
 	return db, nil
 }
+
+// closeDB
+// @Description: 关闭连接池，配置了副本时一并关闭副本连接池并停止延迟探测
+// @param db
+func closeDB(db *gorm.DB) {
+	d, err := db.DB()
+	if err != nil {
+		return
+	}
+	if fn, ok := replicaClosers.LoadAndDelete(d); ok {
+		fn.(func())()
+	}
+	_ = d.Close()
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"github.com/zohu/zfiber/zlog"
-	"github.com/zohu/zfiber/zutil"
 	"gorm.io/gorm"
 	"sync"
 
@@ -12,6 +11,7 @@ import (
 )
 
 var conn sync.Map
+var connMu sync.Mutex
 var conf *Config
 
 func New(c *Config, dst ...any) {
@@ -20,42 +20,114 @@ func New(c *Config, dst ...any) {
 		zlog.Fatalf("validate db config failed: %v", err)
 		return
 	}
+	if conf.Encrypt != nil {
+		if err := SetKeyring(conf.Encrypt); err != nil {
+			zlog.Fatalf("load encryption keyring failed: %v", err)
+			return
+		}
+	}
+	if conf.Tenant != nil && conf.Tenant.Mode != TenantModeColumn {
+		evictIdle()
+	}
 	db := DB(context.Background(), "")
 	if db == nil {
 		zlog.Fatalf("init db failed")
 		return
 	}
-	// 初始化扩展
-	for _, ext := range conf.Extension {
-		if err := db.Exec(fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s;", ext)).Error; err != nil {
-			zlog.Fatalf("create extension [%s] failed: %v", ext, err)
-			return
+	// 扩展、库表和迁移在advisory锁内执行，避免多实例启动时竞争
+	err := withMigrateLock(context.Background(), "", func(db *gorm.DB) error {
+		// 初始化扩展
+		for _, ext := range conf.Extension {
+			if err := db.Exec(fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s;", ext)).Error; err != nil {
+				return fmt.Errorf("create extension [%s] failed: %w", ext, err)
+			}
+			zlog.Infof("create extension [%s] success", ext)
 		}
-		zlog.Infof("create extension [%s] success", ext)
-	}
-	// 初始化库表
-	if dst != nil && len(dst) > 0 {
-		if err := db.AutoMigrate(dst...); err != nil {
-			zlog.Fatalf("init db table failed: %v", err)
-			return
+		// 初始化枚举类型
+		if err := ensureEnums(db); err != nil {
+			return err
 		}
-		zlog.Infof("init db table success: %d", len(dst))
+		// 审计日志表
+		if conf.Audit == "yes" {
+			if err := db.AutoMigrate(&AuditLog{}); err != nil {
+				return fmt.Errorf("init audit log table failed: %w", err)
+			}
+		}
+		// 初始化库表
+		if err := autoMigrate(db, dst...); err != nil {
+			return fmt.Errorf("init db table failed: %w", err)
+		}
+		// 执行迁移
+		if conf.Migrate != "yes" {
+			return nil
+		}
+		return migrateUp(db, MigrateOptions{})
+	})
+	if err != nil {
+		zlog.Fatalf("%v", err)
+	}
+}
+
+// AutoMigrate
+// @Description: 按Config.AutoMigrate开关同步库表，供zfile、zauth等模块初始化内置表；关闭时跳过，需由迁移建表
+// @param ctx
+// @param dst
+// @return error
+func AutoMigrate(ctx context.Context, dst ...any) error {
+	if !autoMigrateEnabled(dst) {
+		return nil
 	}
+	return withMigrateLock(ctx, "", func(db *gorm.DB) error {
+		return autoMigrate(db, dst...)
+	})
 }
 
+func autoMigrateEnabled(dst []any) bool {
+	if len(dst) > 0 && conf.AutoMigrate != "yes" {
+		zlog.Warnf("auto migrate disabled, skip %d tables", len(dst))
+	}
+	return len(dst) > 0 && conf.AutoMigrate == "yes"
+}
+
+func autoMigrate(db *gorm.DB, dst ...any) error {
+	if !autoMigrateEnabled(dst) {
+		return nil
+	}
+	if err := db.AutoMigrate(dst...); err != nil {
+		return err
+	}
+	zlog.Infof("init db table success: %d", len(dst))
+	return nil
+}
+
+// DB
+// @Description: 获取连接，未指定库名时按ctx中的租户选择，在 Tx 中时加入事务
+// @param ctx
+// @param args 库名，默认Config.Db
+// @return *gorm.DB
 func DB(ctx context.Context, args ...string) *gorm.DB {
 	if len(args) == 0 {
 		args = append(args, "")
 	}
-	def := zutil.FirstTruth(args[0], conf.Db)
-	if v, ok := conn.Load(def); ok {
+	key := dbKey(ctx, args[0])
+	// 在 Tx 中时加入事务
+	if st := txFrom(ctx, key); st != nil {
+		return st.db.WithContext(ctx)
+	}
+	touch(key)
+	if v, ok := conn.Load(key); ok {
+		return v.(*gorm.DB).WithContext(ctx)
+	}
+	connMu.Lock()
+	defer connMu.Unlock()
+	if v, ok := conn.Load(key); ok {
 		return v.(*gorm.DB).WithContext(ctx)
 	}
-	db, err := newDB(*conf, def)
+	db, err := openDB(*conf, key)
 	if err != nil {
 		zlog.Fatalf("init db conn failed %v", err)
 		return nil
 	}
-	conn.Store(def, db)
+	conn.Store(key, db)
 	return db.WithContext(ctx)
 }
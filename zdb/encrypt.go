@@ -0,0 +1,294 @@
+package zdb
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/zohu/zfiber/zcpt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	ErrNoKeyring  = errors.New("zdb: encryption keyring not configured")
+	ErrNoBlindKey = errors.New("zdb: blind index key not configured")
+	ErrUnknownKey = errors.New("zdb: unknown encryption key")
+)
+
+// EncryptConfig
+// @Description: 字段加密配置
+type EncryptConfig struct {
+	Keys     map[string]string `json:"keys" yaml:"keys" validate:"required" note:"密钥环,密钥id->base64编码的16/24/32字节AES密钥,旧密钥保留到Rotate完成"`
+	Primary  string            `json:"primary" yaml:"primary" validate:"required" note:"加密新数据的密钥id,轮换时改为新密钥并执行Rotate"`
+	BlindKey string            `json:"blind_key" yaml:"blind_key" note:"盲索引的HMAC密钥,base64,更换后需重建盲索引列,为空不启用盲索引"`
+}
+
+type keyring struct {
+	keys    map[string][]byte
+	primary string
+	blind   []byte
+}
+
+var ring atomic.Pointer[keyring]
+
+// keyIdPattern
+// @Description: 密钥id会写入密文前缀，不能包含分隔符
+var keyIdPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// SetKeyring
+// @Description: 加载密钥环，zdb.New 按Config.Encrypt自动调用；也可在运行时替换以轮换密钥
+// @param c
+// @return error
+func SetKeyring(c *EncryptConfig) error {
+	r := &keyring{keys: make(map[string][]byte, len(c.Keys)), primary: c.Primary}
+	for id, k := range c.Keys {
+		if !keyIdPattern.MatchString(id) {
+			return fmt.Errorf("zdb: invalid encryption key id %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return fmt.Errorf("zdb: decode encryption key %s: %w", id, err)
+		}
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return fmt.Errorf("zdb: encryption key %s must be 16/24/32 bytes, got %d", id, n)
+		}
+		r.keys[id] = key
+	}
+	if _, ok := r.keys[c.Primary]; !ok {
+		return fmt.Errorf("%w: primary %s", ErrUnknownKey, c.Primary)
+	}
+	if c.BlindKey != "" {
+		blind, err := base64.StdEncoding.DecodeString(c.BlindKey)
+		if err != nil {
+			return fmt.Errorf("zdb: decode blind key: %w", err)
+		}
+		r.blind = blind
+	}
+	ring.Store(r)
+	return nil
+}
+
+// encrypt
+// @Description: 用主密钥加密，密文格式 v1:密钥id:base64(nonce+密文)
+// @param plain
+// @return string
+// @return error
+func encrypt(plain []byte) (string, error) {
+	r := ring.Load()
+	if r == nil {
+		return "", ErrNoKeyring
+	}
+	b, err := zcpt.AesEncryptGCM(plain, r.keys[r.primary], []byte(r.primary))
+	if err != nil {
+		return "", err
+	}
+	return "v1:" + r.primary + ":" + base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decrypt(cipher string) ([]byte, error) {
+	r := ring.Load()
+	if r == nil {
+		return nil, ErrNoKeyring
+	}
+	parts := strings.SplitN(cipher, ":", 3)
+	if len(parts) != 3 || parts[0] != "v1" {
+		return nil, errors.New("zdb: malformed ciphertext")
+	}
+	key, ok := r.keys[parts[1]]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, parts[1])
+	}
+	b, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	return zcpt.AesDecryptGCM(b, key, []byte(parts[1]))
+}
+
+// Blind
+// @Description: 明文的盲索引，用于加密列的等值查询，如 Where("phone_bidx = ?", idx)；
+// 未配置BlindKey时返回ErrNoBlindKey，避免用空索引查询
+// @param v 与Encrypted[T]的T一致
+// @return string
+// @return error
+func Blind[T any](v T) (string, error) {
+	return blind(v)
+}
+
+func blind(v any) (string, error) {
+	r := ring.Load()
+	if r == nil || r.blind == nil {
+		return "", ErrNoBlindKey
+	}
+	plain, err := encodePlain(v)
+	if err != nil {
+		return "", err
+	}
+	return zcpt.HmacSha256(plain, r.blind), nil
+}
+
+type blindIndexer interface {
+	blindIndex() (string, error)
+}
+
+// blindOf
+// @Description: 加密列值的盲索引，nil和零值为空串
+// @param v
+// @return string
+// @return bool 是否为加密列类型
+// @return error
+func blindOf(v any) (string, bool, error) {
+	if v == nil {
+		return "", true, nil
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		_, ok := v.(blindIndexer)
+		return "", ok, nil
+	}
+	b, ok := v.(blindIndexer)
+	if !ok {
+		return "", false, nil
+	}
+	idx, err := b.blindIndex()
+	return idx, true, err
+}
+
+// registerBlindIndex
+// @Description: 创建和更新时按 gorm:"blind:列名" 标签填充盲索引列；
+// 加密列清空时索引置空，Select了加密列时索引列一并更新，map更新按map中的值计算
+// @param db
+// @return error
+func registerBlindIndex(db *gorm.DB) error {
+	fill := func(tx *gorm.DB, create bool) {
+		stmt := tx.Statement
+		sch := stmt.Schema
+		if tx.Error != nil || sch == nil {
+			return
+		}
+		rv := stmt.ReflectValue
+		if dest := reflect.Indirect(reflect.ValueOf(stmt.Dest)); dest.IsValid() && dest.Type() == sch.ModelType {
+			rv = dest
+		}
+		selected, restricted := stmt.SelectAndOmitColumns(create, !create)
+		for _, field := range sch.Fields {
+			column, ok := field.TagSettings["BLIND"]
+			if !ok {
+				continue
+			}
+			target := sch.LookUpField(column)
+			if target == nil {
+				_ = tx.AddError(fmt.Errorf("zdb: blind index column %s not found in %s", column, sch.Name))
+				return
+			}
+			if sel, ok := selected[field.DBName]; (ok && !sel) || (restricted && !selected[field.DBName]) {
+				continue
+			}
+			if restricted {
+				if _, ok := selected[target.DBName]; !ok {
+					stmt.Selects = append(stmt.Selects, target.DBName)
+				}
+			}
+			if m, ok := stmt.Dest.(map[string]interface{}); ok {
+				v, found := m[field.DBName]
+				if !found {
+					if v, found = m[field.Name]; !found {
+						continue
+					}
+				}
+				idx, ok, err := blindOf(v)
+				if err != nil {
+					_ = tx.AddError(err)
+					return
+				}
+				if ok {
+					stmt.SetColumn(target.DBName, idx)
+				}
+				continue
+			}
+			each(rv, func(item reflect.Value) {
+				v, _ := field.ValueOf(stmt.Context, item)
+				idx, ok, err := blindOf(v)
+				if err != nil {
+					_ = tx.AddError(err)
+					return
+				}
+				if ok {
+					_ = target.Set(stmt.Context, item, idx)
+				}
+			})
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("gorm:create").Register("zdb:blind_index", func(tx *gorm.DB) { fill(tx, true) }),
+		cb.Update().Before("gorm:update").Register("zdb:blind_index", func(tx *gorm.DB) { fill(tx, false) }),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// each
+// @Description: 遍历结构体或结构体切片
+// @param rv
+// @param fn
+func each(rv reflect.Value, fn func(item reflect.Value)) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		fn(rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			item := reflect.Indirect(rv.Index(i))
+			if item.Kind() == reflect.Struct {
+				fn(item)
+			}
+		}
+	}
+}
+
+// Rotate
+// @Description: 重新加密不是主密钥加密的数据，更换Primary后执行，完成后即可从密钥环移除旧密钥；
+// 按批读取并更新，可重复执行，适合放在后台任务或迁移中
+// @param ctx
+// @param columns M中的加密列
+// @param batch 每批行数，默认500
+// @return int64 重新加密的行数
+// @return error
+func Rotate[M any](ctx context.Context, columns []string, batch int) (int64, error) {
+	r := ring.Load()
+	if r == nil {
+		return 0, ErrNoKeyring
+	}
+	if batch <= 0 {
+		batch = 500
+	}
+	prefix := "v1:" + r.primary + ":%"
+	var stale []clause.Expression
+	for _, col := range columns {
+		stale = append(stale, clause.Expr{SQL: "? NOT LIKE ?", Vars: []interface{}{clause.Column{Name: col}, prefix}})
+	}
+	var total int64
+	for {
+		var rows []M
+		// 软删除的行同样需要换新密钥，否则旧密钥下线后无法恢复
+		if err := Primary(ctx).Unscoped().Where(clause.Or(stale...)).Limit(batch).Find(&rows).Error; err != nil {
+			return total, err
+		}
+		for i := range rows {
+			if err := DB(ctx).Unscoped().Session(&gorm.Session{SkipHooks: true}).Select(columns).Updates(&rows[i]).Error; err != nil {
+				return total, err
+			}
+		}
+		total += int64(len(rows))
+		if len(rows) < batch {
+			return total, nil
+		}
+	}
+}
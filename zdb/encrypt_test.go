@@ -0,0 +1,142 @@
+package zdb
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/bytedance/sonic"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"strings"
+	"testing"
+)
+
+type encryptedUser struct {
+	Id        int64
+	Phone     Encrypted[string] `gorm:"blind:phone_bidx"`
+	PhoneBidx string
+	Tags      Encrypted[[]string]
+}
+
+func testKeyring(t *testing.T, primary string) {
+	key := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	err := SetKeyring(&EncryptConfig{
+		Keys:     map[string]string{"k1": key("0123456789abcdef"), "k2": key("fedcba9876543210fedcba9876543210")},
+		Primary:  primary,
+		BlindKey: key("blind"),
+	})
+	if err != nil {
+		t.Fatalf("SetKeyring() = %v", err)
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	testKeyring(t, "k1")
+	v, err := NewEncrypted("13812345678").Value()
+	if err != nil || !strings.HasPrefix(v.(string), "v1:k1:") {
+		t.Fatalf("Encrypted.Value() = %v, %v; want v1:k1: prefix", v, err)
+	}
+	// 轮换后旧密文仍可解密，新数据用新密钥
+	testKeyring(t, "k2")
+	var got Encrypted[string]
+	if err = got.Scan(v); err != nil || got.Data != "13812345678" {
+		t.Errorf("Encrypted.Scan() = %s, %v; want 13812345678", got.Data, err)
+	}
+	if v2, _ := got.Value(); !strings.HasPrefix(v2.(string), "v1:k2:") {
+		t.Errorf("Encrypted.Value() after rotation = %v; want v1:k2: prefix", v2)
+	}
+	if err = got.Scan("v1:k3:AAAA"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Encrypted.Scan(k3) = %v; want %v", err, ErrUnknownKey)
+	}
+	if n, _ := (Encrypted[string]{}).Value(); n != nil {
+		t.Errorf("Encrypted{}.Value() = %v; want nil", n)
+	}
+
+	u := encryptedUser{Phone: NewEncrypted("13812345678"), Tags: NewEncrypted([]string{"vip"})}
+	b, _ := sonic.Marshal(u)
+	if s := string(b); !strings.Contains(s, `"Phone":"138****5678"`) || !strings.Contains(s, `"Tags":"******"`) {
+		t.Errorf("Marshal() = %s", s)
+	}
+	u.Phone = u.Phone.Reveal()
+	if b, _ = sonic.Marshal(u); !strings.Contains(string(b), `"Phone":"13812345678"`) {
+		t.Errorf("Marshal(Reveal) = %s", b)
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	testKeyring(t, "k1")
+	if mustBlind(t, "13812345678") != mustBlind(t, "13812345678") || mustBlind(t, "13812345678") == mustBlind(t, "13812345679") {
+		t.Errorf("Blind() is not deterministic")
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatalf("open = %v", err)
+	}
+	if err = registerBlindIndex(db); err != nil {
+		t.Fatalf("registerBlindIndex() = %v", err)
+	}
+	u := encryptedUser{Phone: NewEncrypted("13812345678")}
+	if err = db.Create(&u).Error; err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	if want := mustBlind(t, "13812345678"); u.PhoneBidx != want {
+		t.Errorf("PhoneBidx = %s; want %s", u.PhoneBidx, want)
+	}
+
+	hasVar := func(stmt *gorm.Statement, v any) bool {
+		for _, x := range stmt.Vars {
+			if x == v {
+				return true
+			}
+		}
+		return false
+	}
+	// map更新按map中的值计算
+	stmt := db.Model(&encryptedUser{Id: 1}).Updates(map[string]any{"phone": NewEncrypted("13900000000")}).Statement
+	if !strings.Contains(stmt.SQL.String(), `"phone_bidx"`) || !hasVar(stmt, mustBlind(t, "13900000000")) {
+		t.Errorf("Updates(map) = %s %v; want phone_bidx of new value", stmt.SQL.String(), stmt.Vars)
+	}
+	// Select加密列时索引列一并更新
+	u = encryptedUser{Id: 1, Phone: NewEncrypted("13900000001"), PhoneBidx: "stale"}
+	stmt = db.Model(&u).Select("phone").Updates(&u).Statement
+	if !strings.Contains(stmt.SQL.String(), `"phone_bidx"`) || !hasVar(stmt, mustBlind(t, "13900000001")) {
+		t.Errorf("Select(phone).Updates = %s %v; want phone_bidx", stmt.SQL.String(), stmt.Vars)
+	}
+	// 清空加密列时索引置空
+	u = encryptedUser{Id: 1, PhoneBidx: "stale"}
+	stmt = db.Model(&u).Select("phone").Updates(&u).Statement
+	if u.PhoneBidx != "" || !strings.Contains(stmt.SQL.String(), `"phone_bidx"`) {
+		t.Errorf("clear phone = %s, PhoneBidx %q; want empty index", stmt.SQL.String(), u.PhoneBidx)
+	}
+	stmt = db.Model(&encryptedUser{Id: 1}).Update("phone", nil).Statement
+	if !strings.Contains(stmt.SQL.String(), `"phone_bidx"`) || !hasVar(stmt, "") {
+		t.Errorf("Update(phone, nil) = %s %v; want empty index", stmt.SQL.String(), stmt.Vars)
+	}
+	// Omit加密列时不更新索引
+	stmt = db.Model(&u).Omit("phone").Updates(&encryptedUser{Phone: NewEncrypted("13900000002")}).Statement
+	if strings.Contains(stmt.SQL.String(), `"phone_bidx"`) {
+		t.Errorf("Omit(phone).Updates = %s; want no phone_bidx", stmt.SQL.String())
+	}
+}
+
+func TestBlindWithoutKey(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+	if err := SetKeyring(&EncryptConfig{Keys: map[string]string{"k1": key}, Primary: "k1"}); err != nil {
+		t.Fatalf("SetKeyring() = %v", err)
+	}
+	defer testKeyring(t, "k1")
+	if _, err := NewEncrypted("13812345678").blindIndex(); !errors.Is(err, ErrNoBlindKey) {
+		t.Errorf("blindIndex() without key = %v; want %v", err, ErrNoBlindKey)
+	}
+	if _, err := Blind("13812345678"); !errors.Is(err, ErrNoBlindKey) {
+		t.Errorf("Blind() without key = %v; want %v", err, ErrNoBlindKey)
+	}
+}
+
+func mustBlind(t *testing.T, v string) string {
+	t.Helper()
+	idx, err := Blind(v)
+	if err != nil {
+		t.Fatalf("Blind(%s) = %v", v, err)
+	}
+	return idx
+}
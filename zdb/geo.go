@@ -0,0 +1,74 @@
+package zdb
+
+import (
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Distance
+// @Description: 嵌入查询结果结构体以接收 Nearest 返回的距离
+type Distance struct {
+	Distance float64 `json:"distance" gorm:"->;-:migration;comment:距离,米"`
+}
+
+// DistanceExpr
+// @Description: 到指定点的距离(米)，可用于自定义Select或Order
+// @param column geography列
+// @param p
+// @return clause.Expr
+func DistanceExpr(column string, p *Point) clause.Expr {
+	return gorm.Expr("ST_Distance(?, ST_GeographyFromText(?))", clause.Column{Name: column}, p.wkt())
+}
+
+// WithinRadius
+// @Description: 距离指定点meters米以内，可使用geography列的GiST索引
+// @param column geography列
+// @param p
+// @param meters
+// @return func(db *gorm.DB) *gorm.DB
+func WithinRadius(column string, p *Point, meters float64) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("ST_DWithin(?, ST_GeographyFromText(?), ?)", clause.Column{Name: column}, p.wkt(), meters)
+	}
+}
+
+// Nearest
+// @Description: 距离最近的n条，按距离升序并返回distance列，结果结构体嵌入Distance接收；
+// 会覆盖已有的Select，自定义列时改用DistanceExpr
+// @param column geography列
+// @param p
+// @param n
+// @return func(db *gorm.DB) *gorm.DB
+func Nearest(column string, p *Point, n int) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		col, wkt := clause.Column{Name: column}, p.wkt()
+		return db.
+			Select("?.*, ST_Distance(?, ST_GeographyFromText(?)) AS distance", clause.Table{Name: clause.CurrentTable}, col, wkt).
+			Clauses(clause.OrderBy{Expression: gorm.Expr("? <-> ST_GeographyFromText(?)", col, wkt)}).
+			Limit(n)
+	}
+}
+
+// WithinBox
+// @Description: 在西南角sw和东北角ne围成的矩形内(含边界)
+// @param column geography列
+// @param sw
+// @param ne
+// @return func(db *gorm.DB) *gorm.DB
+func WithinBox(column string, sw, ne *Point) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("ST_Covers(ST_MakeEnvelope(?, ?, ?, ?, 4326)::geography, ?)",
+			sw.X(), sw.Y(), ne.X(), ne.Y(), clause.Column{Name: column})
+	}
+}
+
+// WithinPolygon
+// @Description: 在多边形内(含边界)
+// @param column geography列
+// @param polygon
+// @return func(db *gorm.DB) *gorm.DB
+func WithinPolygon(column string, polygon *Polygon) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("ST_Covers(?, ?)", polygon, clause.Column{Name: column})
+	}
+}
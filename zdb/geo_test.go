@@ -0,0 +1,67 @@
+package zdb
+
+import (
+	"github.com/bytedance/sonic"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"math"
+	"strings"
+	"testing"
+)
+
+type geoShop struct {
+	Id       int64
+	Location *Point
+	Area     *Polygon
+	Distance
+}
+
+func TestGeoJSON(t *testing.T) {
+	p := NewPolygon(PointTypeGCJ02, [][2]float64{{116.39, 39.90}, {116.41, 39.90}, {116.41, 39.92}})
+	if rings := p.WGS84().Rings(); len(rings) != 1 || len(rings[0]) != 4 {
+		t.Fatalf("NewPolygon() rings = %v; want 1 closed ring of 4", rings)
+	}
+	b, err := sonic.Marshal(p.GCJ02())
+	if err != nil {
+		t.Fatalf("Marshal() = %v", err)
+	}
+	if s := string(b); !strings.Contains(s, `"type":"Polygon"`) || !strings.Contains(s, `"point_type":"gcj02"`) {
+		t.Errorf("Marshal() = %s", s)
+	}
+	var q Polygon
+	if err = sonic.Unmarshal(b, &q); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	got, want := q.GCJ02().Rings()[0][1], [2]float64{116.41, 39.90}
+	if math.Abs(got[0]-want[0]) > 1e-5 || math.Abs(got[1]-want[1]) > 1e-5 {
+		t.Errorf("round trip = %v; want %v", got, want)
+	}
+
+	var l LineString
+	if err = sonic.Unmarshal([]byte(`{"type":"Point","coordinates":[1,2]}`), &l); err == nil {
+		t.Errorf("Unmarshal(Point) into LineString = nil; want error")
+	}
+	if b, _ = sonic.Marshal(struct{ L LineString }{}); string(b) != `{"L":null}` {
+		t.Errorf("Marshal(empty) = %s", b)
+	}
+}
+
+func TestGeoScopes(t *testing.T) {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatalf("open = %v", err)
+	}
+	center := NewPointFromWGS84(116.4, 39.9)
+	cases := map[string]func(*gorm.DB) *gorm.DB{
+		`ST_DWithin("location", ST_GeographyFromText($1), $2)`:                         WithinRadius("location", center, 500),
+		`"geo_shops".*, ST_Distance("location", ST_GeographyFromText($1)) AS distance`: Nearest("location", center, 5),
+		`ST_Covers(ST_MakeEnvelope($1, $2, $3, $4, 4326)::geography, "location")`:      WithinBox("location", center, center),
+		`ST_Covers(ST_GeographyFromText($1), "location")`:                              WithinPolygon("location", NewPolygon(PointTypeWGS84, [][2]float64{{0, 0}, {1, 0}, {1, 1}})),
+	}
+	for want, scope := range cases {
+		sql := db.Scopes(scope).Find(&[]geoShop{}).Statement.SQL.String()
+		if !strings.Contains(sql, want) {
+			t.Errorf("scope SQL = %s; want contains %s", sql, want)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package zdb
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/zohu/zfiber/zlog"
+	"gorm.io/gorm"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// migrateLockKey
+// @Description: pg_advisory_lock的键，同库多实例同时启动时只有一个执行迁移
+const migrateLockKey int64 = 0x7a64624d69677261 // "zdbMigra"
+
+// noTxMark
+// @Description: SQL文件首行包含该标记时不在事务中执行，如 CREATE INDEX CONCURRENTLY
+const noTxMark = "-- zdb:no-transaction"
+
+// Migration
+// @Description: 一个版本的迁移，Up/Down与UpSQL/DownSQL二选一，Down为空时不可回滚
+type Migration struct {
+	Version int64
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+	UpSQL   string
+	DownSQL string
+	NoTx    bool // 不在事务中执行
+}
+
+// SchemaMigration
+// @Description: 已执行的迁移记录
+type SchemaMigration struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"not null"`
+	AppliedAt time.Time `gorm:"not null"`
+	Duration  int64     `gorm:"not null;comment:耗时,毫秒"`
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationStatus
+// @Description: 迁移状态
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	Missing   bool       `json:"missing,omitempty"` // 库中已执行但代码中不存在
+}
+
+var (
+	migrations   = make(map[int64]*Migration)
+	migrationsMu sync.Mutex
+)
+
+// Register
+// @Description: 注册迁移，版本重复时panic
+// @param ms
+func Register(ms ...*Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	for _, m := range ms {
+		if old, ok := migrations[m.Version]; ok && old != m {
+			panic(fmt.Sprintf("zdb: duplicate migration version %d (%s, %s)", m.Version, old.Name, m.Name))
+		}
+		migrations[m.Version] = m
+	}
+}
+
+// RegisterFS
+// @Description: 从目录注册SQL迁移，文件名格式 {version}_{name}.up.sql / {version}_{name}.down.sql，常配合embed.FS使用
+// @param fsys
+// @param dir
+// @return error
+func RegisterFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	found := make(map[int64]*Migration)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		version, name, up, ok := parseMigrationName(e.Name())
+		if !ok {
+			continue
+		}
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		m, ok := found[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			found[version] = m
+		} else if m.Name != name {
+			return fmt.Errorf("zdb: migration %d has different names: %s, %s", version, m.Name, name)
+		}
+		sql := string(b)
+		if up {
+			m.UpSQL = sql
+			m.NoTx = strings.HasPrefix(strings.TrimSpace(sql), noTxMark)
+		} else {
+			m.DownSQL = sql
+		}
+	}
+	for _, m := range found {
+		if m.UpSQL == "" {
+			return fmt.Errorf("zdb: migration %d_%s missing up.sql", m.Version, m.Name)
+		}
+		Register(m)
+	}
+	return nil
+}
+
+// parseMigrationName
+// @Description: 解析迁移文件名
+// @param file
+// @return version
+// @return name
+// @return up
+// @return ok
+func parseMigrationName(file string) (version int64, name string, up bool, ok bool) {
+	base, found := strings.CutSuffix(file, ".up.sql")
+	if found {
+		up = true
+	} else if base, found = strings.CutSuffix(file, ".down.sql"); !found {
+		return 0, "", false, false
+	}
+	v, name, _ := strings.Cut(base, "_")
+	version, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, "", false, false
+	}
+	return version, name, up, true
+}
+
+// registered
+// @Description: 按版本升序的已注册迁移
+// @return []*Migration
+func registered() []*Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	list := make([]*Migration, 0, len(migrations))
+	for _, m := range migrations {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list
+}
+
+// MigrateOptions
+// @Description: 迁移参数
+type MigrateOptions struct {
+	Db     string // 数据库，默认Config.Db
+	DryRun bool   // 只打印将执行的迁移
+	Steps  int    // up默认全部，down默认1
+	To     int64  // up执行到该版本(含)，down回滚到该版本(不含)
+}
+
+// Migrate
+// @Description: 命令行风格的迁移入口，如 zdb.Migrate(ctx, os.Args[1:]...)
+// 支持 up / down / status，参数 -dry-run -steps=N -to=VERSION -db=NAME
+// @param ctx
+// @param args
+// @return error
+func Migrate(ctx context.Context, args ...string) error {
+	if len(args) == 0 {
+		return errors.New("zdb: migrate command required: up/down/status")
+	}
+	ops := MigrateOptions{}
+	fset := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	fset.BoolVar(&ops.DryRun, "dry-run", false, "只打印将执行的迁移")
+	fset.IntVar(&ops.Steps, "steps", 0, "执行的迁移数")
+	fset.Int64Var(&ops.To, "to", 0, "目标版本")
+	fset.StringVar(&ops.Db, "db", "", "数据库")
+	if err := fset.Parse(args[1:]); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "up":
+		return MigrateUp(ctx, ops)
+	case "down":
+		return MigrateDown(ctx, ops)
+	case "status":
+		list, err := Status(ctx, ops.Db)
+		if err != nil {
+			return err
+		}
+		for _, s := range list {
+			state := "pending"
+			switch {
+			case s.Missing:
+				state = "missing"
+			case s.Applied:
+				state = "applied " + s.AppliedAt.Format(time.DateTime)
+			}
+			zlog.Infof("%d_%s\t%s", s.Version, s.Name, state)
+		}
+		return nil
+	}
+	return fmt.Errorf("zdb: unknown migrate command %q", args[0])
+}
+
+// MigrateUp
+// @Description: 执行未执行的迁移
+// @param ctx
+// @param ops
+// @return error
+func MigrateUp(ctx context.Context, ops MigrateOptions) error {
+	return withMigrateLock(ctx, ops.Db, func(db *gorm.DB) error {
+		return migrateUp(db, ops)
+	})
+}
+
+// migrateUp
+// @Description: 调用方需持有迁移锁
+// @param db
+// @param ops
+// @return error
+func migrateUp(db *gorm.DB, ops MigrateOptions) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range planUp(registered(), applied, ops) {
+		if err = runMigration(db, m, true, ops.DryRun); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateDown
+// @Description: 回滚已执行的迁移，默认回滚最近一个
+// @param ctx
+// @param ops
+// @return error
+func MigrateDown(ctx context.Context, ops MigrateOptions) error {
+	return withMigrateLock(ctx, ops.Db, func(db *gorm.DB) error {
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		plan, err := planDown(registered(), applied, ops)
+		if err != nil {
+			return err
+		}
+		for _, m := range plan {
+			if err = runMigration(db, m, false, ops.DryRun); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Status
+// @Description: 各版本迁移状态，按版本升序
+// @param ctx
+// @param database
+// @return []MigrationStatus
+// @return error
+func Status(ctx context.Context, database string) ([]MigrationStatus, error) {
+	db := Primary(ctx, database)
+	applied := make(map[int64]SchemaMigration)
+	if db.Migrator().HasTable(&SchemaMigration{}) {
+		var err error
+		if applied, err = appliedMigrations(db); err != nil {
+			return nil, err
+		}
+	}
+	var list []MigrationStatus
+	for _, m := range registered() {
+		s := MigrationStatus{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			s.Applied, s.AppliedAt = true, &a.AppliedAt
+			delete(applied, m.Version)
+		}
+		list = append(list, s)
+	}
+	for _, a := range applied {
+		list = append(list, MigrationStatus{Version: a.Version, Name: a.Name, Applied: true, AppliedAt: &a.AppliedAt, Missing: true})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+// withMigrateLock
+// @Description: 在同一连接上持有会话级advisory锁执行fn，锁随连接释放；
+// 配置了副本时读写分离会把语句切到其他连接，改用单独的主库连接
+// @param ctx
+// @param database
+// @param fn
+// @return error
+func withMigrateLock(ctx context.Context, database string, fn func(db *gorm.DB) error) error {
+	db := DB(ctx, database)
+	if len(conf.Replicas) > 0 {
+		c := *conf
+		c.Replicas, c.MaxIdle, c.MaxAlive = nil, 1, 1
+		primary, err := openDB(c, dbKey(ctx, database))
+		if err != nil {
+			return err
+		}
+		defer closeDB(primary)
+		db = primary.WithContext(ctx)
+	}
+	return db.Connection(func(db *gorm.DB) error {
+		if err := db.Exec("SELECT pg_advisory_lock(?)", migrateLockKey).Error; err != nil {
+			return fmt.Errorf("zdb: acquire migrate lock: %w", err)
+		}
+		defer db.Exec("SELECT pg_advisory_unlock(?)", migrateLockKey)
+		if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+			return err
+		}
+		return fn(db)
+	})
+}
+
+func appliedMigrations(db *gorm.DB) (map[int64]SchemaMigration, error) {
+	var list []SchemaMigration
+	if err := db.Order("version").Find(&list).Error; err != nil {
+		return nil, err
+	}
+	res := make(map[int64]SchemaMigration, len(list))
+	for _, m := range list {
+		res[m.Version] = m
+	}
+	return res, nil
+}
+
+// planUp
+// @Description: 待执行的迁移，低于已执行最大版本的遗漏迁移同样会执行
+// @param all
+// @param applied
+// @param ops
+// @return []*Migration
+func planUp(all []*Migration, applied map[int64]SchemaMigration, ops MigrateOptions) []*Migration {
+	var plan []*Migration
+	for _, m := range all {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if ops.To > 0 && m.Version > ops.To {
+			break
+		}
+		if ops.Steps > 0 && len(plan) >= ops.Steps {
+			break
+		}
+		plan = append(plan, m)
+	}
+	return plan
+}
+
+// planDown
+// @Description: 待回滚的迁移，按版本降序
+// @param all
+// @param applied
+// @param ops
+// @return []*Migration
+// @return error
+func planDown(all []*Migration, applied map[int64]SchemaMigration, ops MigrateOptions) ([]*Migration, error) {
+	steps := ops.Steps
+	if steps <= 0 && ops.To == 0 {
+		steps = 1
+	}
+	var plan []*Migration
+	for i := len(all) - 1; i >= 0; i-- {
+		m := all[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if ops.To > 0 && m.Version <= ops.To {
+			break
+		}
+		if steps > 0 && len(plan) >= steps {
+			break
+		}
+		if m.Down == nil && m.DownSQL == "" {
+			return nil, fmt.Errorf("zdb: migration %d_%s is irreversible", m.Version, m.Name)
+		}
+		plan = append(plan, m)
+	}
+	return plan, nil
+}
+
+// runMigration
+// @Description: 执行单个迁移并写入/删除记录，默认与记录在同一事务中
+// @param db
+// @param m
+// @param up
+// @param dryRun
+// @return error
+func runMigration(db *gorm.DB, m *Migration, up bool, dryRun bool) error {
+	direction, fn, sql := "up", m.Up, m.UpSQL
+	if !up {
+		direction, fn, sql = "down", m.Down, m.DownSQL
+	}
+	if dryRun {
+		if sql != "" {
+			zlog.Infof("[dry-run] migrate %s %d_%s:\n%s", direction, m.Version, m.Name, sql)
+		} else {
+			zlog.Infof("[dry-run] migrate %s %d_%s (go func)", direction, m.Version, m.Name)
+		}
+		return nil
+	}
+	start := time.Now()
+	apply := func(tx *gorm.DB) error {
+		var err error
+		if fn != nil {
+			err = fn(tx)
+		} else {
+			err = tx.Exec(sql).Error
+		}
+		if err != nil {
+			return fmt.Errorf("zdb: migrate %s %d_%s: %w", direction, m.Version, m.Name, err)
+		}
+		if !up {
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		}
+		return tx.Create(&SchemaMigration{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: time.Now(),
+			Duration:  time.Since(start).Milliseconds(),
+		}).Error
+	}
+	var err error
+	if m.NoTx {
+		err = apply(db)
+	} else {
+		err = db.Transaction(apply)
+	}
+	if err != nil {
+		return err
+	}
+	zlog.Infof("migrate %s %d_%s success, %s", direction, m.Version, m.Name, time.Since(start))
+	return nil
+}
@@ -0,0 +1,89 @@
+package zdb
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParseMigrationName(t *testing.T) {
+	cases := []struct {
+		file    string
+		version int64
+		name    string
+		up      bool
+		ok      bool
+	}{
+		{"0001_create_user.up.sql", 1, "create_user", true, true},
+		{"20240101120000_add_index.down.sql", 20240101120000, "add_index", false, true},
+		{"readme.md", 0, "", false, false},
+		{"x_bad.up.sql", 0, "", false, false},
+	}
+	for _, c := range cases {
+		version, name, up, ok := parseMigrationName(c.file)
+		if version != c.version || name != c.name || up != c.up || ok != c.ok {
+			t.Errorf("parseMigrationName(%s) = %d, %s, %v, %v; want %d, %s, %v, %v", c.file, version, name, up, ok, c.version, c.name, c.up, c.ok)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	all := []*Migration{
+		{Version: 1, Name: "a", UpSQL: "1", DownSQL: "1"},
+		{Version: 2, Name: "b", UpSQL: "2", DownSQL: "2"},
+		{Version: 3, Name: "c", UpSQL: "3"},
+		{Version: 4, Name: "d", UpSQL: "4", DownSQL: "4"},
+	}
+	applied := map[int64]SchemaMigration{1: {Version: 1}, 3: {Version: 3}}
+
+	if p := planUp(all, applied, MigrateOptions{}); len(p) != 2 || p[0].Version != 2 || p[1].Version != 4 {
+		t.Errorf("planUp() = %v; want [2 4]", versions(p))
+	}
+	if p := planUp(all, applied, MigrateOptions{To: 3}); len(p) != 1 || p[0].Version != 2 {
+		t.Errorf("planUp(to=3) = %v; want [2]", versions(p))
+	}
+	if _, err := planDown(all, applied, MigrateOptions{}); err == nil {
+		t.Errorf("planDown() irreversible = nil; want error")
+	}
+	p, err := planDown(all, map[int64]SchemaMigration{1: {}, 2: {}, 4: {}}, MigrateOptions{To: 1})
+	if err != nil || len(p) != 2 || p[0].Version != 4 || p[1].Version != 2 {
+		t.Errorf("planDown(to=1) = %v, %v; want [4 2]", versions(p), err)
+	}
+}
+
+func TestRegisterFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/0100_t.up.sql":   {Data: []byte("-- zdb:no-transaction\nCREATE INDEX CONCURRENTLY i ON t (a);")},
+		"sql/0100_t.down.sql": {Data: []byte("DROP INDEX i;")},
+	}
+	if err := RegisterFS(fsys, "sql"); err != nil {
+		t.Fatalf("RegisterFS() = %v", err)
+	}
+	m := migrations[100]
+	if m == nil || m.Name != "t" || !m.NoTx || m.DownSQL != "DROP INDEX i;" {
+		t.Errorf("RegisterFS() migration = %+v", m)
+	}
+}
+
+func versions(list []*Migration) []int64 {
+	res := make([]int64, len(list))
+	for i, m := range list {
+		res[i] = m.Version
+	}
+	return res
+}
+
+func TestAutoMigrateSwitch(t *testing.T) {
+	old := conf
+	defer func() { conf = old }()
+	c := &Config{Host: "localhost", Port: "5432", User: "u", Password: "p", Db: "d"}
+	if err := c.Validate(); err != nil || c.AutoMigrate != "yes" {
+		t.Errorf("Validate() AutoMigrate = %s, %v; want yes", c.AutoMigrate, err)
+	}
+	// 关闭时不连接数据库直接跳过
+	c.AutoMigrate = "no"
+	conf = c
+	if err := AutoMigrate(context.Background(), &AuditLog{}); err != nil {
+		t.Errorf("AutoMigrate() disabled = %v; want nil", err)
+	}
+}
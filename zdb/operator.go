@@ -1,5 +1,11 @@
 package zdb
 
+import (
+	"github.com/bytedance/sonic"
+	"github.com/lib/pq"
+	"gorm.io/gorm/clause"
+)
+
 func LikeLeft(str string) string {
 	return str + "%"
 }
@@ -9,3 +15,89 @@ func LikeRight(str string) string {
 func LikeBetween(str string) string {
 	return "%" + str + "%"
 }
+
+// JSONContains
+// @Description: JSONB列包含v，即 column @> v，可使用GIN索引
+// @param column
+// @param v 按sonic序列化，如 map[string]any{"tags": []string{"vip"}}
+// @return clause.Expr
+func JSONContains[T any](column string, v T) clause.Expr {
+	s, err := sonic.MarshalString(v)
+	if err != nil {
+		s = "null"
+	}
+	return clause.Expr{SQL: "? @> ?::jsonb", Vars: []interface{}{clause.Column{Name: column}, s}}
+}
+
+// JSONHasKey
+// @Description: JSONB列存在顶层键key，即 column ? key
+// @param column
+// @param key
+// @return clause.Expression
+func JSONHasKey(column string, key string) clause.Expression {
+	return jsonKeys{column: column, op: "?", keys: []string{key}}
+}
+
+// JSONHasAnyKey
+// @Description: JSONB列存在任一顶层键，即 column ?| keys
+// @param column
+// @param keys
+// @return clause.Expression
+func JSONHasAnyKey(column string, keys ...string) clause.Expression {
+	return jsonKeys{column: column, op: "?|", keys: keys}
+}
+
+// JSONHasAllKeys
+// @Description: JSONB列存在所有顶层键，即 column ?& keys
+// @param column
+// @param keys
+// @return clause.Expression
+func JSONHasAllKeys(column string, keys ...string) clause.Expression {
+	return jsonKeys{column: column, op: "?&", keys: keys}
+}
+
+// jsonKeys
+// @Description: ?操作符与gorm占位符冲突，不能用clause.Expr拼接
+type jsonKeys struct {
+	column string
+	op     string
+	keys   []string
+}
+
+func (k jsonKeys) Build(builder clause.Builder) {
+	builder.WriteQuoted(clause.Column{Name: k.column})
+	builder.WriteString(" " + k.op + " ")
+	if k.op == "?" {
+		builder.AddVar(builder, k.keys[0])
+		return
+	}
+	builder.AddVar(builder, pq.StringArray(k.keys))
+	builder.WriteString("::text[]")
+}
+
+// ArrayOverlap
+// @Description: 数组列与values有交集，即 column && values，可使用GIN索引
+// @param column
+// @param values
+// @return clause.Expr
+func ArrayOverlap[T any](column string, values ...T) clause.Expr {
+	return clause.Expr{SQL: "? && ?", Vars: []interface{}{clause.Column{Name: column}, Array[T](values)}}
+}
+
+// ArrayContains
+// @Description: 数组列包含所有values，即 column @> values
+// @param column
+// @param values
+// @return clause.Expr
+func ArrayContains[T any](column string, values ...T) clause.Expr {
+	return clause.Expr{SQL: "? @> ?", Vars: []interface{}{clause.Column{Name: column}, Array[T](values)}}
+}
+
+// ArrayHas
+// @Description: 数组列包含v，即 v = ANY(column)
+// @param column
+// @param v
+// @return clause.Expr
+func ArrayHas[T any](column string, v T) clause.Expr {
+	return clause.Expr{SQL: "? = ANY(?)", Vars: []interface{}{v, clause.Column{Name: column}}}
+}
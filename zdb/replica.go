@@ -0,0 +1,240 @@
+package zdb
+
+import (
+	"context"
+	"database/sql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BalanceRoundRobin   = "round_robin"
+	BalanceLeastLatency = "least_latency"
+)
+
+// Replica
+// @Description: 只读副本，账号密码与主库一致
+type Replica struct {
+	Host string `json:"host" yaml:"host" validate:"required" note:"副本地址"`
+	Port string `json:"port" yaml:"port" validate:"required" note:"副本端口"`
+}
+
+// Primary
+// @Description: 强制走主库，用于对延迟敏感的读，如写后立即读、校验唯一性
+// @param ctx
+// @param args 数据库名，默认Config.Db
+// @return *gorm.DB
+func Primary(ctx context.Context, args ...string) *gorm.DB {
+	return DB(ctx, args...).Clauses(dbresolver.Write)
+}
+
+// replicaClosers
+// @Description: 主库*sql.DB -> func()，关闭副本连接池和延迟探测；按主库连接池索引，Debug()等会话后仍能找到
+var replicaClosers sync.Map
+
+// useReplicas
+// @Description: 注册读写分离，SELECT走副本，写入和事务走主库；副本连接池由closeDB一并关闭
+// @param db
+// @param config
+// @param database
+// @return error
+func useReplicas(db *gorm.DB, config Config, database string) error {
+	replicas := make([]gorm.Dialector, 0, len(config.Replicas))
+	pools := make([]*sql.DB, 0, len(config.Replicas))
+	var lp *latencyPolicy
+	closeReplicas := func() {
+		if lp != nil {
+			lp.Close()
+		}
+		for _, pool := range pools {
+			_ = pool.Close()
+		}
+	}
+	for _, r := range config.Replicas {
+		c := config
+		c.Host, c.Port = r.Host, r.Port
+		pool, err := sql.Open(DriverName, c.Dsn(database))
+		if err != nil {
+			closeReplicas()
+			return err
+		}
+		pools = append(pools, pool)
+		replicas = append(replicas, postgres.New(postgres.Config{Conn: pool}))
+	}
+	var policy dbresolver.Policy = dbresolver.StrictRoundRobinPolicy()
+	if config.Balance == BalanceLeastLatency {
+		lp = newLatencyPolicy()
+		policy = lp
+	}
+	resolver := dbresolver.Register(dbresolver.Config{
+		Replicas: replicas,
+		Policy:   policy,
+	}).
+		SetMaxIdleConns(config.MaxIdle).
+		SetMaxOpenConns(config.MaxAlive).
+		SetConnMaxLifetime(config.MaxAliveLife)
+	if err := db.Use(resolver); err != nil {
+		closeReplicas()
+		return err
+	}
+	if primary, err := db.DB(); err == nil {
+		replicaClosers.Store(primary, closeReplicas)
+	}
+	return registerSticky(db, config.StickyWindow)
+}
+
+// ========================= least latency =========================
+
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// latencyPolicy
+// @Description: 选择最近一次探测延迟最低的副本，每个副本后台每5秒探测一次，探测失败视为不可用；Close后停止探测
+type latencyPolicy struct {
+	latency sync.Map // gorm.ConnPool -> *atomic.Int64
+	every   time.Duration
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func newLatencyPolicy() *latencyPolicy {
+	return &latencyPolicy{every: 5 * time.Second, stop: make(chan struct{})}
+}
+
+// Close
+// @Description: 停止全部探测
+// @receiver p
+func (p *latencyPolicy) Close() {
+	p.once.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *latencyPolicy) Resolve(pools []gorm.ConnPool) gorm.ConnPool {
+	best, min := pools[0], int64(math.MaxInt64)
+	for _, pool := range pools {
+		if d := p.track(pool).Load(); d < min {
+			best, min = pool, d
+		}
+	}
+	return best
+}
+
+// track
+// @Description: 首次见到的连接池启动探测，探测结果出来前延迟为0，会被优先选中
+// @receiver p
+// @param pool
+// @return *atomic.Int64
+func (p *latencyPolicy) track(pool gorm.ConnPool) *atomic.Int64 {
+	if v, ok := p.latency.Load(pool); ok {
+		return v.(*atomic.Int64)
+	}
+	v, loaded := p.latency.LoadOrStore(pool, new(atomic.Int64))
+	d := v.(*atomic.Int64)
+	if pg, ok := pool.(pinger); ok && !loaded {
+		go p.probe(pg, d)
+	}
+	return d
+}
+
+func (p *latencyPolicy) probe(pg pinger, d *atomic.Int64) {
+	ticker := time.NewTicker(p.every)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		start := time.Now()
+		if err := pg.PingContext(ctx); err != nil {
+			d.Store(math.MaxInt64 - 1)
+		} else {
+			d.Store(int64(time.Since(start)))
+		}
+		cancel()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ========================= read your writes =========================
+
+type stickyKey struct{}
+
+type sticky struct {
+	lastWrite atomic.Int64
+}
+
+// WithSticky
+// @Description: 开启读己之写，同一ctx内写入后的StickyWindow内读取走主库，通常由请求中间件调用
+// @param ctx
+// @return context.Context
+func WithSticky(ctx context.Context) context.Context {
+	if stickyFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, stickyKey{}, new(sticky))
+}
+
+func stickyFrom(ctx context.Context) *sticky {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(stickyKey{}).(*sticky)
+	return s
+}
+
+// registerSticky
+// @Description: 写入成功后记录时间，读取前在窗口内则标记走主库；需在dbresolver之后注册，同为Before("*")时后注册的先执行
+// @param db
+// @param window
+// @return error
+func registerSticky(db *gorm.DB, window time.Duration) error {
+	mark := func(tx *gorm.DB) {
+		if tx.Error != nil || tx.Statement.Context == nil {
+			return
+		}
+		if s := stickyFrom(tx.Statement.Context); s != nil {
+			s.lastWrite.Store(time.Now().UnixNano())
+		}
+	}
+	route := func(tx *gorm.DB) {
+		if tx.Statement.Context == nil {
+			return
+		}
+		if s := stickyFrom(tx.Statement.Context); s != nil && time.Since(time.Unix(0, s.lastWrite.Load())) < window {
+			dbresolver.Write.ModifyStatement(tx.Statement)
+		}
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().After("*").Register("zdb:sticky_mark", mark),
+		cb.Update().After("*").Register("zdb:sticky_mark", mark),
+		cb.Delete().After("*").Register("zdb:sticky_mark", mark),
+		cb.Raw().After("*").Register("zdb:sticky_mark", func(tx *gorm.DB) {
+			if !isSelect(tx.Statement.SQL.String()) {
+				mark(tx)
+			}
+		}),
+		cb.Query().Before("*").Register("zdb:sticky_route", route),
+		cb.Row().Before("*").Register("zdb:sticky_route", route),
+		cb.Raw().Before("*").Register("zdb:sticky_route", route),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSelect(sql string) bool {
+	sql = strings.TrimSpace(sql)
+	return len(sql) >= 6 && strings.EqualFold(sql[:6], "select")
+}
@@ -0,0 +1,92 @@
+package zdb
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countPinger struct {
+	n atomic.Int32
+}
+
+func (p *countPinger) PingContext(ctx context.Context) error {
+	p.n.Add(1)
+	return nil
+}
+
+type fakePool struct {
+	gorm.ConnPool
+	name string
+}
+
+func TestLatencyPolicy(t *testing.T) {
+	a, b := &fakePool{name: "a"}, &fakePool{name: "b"}
+	p := newLatencyPolicy()
+	for pool, d := range map[*fakePool]int64{a: 30, b: 10} {
+		v := new(atomic.Int64)
+		v.Store(d)
+		p.latency.Store(gorm.ConnPool(pool), v)
+	}
+	if got := p.Resolve([]gorm.ConnPool{a, b}).(*fakePool); got != b {
+		t.Errorf("Resolve() = %s; want b", got.name)
+	}
+}
+
+func TestLatencyPolicyClose(t *testing.T) {
+	p := newLatencyPolicy()
+	p.every = 5 * time.Millisecond
+	pg := new(countPinger)
+	done := make(chan struct{})
+	go func() {
+		p.probe(pg, new(atomic.Int64))
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	p.Close()
+	p.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("probe still running after Close")
+	}
+	if pg.n.Load() == 0 {
+		t.Errorf("probe never pinged")
+	}
+}
+
+func TestWithSticky(t *testing.T) {
+	ctx := WithSticky(context.Background())
+	s := stickyFrom(ctx)
+	if s == nil {
+		t.Fatalf("stickyFrom() = nil")
+	}
+	if stickyFrom(WithSticky(ctx)) != s {
+		t.Errorf("WithSticky() twice created a new state")
+	}
+	if stickyFrom(context.Background()) != nil {
+		t.Errorf("stickyFrom(background) != nil")
+	}
+}
+
+func TestCloseReplicas(t *testing.T) {
+	db := dryRun(t)
+	c := Config{Host: "localhost", Port: "5432", User: "u", Password: "p", Db: "d", Replicas: []Replica{{Host: "replica", Port: "5432"}}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Balance = BalanceLeastLatency
+	if err := useReplicas(db, c, "d"); err != nil {
+		t.Fatalf("useReplicas() = %v", err)
+	}
+	primary, _ := db.DB()
+	if _, ok := replicaClosers.Load(primary); !ok {
+		t.Fatalf("replica closer not registered")
+	}
+	closeDB(db.Debug())
+	if _, ok := replicaClosers.Load(primary); ok {
+		t.Errorf("replica closer still registered after closeDB")
+	}
+}
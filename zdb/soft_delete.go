@@ -0,0 +1,81 @@
+package zdb
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+)
+
+// SoftDelete
+// @Description: 软删除，嵌入模型后Delete只写入删除时间和ctx中的操作人，查询自动排除已删除的记录
+type SoftDelete struct {
+	DeletedAt DeletedAt `json:"deleted_at,omitempty" gorm:"index;comment:删除时间"`
+	DeletedBy string    `json:"deleted_by,omitempty" gorm:"not null;default:'';comment:删除人"`
+}
+
+// DeletedAt
+// @Description: 与gorm.DeletedAt相同，删除时同时写入deleted_by列
+type DeletedAt struct {
+	gorm.DeletedAt
+}
+
+func (DeletedAt) DeleteClauses(f *schema.Field) []clause.Interface {
+	return []clause.Interface{softDeleteClause{SoftDeleteDeleteClause: gorm.SoftDeleteDeleteClause{Field: f}}}
+}
+
+type softDeleteClause struct {
+	gorm.SoftDeleteDeleteClause
+}
+
+// ModifyStatement
+// @Description: 同gorm.SoftDeleteDeleteClause，SET中追加deleted_by
+// @receiver sd
+// @param stmt
+func (sd softDeleteClause) ModifyStatement(stmt *gorm.Statement) {
+	var by *schema.Field
+	if stmt.Schema != nil {
+		by = stmt.Schema.LookUpField("deleted_by")
+	}
+	if by == nil || stmt.SQL.Len() > 0 || stmt.Unscoped {
+		sd.SoftDeleteDeleteClause.ModifyStatement(stmt)
+		return
+	}
+	curTime, actor := stmt.DB.NowFunc(), ActorFrom(stmt.Context)
+	stmt.AddClause(clause.Set{
+		{Column: clause.Column{Name: sd.Field.DBName}, Value: curTime},
+		{Column: clause.Column{Name: by.DBName}, Value: actor},
+	})
+	stmt.SetColumn(sd.Field.DBName, curTime, true)
+	stmt.SetColumn(by.DBName, actor, true)
+	where := func(rv reflect.Value) {
+		_, values := schema.GetIdentityFieldValuesMap(stmt.Context, rv, stmt.Schema.PrimaryFields)
+		column, vars := schema.ToQueryValues(stmt.Table, stmt.Schema.PrimaryFieldDBNames, values)
+		if len(vars) > 0 {
+			stmt.AddClause(clause.Where{Exprs: []clause.Expression{clause.IN{Column: column, Values: vars}}})
+		}
+	}
+	where(stmt.ReflectValue)
+	if stmt.ReflectValue.CanAddr() && stmt.Dest != stmt.Model && stmt.Model != nil {
+		where(reflect.ValueOf(stmt.Model))
+	}
+	gorm.SoftDeleteQueryClause{Field: sd.Field}.ModifyStatement(stmt)
+	stmt.AddClauseIfNotExists(clause.Update{})
+	stmt.Build(stmt.DB.Callback().Update().Clauses...)
+}
+
+// Restore
+// @Description: 恢复软删除的记录，如 zdb.Restore[User](ctx, "id = ?", id)
+// @param ctx
+// @param query
+// @param args
+// @return int64 恢复的行数
+// @return error
+func Restore[M any](ctx context.Context, query any, args ...any) (int64, error) {
+	tx := DB(ctx).Unscoped().Model(new(M)).
+		Where(query, args...).
+		Where("deleted_at IS NOT NULL").
+		Updates(map[string]any{"deleted_at": nil, "deleted_by": ""})
+	return tx.RowsAffected, tx.Error
+}
@@ -0,0 +1,362 @@
+package zdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TenantModeDatabase = "database" // 每租户一个库
+	TenantModeSchema   = "schema"   // 同库每租户一个schema，按search_path切换
+	TenantModeColumn   = "column"   // 共享表，按tenant_id列隔离
+)
+
+var (
+	ErrInvalidTenant  = errors.New("zdb: invalid tenant")
+	ErrNoTenant       = errors.New("zdb: tenant required")
+	ErrTenantMismatch = errors.New("zdb: tenant mismatch")
+)
+
+// TenantConfig
+// @Description: 多租户配置
+type TenantConfig struct {
+	Mode        string        `json:"mode" yaml:"mode" validate:"required,oneof=database schema column" note:"隔离方式,database/schema/column"`
+	Database    string        `json:"database" yaml:"database" note:"database模式的库名格式,%s为租户,默认 {Db}_%s"`
+	Schema      string        `json:"schema" yaml:"schema" note:"schema模式的schema格式,%s为租户,默认 tenant_%s"`
+	Column      string        `json:"column" yaml:"column" note:"column模式的租户列,默认tenant_id"`
+	MaxIdle     int           `json:"max_idle" yaml:"max_idle" note:"每租户最大闲置连接数,默认2"`
+	MaxAlive    int           `json:"max_alive" yaml:"max_alive" note:"每租户最大连接数,默认10"`
+	IdleTimeout time.Duration `json:"idle_timeout" yaml:"idle_timeout" note:"租户连接池闲置超过该时长后关闭,默认10m"`
+}
+
+func (c *TenantConfig) Validate(db string) {
+	c.Database = zutil.FirstTruth(c.Database, db+"_%s")
+	c.Schema = zutil.FirstTruth(c.Schema, "tenant_%s")
+	c.Column = zutil.FirstTruth(c.Column, "tenant_id")
+	c.MaxIdle = zutil.FirstTruth(c.MaxIdle, 2)
+	c.MaxAlive = zutil.FirstTruth(c.MaxAlive, 10)
+	c.IdleTimeout = zutil.FirstTruth(c.IdleTimeout, 10*time.Minute)
+}
+
+type tenantKey struct{}
+type skipTenantKey struct{}
+
+// tenantPattern
+// @Description: 租户会拼进库名和schema，只允许安全字符
+var tenantPattern = regexp.MustCompile(`^[a-zA-Z0-9_]{1,48}$`)
+
+// WithTenant
+// @Description: 把租户写入ctx，之后 zdb.DB(ctx) 自动选择租户的库、schema或追加租户条件
+// @param ctx
+// @param tenant
+// @return context.Context
+// @return error
+func WithTenant(ctx context.Context, tenant string) (context.Context, error) {
+	if !tenantPattern.MatchString(tenant) {
+		return ctx, ErrInvalidTenant
+	}
+	return context.WithValue(ctx, tenantKey{}, tenant), nil
+}
+
+// TenantFrom
+// @Description: ctx中的租户
+// @param ctx
+// @return string
+func TenantFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// TenantMode
+// @Description: 多租户隔离方式，未开启多租户时为空
+// @return string
+func TenantMode() string {
+	if conf == nil || conf.Tenant == nil {
+		return ""
+	}
+	return conf.Tenant.Mode
+}
+
+// WithoutTenant
+// @Description: column模式下跳过租户条件，用于跨租户的后台任务
+// @param ctx
+// @return context.Context
+func WithoutTenant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipTenantKey{}, true)
+}
+
+// dbKey
+// @Description: 连接池和事务的键；未指定库名时按ctx中的租户选择，schema模式为 库名/schema
+// @param ctx
+// @param name
+// @return string
+func dbKey(ctx context.Context, name string) string {
+	if name != "" {
+		return name
+	}
+	if conf.Tenant == nil {
+		return conf.Db
+	}
+	tenant := TenantFrom(ctx)
+	if tenant == "" {
+		return conf.Db
+	}
+	switch conf.Tenant.Mode {
+	case TenantModeDatabase:
+		return fmt.Sprintf(conf.Tenant.Database, tenant)
+	case TenantModeSchema:
+		return conf.Db + "/" + fmt.Sprintf(conf.Tenant.Schema, tenant)
+	}
+	return conf.Db
+}
+
+// openDB
+// @Description: 按连接池的键建立连接，租户库的连接数不超过租户限制
+// @param c
+// @param key
+// @return *gorm.DB
+// @return error
+func openDB(c Config, key string) (*gorm.DB, error) {
+	database, schema, _ := strings.Cut(key, "/")
+	if c.Tenant != nil && key != c.Db {
+		c.MaxIdle, c.MaxAlive = min(c.MaxIdle, c.Tenant.MaxIdle), min(c.MaxAlive, c.Tenant.MaxAlive)
+	}
+	if schema != "" {
+		c.Config += " search_path=" + schema
+	}
+	db, err := newDB(c, database)
+	if err != nil {
+		return nil, err
+	}
+	if c.Tenant != nil && c.Tenant.Mode == TenantModeColumn {
+		if err = registerTenantColumn(db, c.Tenant.Column); err != nil {
+			return nil, err
+		}
+	}
+	if err = registerVersion(db); err != nil {
+		return nil, err
+	}
+	if c.Audit == "yes" {
+		if err = registerAudit(db); err != nil {
+			return nil, err
+		}
+		// 租户独立库或schema时审计日志写在租户自己的库里，打开连接时建表
+		if c.Tenant != nil && c.Tenant.Mode != TenantModeColumn && key != c.Db {
+			if err = db.AutoMigrate(&AuditLog{}); err != nil {
+				return nil, fmt.Errorf("init audit log table for %s failed: %w", key, err)
+			}
+		}
+	}
+	if c.Encrypt != nil && c.Encrypt.BlindKey != "" {
+		if err = registerBlindIndex(db); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// ========================= idle eviction =========================
+
+var lastUsed sync.Map // key -> *atomic.Int64
+
+func touch(key string) {
+	if conf.Tenant == nil || key == conf.Db {
+		return
+	}
+	v, ok := lastUsed.Load(key)
+	if !ok {
+		v, _ = lastUsed.LoadOrStore(key, new(atomic.Int64))
+	}
+	v.(*atomic.Int64).Store(time.Now().UnixNano())
+}
+
+var evictOnce sync.Once
+
+// evictIdle
+// @Description: 定期摘除闲置租户的连接池，之后的 DB(ctx) 会新建连接池；
+// 摘除前已取到的句柄可能仍在使用，旧连接池在宽限期(IdleTimeout)后且没有使用中的连接时才关闭
+func evictIdle() {
+	evictOnce.Do(func() {
+		go func() {
+			for range time.NewTicker(conf.Tenant.IdleTimeout / 2).C {
+				deadline := time.Now().Add(-conf.Tenant.IdleTimeout).UnixNano()
+				lastUsed.Range(func(k, v any) bool {
+					if v.(*atomic.Int64).Load() > deadline {
+						return true
+					}
+					c, ok := conn.Load(k)
+					if !ok {
+						lastUsed.Delete(k)
+						return true
+					}
+					// 只摘除仍是该连接池的键，避免误删并发新建的连接池
+					if conn.CompareAndDelete(k, c) {
+						lastUsed.CompareAndDelete(k, v)
+						retire(k.(string), c.(*gorm.DB), conf.Tenant.IdleTimeout)
+					}
+					return true
+				})
+			}
+		}()
+	})
+}
+
+// retire
+// @Description: 宽限期后关闭已摘除的连接池，仍有使用中的连接时顺延
+// @param key
+// @param db
+// @param grace
+func retire(key string, db *gorm.DB, grace time.Duration) {
+	time.AfterFunc(grace, func() {
+		d, err := db.DB()
+		if err != nil {
+			return
+		}
+		if d.Stats().InUse > 0 {
+			retire(key, db, grace)
+			return
+		}
+		closeDB(db)
+		zlog.Infof("zdb closed idle tenant pool %s", key)
+	})
+}
+
+// ========================= column =========================
+
+// registerTenantColumn
+// @Description: 带租户列的模型在查询(含Row/Rows)、更新、删除时追加租户条件，创建时写入ctx中的租户；
+// 写入或更新为其他租户时报ErrTenantMismatch，ctx中没有租户且未调用WithoutTenant时报ErrNoTenant，避免越权。
+// Raw/Exec的SQL由调用方编写，不追加租户条件，需自行带上租户列
+// @param db
+// @param column
+// @return error
+func registerTenantColumn(db *gorm.DB, column string) error {
+	scope := func(tx *gorm.DB) {
+		field, tenant, ok := tenantField(tx, column)
+		if !ok {
+			return
+		}
+		tx.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: tx.Statement.Table, Name: field.DBName}, Value: tenant},
+		}})
+	}
+	update := func(tx *gorm.DB) {
+		field, tenant, ok := tenantField(tx, column)
+		if !ok {
+			return
+		}
+		if !sameTenant(tx.Statement, field, tenant, false) {
+			_ = tx.AddError(ErrTenantMismatch)
+			return
+		}
+		scope(tx)
+	}
+	fill := func(tx *gorm.DB) {
+		field, tenant, ok := tenantField(tx, column)
+		if !ok {
+			return
+		}
+		if !sameTenant(tx.Statement, field, tenant, true) {
+			_ = tx.AddError(ErrTenantMismatch)
+			return
+		}
+		tx.Statement.SetColumn(field.DBName, tenant, true)
+	}
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Query().Before("gorm:query").Register("zdb:tenant", scope),
+		cb.Row().Before("gorm:row").Register("zdb:tenant", scope),
+		cb.Update().Before("gorm:update").Register("zdb:tenant", update),
+		cb.Delete().Before("gorm:delete").Register("zdb:tenant", scope),
+		cb.Create().Before("gorm:create").Register("zdb:tenant", fill),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sameTenant
+// @Description: 语句写入的租户列为空或等于ctx中的租户；更新时只检查Dest，模型上查出的租户由条件保证
+// @param stmt
+// @param field
+// @param tenant
+// @param create
+// @return bool
+func sameTenant(stmt *gorm.Statement, field *schema.Field, tenant string, create bool) bool {
+	ok := true
+	check := func(v any) {
+		if s, _ := v.(string); s != "" && s != tenant {
+			ok = false
+		}
+	}
+	switch dest := stmt.Dest.(type) {
+	case map[string]interface{}:
+		check(dest[field.DBName])
+		check(dest[field.Name])
+		return ok
+	case []map[string]interface{}:
+		for _, m := range dest {
+			check(m[field.DBName])
+			check(m[field.Name])
+		}
+		return ok
+	}
+	rv := stmt.ReflectValue
+	if !create {
+		rv = reflect.Indirect(reflect.ValueOf(stmt.Dest))
+	}
+	each(rv, func(item reflect.Value) {
+		if item.Type() != stmt.Schema.ModelType {
+			return
+		}
+		v, zero := field.ValueOf(stmt.Context, item)
+		if !zero {
+			check(v)
+		}
+	})
+	return ok
+}
+
+// tenantField
+// @Description: 语句的模型是否有租户列，以及ctx中的租户
+// @param tx
+// @param column
+// @return *schema.Field
+// @return string
+// @return bool
+func tenantField(tx *gorm.DB, column string) (*schema.Field, string, bool) {
+	if tx.Statement.Schema == nil {
+		return nil, "", false
+	}
+	field := tx.Statement.Schema.LookUpField(column)
+	if field == nil {
+		return nil, "", false
+	}
+	ctx := tx.Statement.Context
+	if skip, _ := ctx.Value(skipTenantKey{}).(bool); skip {
+		return nil, "", false
+	}
+	tenant := TenantFrom(ctx)
+	if tenant == "" {
+		_ = tx.AddError(ErrNoTenant)
+		return nil, "", false
+	}
+	return field, tenant, true
+}
@@ -0,0 +1,107 @@
+package zdb
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDbKey(t *testing.T) {
+	conf = &Config{Db: "app"}
+	ctx, err := WithTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatalf("WithTenant(acme) = %v", err)
+	}
+	if _, err = WithTenant(context.Background(), "a;drop"); err != ErrInvalidTenant {
+		t.Errorf("WithTenant(a;drop) = %v; want %v", err, ErrInvalidTenant)
+	}
+	if got := dbKey(ctx, ""); got != "app" {
+		t.Errorf("dbKey() without tenant config = %s; want app", got)
+	}
+	cases := map[string]string{
+		TenantModeDatabase: "app_acme",
+		TenantModeSchema:   "app/tenant_acme",
+		TenantModeColumn:   "app",
+	}
+	for mode, want := range cases {
+		conf.Tenant = &TenantConfig{Mode: mode}
+		conf.Tenant.Validate(conf.Db)
+		if got := dbKey(ctx, ""); got != want {
+			t.Errorf("dbKey(%s) = %s; want %s", mode, got, want)
+		}
+		if got := dbKey(ctx, "other"); got != "other" {
+			t.Errorf("dbKey(%s, other) = %s; want other", mode, got)
+		}
+		if got := dbKey(context.Background(), ""); got != "app" {
+			t.Errorf("dbKey(%s) without tenant = %s; want app", mode, got)
+		}
+	}
+}
+
+type tenantOrder struct {
+	Id       int64
+	TenantId string
+	Title    string
+}
+
+func TestTenantColumn(t *testing.T) {
+	db := dryRun(t)
+	if err := registerTenantColumn(db, "tenant_id"); err != nil {
+		t.Fatalf("registerTenantColumn() = %v", err)
+	}
+	var rowSQL string
+	_ = db.Callback().Row().After("gorm:row").Register("test:capture", func(tx *gorm.DB) {
+		rowSQL = tx.Statement.SQL.String()
+	})
+	ctx, _ := WithTenant(context.Background(), "acme")
+	tx := db.WithContext(ctx)
+
+	cases := map[string]string{
+		"Find":   tx.Find(&[]tenantOrder{}).Statement.SQL.String(),
+		"Update": tx.Model(&tenantOrder{Id: 1}).Update("title", "a").Statement.SQL.String(),
+		"Delete": tx.Delete(&tenantOrder{Id: 1}).Statement.SQL.String(),
+	}
+	// DryRun下Row会报错，只取生成的SQL
+	_ = tx.Session(&gorm.Session{Logger: logger.Discard}).Model(&tenantOrder{}).Select("id").Row()
+	cases["Row"] = rowSQL
+	for name, sql := range cases {
+		if !strings.Contains(sql, `"tenant_orders"."tenant_id" = $`) {
+			t.Errorf("%s SQL = %s; want tenant condition", name, sql)
+		}
+	}
+
+	o := tenantOrder{Title: "a"}
+	if err := tx.Create(&o).Error; err != nil || o.TenantId != "acme" {
+		t.Errorf("Create() = %v, tenant %s; want acme", err, o.TenantId)
+	}
+	if err := tx.Create(&tenantOrder{TenantId: "other"}).Error; !errors.Is(err, ErrTenantMismatch) {
+		t.Errorf("Create(other tenant) = %v; want %v", err, ErrTenantMismatch)
+	}
+	if err := tx.Model(&tenantOrder{Id: 1}).Updates(map[string]any{"tenant_id": "other"}).Error; !errors.Is(err, ErrTenantMismatch) {
+		t.Errorf("Updates(other tenant) = %v; want %v", err, ErrTenantMismatch)
+	}
+	if err := db.Find(&[]tenantOrder{}).Error; !errors.Is(err, ErrNoTenant) {
+		t.Errorf("Find() without tenant = %v; want %v", err, ErrNoTenant)
+	}
+	if sql := db.WithContext(WithoutTenant(context.Background())).Find(&[]tenantOrder{}).Statement.SQL.String(); strings.Contains(sql, "tenant_id") {
+		t.Errorf("Find(WithoutTenant) SQL = %s; want no tenant condition", sql)
+	}
+}
+
+func TestRetire(t *testing.T) {
+	db := dryRun(t)
+	retire("acme", db, 10*time.Millisecond)
+	d, _ := db.DB()
+	// 宽限期内仍可使用
+	if err := d.PingContext(context.Background()); err != nil && strings.Contains(err.Error(), "database is closed") {
+		t.Fatalf("Ping() before grace = %v; want open", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := d.PingContext(context.Background()); err == nil || !strings.Contains(err.Error(), "database is closed") {
+		t.Errorf("Ping() after grace = %v; want database is closed", err)
+	}
+}
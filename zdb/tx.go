@@ -0,0 +1,221 @@
+package zdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"gorm.io/gorm"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// TxOptions
+// @Description: 事务参数，仅对最外层事务生效
+type TxOptions struct {
+	Db        string             `note:"数据库，默认Config.Db"`
+	Isolation sql.IsolationLevel `note:"隔离级别，默认数据库默认级别(READ COMMITTED)"`
+	ReadOnly  bool               `note:"只读事务"`
+	Retries   int                `note:"序列化失败(40001)和死锁(40P01)的重试次数，默认3，<0不重试"`
+}
+
+func (o *TxOptions) Validate() {
+	o.Retries = zutil.FirstTruth(o.Retries, 3)
+}
+
+type txKey struct{}
+
+// txState
+// @Description: 进行中的事务；事务连接上的语句不能并发执行，ctx不要跨goroutine执行SQL，钩子的注册有锁保护
+type txState struct {
+	db       *gorm.DB
+	database string
+
+	mu    sync.Mutex
+	depth int
+	hooks []func(ctx context.Context)
+}
+
+// txSet
+// @Description: ctx中按数据库保存的事务，跨库嵌套时外层事务仍可加入
+type txSet map[string]*txState
+
+// withTx
+// @Description: 复制ctx中已有的事务并加入st，不修改外层ctx
+// @param ctx
+// @param st
+// @return context.Context
+func withTx(ctx context.Context, st *txState) context.Context {
+	parent, _ := ctx.Value(txKey{}).(txSet)
+	set := make(txSet, len(parent)+1)
+	for k, v := range parent {
+		set[k] = v
+	}
+	set[st.database] = st
+	return context.WithValue(ctx, txKey{}, set)
+}
+
+func txFrom(ctx context.Context, database string) *txState {
+	if ctx == nil {
+		return nil
+	}
+	set, _ := ctx.Value(txKey{}).(txSet)
+	return set[database]
+}
+
+func (st *txState) addHook(fn func(ctx context.Context)) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.hooks = append(st.hooks, fn)
+}
+
+// Tx
+// @Description: 在事务中执行fn，事务保存在ctx中，fn内 zdb.DB(ctx) 自动加入该事务；
+// 嵌套调用使用保存点，内层失败只回滚到保存点；最外层遇到序列化失败或死锁时整体重试，fn需可重入
+// @param ctx
+// @param fn
+// @param ops
+// @return error
+func Tx(ctx context.Context, fn func(ctx context.Context) error, ops ...TxOptions) error {
+	o := TxOptions{}
+	if len(ops) > 0 {
+		o = ops[0]
+	}
+	o.Validate()
+	database := dbKey(ctx, o.Db)
+	if st := txFrom(ctx, database); st != nil {
+		return savepoint(ctx, st, fn)
+	}
+	for attempt := 0; ; attempt++ {
+		hooks, err := transaction(ctx, database, o, fn)
+		if err == nil {
+			for _, hook := range hooks {
+				hook(ctx)
+			}
+			return nil
+		}
+		if !retryable(err) || attempt >= o.Retries {
+			return err
+		}
+		wait := time.Duration(10<<attempt)*time.Millisecond + rand.N(10*time.Millisecond)
+		zlog.Warnf("tx retry %d after %s: %v", attempt+1, wait, err)
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// transaction
+// @Description: 执行一次最外层事务，提交成功后返回待执行的钩子
+// @param ctx
+// @param database
+// @param o
+// @param fn
+// @return []func(ctx context.Context)
+// @return error
+func transaction(ctx context.Context, database string, o TxOptions, fn func(ctx context.Context) error) (hooks []func(ctx context.Context), err error) {
+	tx := DB(ctx, database).Begin(&sql.TxOptions{Isolation: o.Isolation, ReadOnly: o.ReadOnly})
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	st := &txState{database: database}
+	ctx = withTx(ctx, st)
+	st.db = tx.WithContext(ctx)
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	if err = fn(ctx); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	committed = true
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.hooks, nil
+}
+
+// savepoint
+// @Description: 嵌套事务，失败时回滚到保存点并丢弃期间注册的钩子
+// @param ctx
+// @param st
+// @param fn
+// @return error
+func savepoint(ctx context.Context, st *txState, fn func(ctx context.Context) error) (err error) {
+	st.mu.Lock()
+	st.depth++
+	name := fmt.Sprintf("zdb_sp_%d", st.depth)
+	hooks := len(st.hooks)
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		st.depth--
+		st.mu.Unlock()
+	}()
+	if err = st.db.SavePoint(name).Error; err != nil {
+		return err
+	}
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			st.db.RollbackTo(name)
+			st.mu.Lock()
+			st.hooks = st.hooks[:hooks]
+			st.mu.Unlock()
+		}
+	}()
+	err = fn(ctx)
+	panicked = false
+	return err
+}
+
+// AfterCommit
+// @Description: 注册事务提交后执行的钩子，如发消息、删缓存；事务回滚或重试时不执行，不在事务中时立即执行
+// @param ctx
+// @param fn
+// @param args 数据库名，默认Config.Db
+func AfterCommit(ctx context.Context, fn func(ctx context.Context), args ...string) {
+	if st := txFrom(ctx, dbKey(ctx, firstArg(args))); st != nil {
+		st.addHook(fn)
+		return
+	}
+	fn(ctx)
+}
+
+// InTx
+// @Description: ctx是否在事务中
+// @param ctx
+// @param args 数据库名，默认Config.Db
+// @return bool
+func InTx(ctx context.Context, args ...string) bool {
+	return txFrom(ctx, dbKey(ctx, firstArg(args))) != nil
+}
+
+// retryable
+// @Description: 序列化失败和死锁可重试
+// @param err
+// @return bool
+func retryable(err error) bool {
+	var pe *pgconn.PgError
+	if errors.As(err, &pe) {
+		return pe.Code == "40001" || pe.Code == "40P01"
+	}
+	return false
+}
+
+func firstArg(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package zdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"testing"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := map[error]bool{
+		&pgconn.PgError{Code: "40001"}:                         true,
+		fmt.Errorf("wrap: %w", &pgconn.PgError{Code: "40P01"}): true,
+		&pgconn.PgError{Code: "23505"}:                         false,
+		fmt.Errorf("other"):                                    false,
+	}
+	for err, want := range cases {
+		if got := retryable(err); got != want {
+			t.Errorf("retryable(%v) = %v; want %v", err, got, want)
+		}
+	}
+}
+
+func TestAfterCommit(t *testing.T) {
+	conf = &Config{Db: "test"}
+	n := 0
+	AfterCommit(context.Background(), func(ctx context.Context) { n++ })
+	if n != 1 {
+		t.Errorf("AfterCommit() outside tx ran %d times; want 1", n)
+	}
+
+	st := &txState{database: "test"}
+	ctx := withTx(context.Background(), st)
+	AfterCommit(ctx, func(ctx context.Context) { n++ })
+	AfterCommit(ctx, func(ctx context.Context) { n++ }, "other")
+	if n != 2 || len(st.hooks) != 1 {
+		t.Errorf("AfterCommit() inside tx ran %d, queued %d; want 2, 1", n, len(st.hooks))
+	}
+	if !InTx(ctx) || InTx(ctx, "other") {
+		t.Errorf("InTx() mismatch")
+	}
+}
+
+func TestNestedTxOtherDatabase(t *testing.T) {
+	outer, inner := &txState{database: "a"}, &txState{database: "b"}
+	octx := withTx(context.Background(), outer)
+	ictx := withTx(octx, inner)
+	if txFrom(ictx, "a") != outer || txFrom(ictx, "b") != inner {
+		t.Errorf("txFrom(inner ctx) lost the outer transaction")
+	}
+	if txFrom(octx, "b") != nil {
+		t.Errorf("inner transaction leaked into the outer ctx")
+	}
+	// 同库嵌套时内层替换为新的事务状态
+	if again := (&txState{database: "a"}); txFrom(withTx(ictx, again), "a") != again {
+		t.Errorf("txFrom() did not return the innermost transaction")
+	}
+}
@@ -0,0 +1,113 @@
+package zdb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"strconv"
+)
+
+// Array
+// @Description: 一维数组列，元素支持字符串、整数、浮点、布尔及实现了Enumer的枚举；nil存为NULL，空切片存为{}
+type Array[T any] []T
+
+func (a Array[T]) GormDataType() string {
+	return "array"
+}
+
+func (a Array[T]) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return arrayType(reflect.TypeFor[T]())
+}
+
+func (a *Array[T]) Scan(value interface{}) error {
+	if value == nil {
+		*a = nil
+		return nil
+	}
+	var s pq.StringArray
+	if err := s.Scan(value); err != nil {
+		return err
+	}
+	arr := make(Array[T], len(s))
+	for i, e := range s {
+		if err := setString(reflect.ValueOf(&arr[i]).Elem(), e); err != nil {
+			return fmt.Errorf("zdb: array element %d: %w", i, err)
+		}
+	}
+	*a = arr
+	return nil
+}
+
+func (a Array[T]) Value() (driver.Value, error) {
+	if a == nil {
+		return nil, nil
+	}
+	return pq.GenericArray{A: []T(a)}.Value()
+}
+
+// arrayType
+// @Description: 元素类型对应的数组类型
+// @param t
+// @return string
+func arrayType(t reflect.Type) string {
+	if e, ok := reflect.Zero(t).Interface().(interface{ EnumName() string }); ok {
+		return e.EnumName() + "[]"
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "BOOLEAN[]"
+	case reflect.Int8, reflect.Int16, reflect.Uint8:
+		return "SMALLINT[]"
+	case reflect.Int32, reflect.Uint16:
+		return "INTEGER[]"
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return "BIGINT[]"
+	case reflect.Float32:
+		return "REAL[]"
+	case reflect.Float64:
+		return "DOUBLE PRECISION[]"
+	}
+	return "TEXT[]"
+}
+
+// setString
+// @Description: 按元素类型解析数组的文本元素
+// @param v
+// @param s
+// @return error
+func setString(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package zdb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/zohu/zfiber/zutil"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"unicode/utf8"
+)
+
+// Encrypted
+// @Description: 加密列，写入时用主密钥AES-GCM加密，读取时解密；零值存为NULL。
+// 接口输出默认脱敏，Reveal后输出明文；需要等值查询时加盲索引列：
+//
+//	Phone     zdb.Encrypted[string] `gorm:"blind:phone_bidx"`
+//	PhoneBidx string                `gorm:"index"`
+type Encrypted[T any] struct {
+	Data   T
+	reveal bool
+}
+
+func NewEncrypted[T any](data T) Encrypted[T] {
+	return Encrypted[T]{Data: data}
+}
+
+// Reveal
+// @Description: 接口输出明文
+// @receiver e
+// @return Encrypted[T]
+func (e Encrypted[T]) Reveal() Encrypted[T] {
+	e.reveal = true
+	return e
+}
+
+func (e Encrypted[T]) GormDataType() string {
+	return "encrypted"
+}
+
+func (e Encrypted[T]) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return "TEXT"
+}
+
+func (e *Encrypted[T]) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		*e = Encrypted[T]{}
+		return nil
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return fmt.Errorf("zdb: unsupported encrypted value %T", value)
+	}
+	plain, err := decrypt(s)
+	if err != nil {
+		return err
+	}
+	return decodePlain(plain, &e.Data)
+}
+
+func (e Encrypted[T]) Value() (driver.Value, error) {
+	if reflect.ValueOf(&e.Data).Elem().IsZero() {
+		return nil, nil
+	}
+	plain, err := encodePlain(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	return encrypt(plain)
+}
+
+// MarshalJSON
+// @Description: 字符串保留首尾约三分之一，其余类型输出******
+// @receiver e
+// @return []byte
+// @return error
+func (e Encrypted[T]) MarshalJSON() ([]byte, error) {
+	if e.reveal {
+		return sonic.Marshal(e.Data)
+	}
+	rv := reflect.ValueOf(e.Data)
+	if rv.Kind() == reflect.String {
+		s := rv.String()
+		return sonic.Marshal(zutil.Privacy(s, (utf8.RuneCountInString(s)+1)/3))
+	}
+	return sonic.Marshal(zutil.PrivacyMust("", 0, 6))
+}
+
+func (e *Encrypted[T]) UnmarshalJSON(b []byte) error {
+	return sonic.Unmarshal(b, &e.Data)
+}
+
+// blindIndex
+// @Description: 供盲索引回调计算，零值(存为NULL)时为空串
+// @receiver e
+// @return string
+// @return error
+func (e Encrypted[T]) blindIndex() (string, error) {
+	if reflect.ValueOf(&e.Data).Elem().IsZero() {
+		return "", nil
+	}
+	return blind(e.Data)
+}
+
+// encodePlain
+// @Description: 字符串直接加密，其余类型按sonic序列化
+// @param v
+// @return []byte
+// @return error
+func encodePlain(v any) ([]byte, error) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+		return []byte(rv.String()), nil
+	}
+	return sonic.Marshal(v)
+}
+
+func decodePlain(plain []byte, dest any) error {
+	if rv := reflect.ValueOf(dest).Elem(); rv.Kind() == reflect.String {
+		rv.SetString(string(plain))
+		return nil
+	}
+	return sonic.Unmarshal(plain, dest)
+}
@@ -0,0 +1,154 @@
+package zdb
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidEnum = errors.New("zdb: invalid enum value")
+
+// Enumer
+// @Description: 枚举类型，如
+//
+//	type OrderStatus string
+//	func (OrderStatus) EnumName() string { return "order_status" }
+//	func (OrderStatus) EnumValues() []OrderStatus { return []OrderStatus{"paid", "shipped"} }
+type Enumer[T any] interface {
+	~string
+	EnumName() string
+	EnumValues() []T
+}
+
+// Enum
+// @Description: 对应Postgres ENUM类型的列，读写时校验取值；空值存为NULL
+type Enum[T Enumer[T]] struct {
+	Data T
+}
+
+func NewEnum[T Enumer[T]](data T) Enum[T] {
+	return Enum[T]{Data: data}
+}
+
+// Valid
+// @Description: 是否为合法取值
+// @receiver e
+// @return bool
+func (e Enum[T]) Valid() bool {
+	return slices.Contains(e.Data.EnumValues(), e.Data)
+}
+
+func (e Enum[T]) GormDataType() string {
+	return "enum"
+}
+
+func (e Enum[T]) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return e.Data.EnumName()
+}
+
+func (e *Enum[T]) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*e = Enum[T]{}
+		return nil
+	case string:
+		e.Data = T(v)
+	case []byte:
+		e.Data = T(v)
+	default:
+		return fmt.Errorf("zdb: unsupported enum value %T", value)
+	}
+	if !e.Valid() {
+		return fmt.Errorf("%w: %s(%s)", ErrInvalidEnum, e.Data.EnumName(), e.Data)
+	}
+	return nil
+}
+
+func (e Enum[T]) Value() (driver.Value, error) {
+	if e.Data == "" {
+		return nil, nil
+	}
+	if !e.Valid() {
+		return nil, fmt.Errorf("%w: %s(%s)", ErrInvalidEnum, e.Data.EnumName(), e.Data)
+	}
+	return string(e.Data), nil
+}
+
+func (e Enum[T]) MarshalJSON() ([]byte, error) {
+	return sonic.Marshal(string(e.Data))
+}
+
+func (e *Enum[T]) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := sonic.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	e.Data = T(s)
+	if s != "" && !e.Valid() {
+		return fmt.Errorf("%w: %s(%s)", ErrInvalidEnum, e.Data.EnumName(), s)
+	}
+	return nil
+}
+
+// ========================= migration =========================
+
+var enums struct {
+	sync.Mutex
+	ensure []func(db *gorm.DB) error
+}
+
+// RegisterEnum
+// @Description: 注册枚举类型，zdb.New 在AutoMigrate和迁移之前创建类型并补充新增的取值
+func RegisterEnum[T Enumer[T]]() {
+	enums.Lock()
+	defer enums.Unlock()
+	enums.ensure = append(enums.ensure, EnsureEnum[T])
+}
+
+// EnsureEnum
+// @Description: 创建枚举类型，已存在时只追加缺少的取值；Postgres不支持删除取值，移除取值需手写迁移
+// @param db
+// @return error
+func EnsureEnum[T Enumer[T]](db *gorm.DB) error {
+	var zero T
+	name := db.Statement.Quote(zero.EnumName())
+	values := zero.EnumValues()
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = "'" + strings.ReplaceAll(string(v), "'", "''") + "'"
+	}
+	err := db.Exec(fmt.Sprintf(
+		"DO $$ BEGIN CREATE TYPE %s AS ENUM (%s); EXCEPTION WHEN duplicate_object THEN NULL; END $$;",
+		name, strings.Join(quoted, ", "),
+	)).Error
+	if err != nil {
+		return fmt.Errorf("create enum %s failed: %w", name, err)
+	}
+	for _, v := range quoted {
+		if err = db.Exec(fmt.Sprintf("ALTER TYPE %s ADD VALUE IF NOT EXISTS %s;", name, v)).Error; err != nil {
+			return fmt.Errorf("alter enum %s failed: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ensureEnums
+// @Description: 创建所有注册的枚举类型
+// @param db
+// @return error
+func ensureEnums(db *gorm.DB) error {
+	enums.Lock()
+	defer enums.Unlock()
+	for _, ensure := range enums.ensure {
+		if err := ensure(db); err != nil {
+			return err
+		}
+	}
+	return nil
+}
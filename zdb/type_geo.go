@@ -0,0 +1,434 @@
+package zdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/twpayne/go-geom"
+	"github.com/twpayne/go-geom/encoding/ewkb"
+	"github.com/twpayne/go-geom/encoding/geojson"
+	"github.com/twpayne/go-geom/encoding/wkt"
+	"github.com/zohu/zfiber/zutil"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// LineString
+// @Description: 线，数据库只存储WGS84，PointType仅决定JSON输出和Coords的坐标系
+type LineString struct {
+	ewkb.LineString
+	PointType PointType `json:"-"`
+}
+
+// Polygon
+// @Description: 多边形，第一个环为外环，其余为洞；数据库只存储WGS84
+type Polygon struct {
+	ewkb.Polygon
+	PointType PointType `json:"-"`
+}
+
+// MultiPoint
+// @Description: 点集，数据库只存储WGS84
+type MultiPoint struct {
+	ewkb.MultiPoint
+	PointType PointType `json:"-"`
+}
+
+// NewLineString
+// @Description: 按指定坐标系的经纬度创建
+// @param pt
+// @param coords [经度, 纬度]
+// @return *LineString
+func NewLineString(pt PointType, coords ...[2]float64) *LineString {
+	g := geom.NewLineStringFlat(geom.XY, flatWGS84(pt, coords))
+	return &LineString{LineString: ewkb.LineString{LineString: g}, PointType: pt}
+}
+
+// NewPolygon
+// @Description: 按指定坐标系的经纬度创建，未闭合的环自动闭合
+// @param pt
+// @param rings 第一个为外环
+// @return *Polygon
+func NewPolygon(pt PointType, rings ...[][2]float64) *Polygon {
+	var flat []float64
+	var ends []int
+	for _, ring := range rings {
+		if len(ring) > 0 && ring[0] != ring[len(ring)-1] {
+			ring = append(ring, ring[0])
+		}
+		flat = append(flat, flatWGS84(pt, ring)...)
+		ends = append(ends, len(flat))
+	}
+	g := geom.NewPolygonFlat(geom.XY, flat, ends)
+	return &Polygon{Polygon: ewkb.Polygon{Polygon: g}, PointType: pt}
+}
+
+// NewMultiPoint
+// @Description: 按指定坐标系的经纬度创建
+// @param pt
+// @param coords [经度, 纬度]
+// @return *MultiPoint
+func NewMultiPoint(pt PointType, coords ...[2]float64) *MultiPoint {
+	g := geom.NewMultiPointFlat(geom.XY, flatWGS84(pt, coords))
+	return &MultiPoint{MultiPoint: ewkb.MultiPoint{MultiPoint: g}, PointType: pt}
+}
+
+// ========================= LineString =========================
+
+func (l *LineString) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return "GEOGRAPHY(LineString)"
+}
+func (l *LineString) Scan(value interface{}) error {
+	b, err := geoBytes(value)
+	if err != nil || b == nil {
+		*l = LineString{}
+		return err
+	}
+	return l.LineString.Scan(b)
+}
+func (l *LineString) Value() (driver.Value, error) {
+	return l.LineString.Value()
+}
+func (l *LineString) GormValue(ctx context.Context, db *gorm.DB) clause.Expr {
+	if l.LineString.LineString == nil {
+		return clause.Expr{SQL: "NULL"}
+	}
+	return geoValue(l.LineString.LineString)
+}
+func (l LineString) MarshalJSON() ([]byte, error) {
+	if l.LineString.LineString == nil {
+		return []byte("null"), nil
+	}
+	return marshalGeo(l.LineString.LineString, l.PointType)
+}
+func (l *LineString) UnmarshalJSON(data []byte) error {
+	g, pt, err := unmarshalGeo[*geom.LineString](data)
+	if err != nil {
+		return err
+	}
+	*l = LineString{LineString: ewkb.LineString{LineString: g}, PointType: pt}
+	return nil
+}
+func (l *LineString) GCJ02() *LineString {
+	l.PointType = PointTypeGCJ02
+	return l
+}
+func (l *LineString) BD09() *LineString {
+	l.PointType = PointTypeBD09
+	return l
+}
+func (l *LineString) WGS84() *LineString {
+	l.PointType = PointTypeWGS84
+	return l
+}
+
+// Coords
+// @Description: PointType坐标系下的经纬度
+// @receiver l
+// @return [][2]float64
+func (l *LineString) Coords() [][2]float64 {
+	if l.LineString.LineString == nil {
+		return nil
+	}
+	return coords(l.LineString.LineString.FlatCoords(), l.LineString.LineString.Stride(), l.PointType)
+}
+
+// ========================= Polygon =========================
+
+func (p *Polygon) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return "GEOGRAPHY(Polygon)"
+}
+func (p *Polygon) Scan(value interface{}) error {
+	b, err := geoBytes(value)
+	if err != nil || b == nil {
+		*p = Polygon{}
+		return err
+	}
+	return p.Polygon.Scan(b)
+}
+func (p *Polygon) Value() (driver.Value, error) {
+	return p.Polygon.Value()
+}
+func (p *Polygon) GormValue(ctx context.Context, db *gorm.DB) clause.Expr {
+	if p.Polygon.Polygon == nil {
+		return clause.Expr{SQL: "NULL"}
+	}
+	return geoValue(p.Polygon.Polygon)
+}
+func (p Polygon) MarshalJSON() ([]byte, error) {
+	if p.Polygon.Polygon == nil {
+		return []byte("null"), nil
+	}
+	return marshalGeo(p.Polygon.Polygon, p.PointType)
+}
+func (p *Polygon) UnmarshalJSON(data []byte) error {
+	g, pt, err := unmarshalGeo[*geom.Polygon](data)
+	if err != nil {
+		return err
+	}
+	*p = Polygon{Polygon: ewkb.Polygon{Polygon: g}, PointType: pt}
+	return nil
+}
+func (p *Polygon) GCJ02() *Polygon {
+	p.PointType = PointTypeGCJ02
+	return p
+}
+func (p *Polygon) BD09() *Polygon {
+	p.PointType = PointTypeBD09
+	return p
+}
+func (p *Polygon) WGS84() *Polygon {
+	p.PointType = PointTypeWGS84
+	return p
+}
+
+// Rings
+// @Description: PointType坐标系下各环的经纬度
+// @receiver p
+// @return [][][2]float64
+func (p *Polygon) Rings() [][][2]float64 {
+	if p.Polygon.Polygon == nil {
+		return nil
+	}
+	var rings [][][2]float64
+	g := p.Polygon.Polygon
+	flat, start := g.FlatCoords(), 0
+	for _, end := range g.Ends() {
+		rings = append(rings, coords(flat[start:end], g.Stride(), p.PointType))
+		start = end
+	}
+	return rings
+}
+
+// ========================= MultiPoint =========================
+
+func (m *MultiPoint) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return "GEOGRAPHY(MultiPoint)"
+}
+func (m *MultiPoint) Scan(value interface{}) error {
+	b, err := geoBytes(value)
+	if err != nil || b == nil {
+		*m = MultiPoint{}
+		return err
+	}
+	return m.MultiPoint.Scan(b)
+}
+func (m *MultiPoint) Value() (driver.Value, error) {
+	return m.MultiPoint.Value()
+}
+func (m *MultiPoint) GormValue(ctx context.Context, db *gorm.DB) clause.Expr {
+	if m.MultiPoint.MultiPoint == nil {
+		return clause.Expr{SQL: "NULL"}
+	}
+	return geoValue(m.MultiPoint.MultiPoint)
+}
+func (m MultiPoint) MarshalJSON() ([]byte, error) {
+	if m.MultiPoint.MultiPoint == nil {
+		return []byte("null"), nil
+	}
+	return marshalGeo(m.MultiPoint.MultiPoint, m.PointType)
+}
+func (m *MultiPoint) UnmarshalJSON(data []byte) error {
+	g, pt, err := unmarshalGeo[*geom.MultiPoint](data)
+	if err != nil {
+		return err
+	}
+	*m = MultiPoint{MultiPoint: ewkb.MultiPoint{MultiPoint: g}, PointType: pt}
+	return nil
+}
+func (m *MultiPoint) GCJ02() *MultiPoint {
+	m.PointType = PointTypeGCJ02
+	return m
+}
+func (m *MultiPoint) BD09() *MultiPoint {
+	m.PointType = PointTypeBD09
+	return m
+}
+func (m *MultiPoint) WGS84() *MultiPoint {
+	m.PointType = PointTypeWGS84
+	return m
+}
+
+// Coords
+// @Description: PointType坐标系下的经纬度
+// @receiver m
+// @return [][2]float64
+func (m *MultiPoint) Coords() [][2]float64 {
+	if m.MultiPoint.MultiPoint == nil {
+		return nil
+	}
+	return coords(m.MultiPoint.MultiPoint.FlatCoords(), m.MultiPoint.MultiPoint.Stride(), m.PointType)
+}
+
+// ========================= helpers =========================
+
+// GeoJSON
+// @Description: 点的GeoJSON，坐标系同PointType
+// @receiver p
+// @return []byte
+// @return error
+func (p *Point) GeoJSON() ([]byte, error) {
+	if p.Point.Point == nil {
+		return []byte("null"), nil
+	}
+	return marshalGeo(p.Point.Point, p.PointType)
+}
+
+// wkt
+// @Description: WGS84坐标的WKT，用于查询参数
+// @receiver p
+// @return string
+func (p *Point) wkt() string {
+	s, _ := wkt.Marshal(p.Point.Point)
+	return s
+}
+
+// geoBytes
+// @Description: 驱动返回的EWKB，文本协议下为hex字符串
+// @param value
+// @return []byte
+// @return error
+func geoBytes(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return hex.DecodeString(v)
+	case []byte:
+		if b, err := hex.DecodeString(string(v)); err == nil {
+			return b, nil
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("zdb: unsupported geography value %T", value)
+}
+
+// geoValue
+// @Description: 写入时以WKT传参，由数据库转为geography
+// @param g 非nil
+// @return clause.Expr
+func geoValue(g geom.T) clause.Expr {
+	if g.Empty() {
+		return clause.Expr{SQL: "NULL"}
+	}
+	s, err := wkt.Marshal(g)
+	if err != nil {
+		return clause.Expr{SQL: "NULL"}
+	}
+	return clause.Expr{SQL: "ST_GeographyFromText(?)", Vars: []interface{}{s}}
+}
+
+// geoJSON
+// @Description: GeoJSON几何对象，point_type为扩展字段，缺省为WGS84
+type geoJSON struct {
+	Type        string           `json:"type"`
+	Coordinates *json.RawMessage `json:"coordinates"`
+	PointType   PointType        `json:"point_type,omitempty"`
+}
+
+// marshalGeo
+// @Description: 转为PointType坐标系后输出GeoJSON
+// @param g 非nil
+// @param pt
+// @return []byte
+// @return error
+func marshalGeo[G interface {
+	geom.T
+	Clone() G
+}](g G, pt PointType) ([]byte, error) {
+	c := g.Clone()
+	transform(c.FlatCoords(), c.Stride(), fromWGS84(pt))
+	gj, err := geojson.Encode(c)
+	if err != nil {
+		return nil, err
+	}
+	if pt == PointTypeWGS84 {
+		pt = ""
+	}
+	return sonic.Marshal(&geoJSON{Type: gj.Type, Coordinates: gj.Coordinates, PointType: pt})
+}
+
+// unmarshalGeo
+// @Description: 解析GeoJSON并转为WGS84
+// @param data
+// @return G
+// @return PointType 输入的坐标系
+// @return error
+func unmarshalGeo[G geom.T](data []byte) (G, PointType, error) {
+	var zero G
+	var head geoJSON
+	if err := sonic.Unmarshal(data, &head); err != nil {
+		return zero, "", err
+	}
+	var t geom.T
+	if err := geojson.Unmarshal(data, &t); err != nil {
+		return zero, "", err
+	}
+	g, ok := t.(G)
+	if !ok {
+		return zero, "", fmt.Errorf("zdb: unexpected geojson type %s", head.Type)
+	}
+	pt := zutil.FirstTruth(head.PointType, PointTypeWGS84)
+	transform(g.FlatCoords(), g.Stride(), toWGS84(pt))
+	return g, pt, nil
+}
+
+func toWGS84(pt PointType) func(x, y float64) (float64, float64) {
+	switch pt {
+	case PointTypeGCJ02:
+		return zutil.GCJ02toWGS84
+	case PointTypeBD09:
+		return zutil.BD09toWGS84
+	}
+	return nil
+}
+
+func fromWGS84(pt PointType) func(x, y float64) (float64, float64) {
+	switch pt {
+	case PointTypeGCJ02:
+		return zutil.WGS84toGCJ02
+	case PointTypeBD09:
+		return zutil.WGS84toBD09
+	}
+	return nil
+}
+
+// transform
+// @Description: 原地转换XY坐标
+// @param flat
+// @param stride 每个点的维数
+// @param fn 为nil时不转换
+func transform(flat []float64, stride int, fn func(x, y float64) (float64, float64)) {
+	if fn == nil {
+		return
+	}
+	for i := 0; i+1 < len(flat); i += stride {
+		flat[i], flat[i+1] = fn(flat[i], flat[i+1])
+	}
+}
+
+func flatWGS84(pt PointType, coords [][2]float64) []float64 {
+	flat := make([]float64, 0, len(coords)*2)
+	for _, c := range coords {
+		flat = append(flat, c[0], c[1])
+	}
+	transform(flat, 2, toWGS84(pt))
+	return flat
+}
+
+func coords(flat []float64, stride int, pt PointType) [][2]float64 {
+	fn := fromWGS84(pt)
+	res := make([][2]float64, 0, len(flat)/stride)
+	for i := 0; i+1 < len(flat); i += stride {
+		x, y := flat[i], flat[i+1]
+		if fn != nil {
+			x, y = fn(x, y)
+		}
+		res = append(res, [2]float64{x, y})
+	}
+	return res
+}
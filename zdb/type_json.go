@@ -0,0 +1,70 @@
+package zdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// JSON
+// @Description: JSONB列，Data按sonic序列化；接口输出时直接输出Data
+type JSON[T any] struct {
+	Data T
+}
+
+func NewJSON[T any](data T) JSON[T] {
+	return JSON[T]{Data: data}
+}
+
+func (j JSON[T]) GormDataType() string {
+	return "jsonb"
+}
+
+func (j JSON[T]) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return "JSONB"
+}
+
+func (j *JSON[T]) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*j = JSON[T]{}
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("zdb: unsupported jsonb value %T", value)
+	}
+	var data T
+	if err := sonic.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	j.Data = data
+	return nil
+}
+
+func (j JSON[T]) Value() (driver.Value, error) {
+	return sonic.MarshalString(j.Data)
+}
+
+func (j JSON[T]) GormValue(ctx context.Context, db *gorm.DB) clause.Expr {
+	s, err := sonic.MarshalString(j.Data)
+	if err != nil {
+		_ = db.AddError(err)
+	}
+	return clause.Expr{SQL: "?::jsonb", Vars: []interface{}{s}}
+}
+
+func (j JSON[T]) MarshalJSON() ([]byte, error) {
+	return sonic.Marshal(j.Data)
+}
+
+func (j *JSON[T]) UnmarshalJSON(b []byte) error {
+	return sonic.Unmarshal(b, &j.Data)
+}
@@ -0,0 +1,110 @@
+package zdb
+
+import (
+	"errors"
+	"github.com/bytedance/sonic"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type orderStatus string
+
+func (orderStatus) EnumName() string { return "order_status" }
+func (orderStatus) EnumValues() []orderStatus {
+	return []orderStatus{"paid", "shipped"}
+}
+
+type typedOrder struct {
+	Id     int64
+	Meta   JSON[map[string]any]
+	Tags   Array[string]
+	Status Enum[orderStatus]
+}
+
+func TestJSON(t *testing.T) {
+	j := NewJSON(map[string]int{"a": 1})
+	v, err := j.Value()
+	if err != nil || v != `{"a":1}` {
+		t.Errorf("JSON.Value() = %v, %v; want {\"a\":1}", v, err)
+	}
+	var got JSON[map[string]int]
+	if err = got.Scan([]byte(`{"a":2}`)); err != nil || got.Data["a"] != 2 {
+		t.Errorf("JSON.Scan() = %v, %v", got.Data, err)
+	}
+	if b, _ := sonic.Marshal(typedOrder{Meta: NewJSON(map[string]any{"k": "v"})}); !strings.Contains(string(b), `"Meta":{"k":"v"}`) {
+		t.Errorf("Marshal() = %s", b)
+	}
+}
+
+func TestArray(t *testing.T) {
+	v, err := Array[string]{"a", "b c", `d"`}.Value()
+	if err != nil || v != `{"a","b c","d\""}` {
+		t.Errorf("Array.Value() = %v, %v", v, err)
+	}
+	var ints Array[int32]
+	if err = ints.Scan("{1,2,3}"); err != nil || !reflect.DeepEqual(ints, Array[int32]{1, 2, 3}) {
+		t.Errorf("Array.Scan() = %v, %v", ints, err)
+	}
+	var bools Array[bool]
+	if err = bools.Scan([]byte("{t,f}")); err != nil || !reflect.DeepEqual(bools, Array[bool]{true, false}) {
+		t.Errorf("Array.Scan() = %v, %v", bools, err)
+	}
+	cases := map[string]string{
+		Array[string]{}.GormDBDataType(nil, nil):      "TEXT[]",
+		Array[int64]{}.GormDBDataType(nil, nil):       "BIGINT[]",
+		Array[float64]{}.GormDBDataType(nil, nil):     "DOUBLE PRECISION[]",
+		Array[orderStatus]{}.GormDBDataType(nil, nil): "order_status[]",
+	}
+	for got, want := range cases {
+		if got != want {
+			t.Errorf("GormDBDataType() = %s; want %s", got, want)
+		}
+	}
+}
+
+func TestEnum(t *testing.T) {
+	var e Enum[orderStatus]
+	if err := e.Scan("paid"); err != nil || e.Data != "paid" {
+		t.Errorf("Enum.Scan(paid) = %v, %v", e.Data, err)
+	}
+	if err := e.Scan("lost"); !errors.Is(err, ErrInvalidEnum) {
+		t.Errorf("Enum.Scan(lost) = %v; want %v", err, ErrInvalidEnum)
+	}
+	if err := sonic.Unmarshal([]byte(`"lost"`), &e); !errors.Is(err, ErrInvalidEnum) {
+		t.Errorf("Unmarshal(lost) = %v; want %v", err, ErrInvalidEnum)
+	}
+	if v, err := (Enum[orderStatus]{}).Value(); v != nil || err != nil {
+		t.Errorf("Enum{}.Value() = %v, %v; want nil", v, err)
+	}
+}
+
+func TestTypedOperators(t *testing.T) {
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatalf("open = %v", err)
+	}
+	cases := map[string]any{
+		`"meta" @> $1::jsonb`:  JSONContains("meta", map[string]any{"vip": true}),
+		`"meta" ? $1`:          JSONHasKey("meta", "vip"),
+		`"meta" ?| $1::text[]`: JSONHasAnyKey("meta", "a", "b"),
+		`"tags" && $1`:         ArrayOverlap("tags", "a", "b"),
+		`"tags" @> $1`:         ArrayContains("tags", "a"),
+		`$1 = ANY("status")`:   ArrayHas("status", orderStatus("paid")),
+	}
+	for want, expr := range cases {
+		tx := db.Where(expr).Find(&[]typedOrder{})
+		if tx.Error != nil {
+			t.Fatalf("Find() = %v", tx.Error)
+		}
+		stmt := tx.Statement
+		if !strings.Contains(stmt.SQL.String(), want) {
+			t.Errorf("SQL = %s; want contains %s", stmt.SQL.String(), want)
+		}
+		if len(stmt.Vars) != 1 {
+			t.Errorf("Vars(%s) = %v; want 1 var", want, stmt.Vars)
+		}
+	}
+}
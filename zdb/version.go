@@ -0,0 +1,135 @@
+package zdb
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+)
+
+var (
+	ErrConflict         = errors.New("zdb: version conflict")
+	ErrNoConflictTarget = errors.New("zdb: upsert requires conflict columns")
+)
+
+// Version
+// @Description: 乐观锁，嵌入模型后更新时追加 version = 读取时的版本 条件并把版本加1，
+// 没有更新到行时返回ErrConflict；版本为0(未读取记录)时不加锁。也可在自定义int64列上加 gorm:"optimistic" 标签
+type Version struct {
+	Version int64 `json:"version" gorm:"not null;default:1;optimistic;comment:版本号,乐观锁"`
+}
+
+const versionKey = "zdb:version"
+
+type versionState struct {
+	field *schema.Field
+	old   int64
+}
+
+// registerVersion
+// @Description: 注册乐观锁回调
+// @param db
+// @return error
+func registerVersion(db *gorm.DB) error {
+	cb := db.Callback().Update()
+	for _, err := range []error{
+		cb.Before("gorm:update").Register("zdb:version", versionBefore),
+		cb.After("gorm:update").Register("zdb:version_check", versionAfter),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionBefore
+// @Description: 追加版本条件并设置新版本，Select了列时把版本列加入更新
+// @param tx
+func versionBefore(tx *gorm.DB) {
+	stmt := tx.Statement
+	if tx.Error != nil || stmt.Schema == nil || !stmt.ReflectValue.IsValid() || stmt.ReflectValue.Kind() != reflect.Struct {
+		return
+	}
+	field := versionField(stmt.Schema)
+	if field == nil {
+		return
+	}
+	v, zero := field.ValueOf(stmt.Context, stmt.ReflectValue)
+	old, ok := v.(int64)
+	if zero || !ok {
+		return
+	}
+	// Omit了版本列时不加锁
+	selected, restricted := stmt.SelectAndOmitColumns(false, true)
+	if sel, ok := selected[field.DBName]; ok && !sel {
+		return
+	}
+	if restricted && !selected[field.DBName] {
+		stmt.Selects = append(stmt.Selects, field.DBName)
+	}
+	stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: old},
+	}})
+	stmt.SetColumn(field.DBName, old+1, true)
+	tx.InstanceSet(versionKey, versionState{field: field, old: old})
+}
+
+// versionAfter
+// @Description: 没有更新到行时视为冲突，并还原内存中的版本
+// @param tx
+func versionAfter(tx *gorm.DB) {
+	v, ok := tx.InstanceGet(versionKey)
+	if !ok || tx.Error != nil || tx.DryRun || tx.RowsAffected > 0 {
+		return
+	}
+	st := v.(versionState)
+	_ = st.field.Set(tx.Statement.Context, tx.Statement.ReflectValue, st.old)
+	_ = tx.AddError(ErrConflict)
+}
+
+func versionField(sch *schema.Schema) *schema.Field {
+	for _, f := range sch.Fields {
+		if _, ok := f.TagSettings["OPTIMISTIC"]; ok && f.DBName != "" {
+			return f
+		}
+	}
+	return nil
+}
+
+// Upsert
+// @Description: 插入，conflict列冲突时更新updates列，updates为空时忽略冲突；
+// 返回影响的行数，忽略冲突且已存在时为0
+// @param ctx
+// @param value 模型或模型切片
+// @param conflict 唯一约束的列
+// @param updates 冲突时更新的列
+// @return int64
+// @return error
+func Upsert(ctx context.Context, value any, conflict []string, updates ...string) (int64, error) {
+	if len(conflict) == 0 {
+		return 0, ErrNoConflictTarget
+	}
+	tx := DB(ctx).Clauses(upsertClause(conflict, updates)).Create(value)
+	return tx.RowsAffected, tx.Error
+}
+
+// upsertClause
+// @Description: ON CONFLICT子句
+// @param conflict
+// @param updates
+// @return clause.OnConflict
+func upsertClause(conflict, updates []string) clause.OnConflict {
+	c := clause.OnConflict{}
+	for _, col := range conflict {
+		c.Columns = append(c.Columns, clause.Column{Name: col})
+	}
+	if len(updates) == 0 {
+		c.DoNothing = true
+	} else {
+		c.DoUpdates = clause.AssignmentColumns(updates)
+	}
+	return c
+}
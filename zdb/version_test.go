@@ -0,0 +1,54 @@
+package zdb
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+type versionedDoc struct {
+	Id    int64
+	Title string
+	Md5   string `gorm:"unique"`
+	Version
+}
+
+func TestVersion(t *testing.T) {
+	db := dryRun(t)
+	if err := registerVersion(db); err != nil {
+		t.Fatalf("registerVersion() = %v", err)
+	}
+	doc := versionedDoc{Id: 1, Title: "a", Version: Version{Version: 3}}
+	stmt := db.Model(&doc).Select("title").Updates(&versionedDoc{Title: "b"}).Statement
+	sql := stmt.SQL.String()
+	for _, want := range []string{`"version"=$2`, `"version" = $3`} {
+		if !strings.Contains(sql, want) {
+			t.Errorf("Updates() SQL = %s; want contains %s", sql, want)
+		}
+	}
+	if len(stmt.Vars) < 3 || stmt.Vars[1] != int64(4) || stmt.Vars[2] != int64(3) {
+		t.Errorf("Updates() vars = %v; want version 4 where version 3", stmt.Vars)
+	}
+	// 未读取版本时不加锁
+	sql = db.Model(&versionedDoc{Id: 1}).Update("title", "c").Statement.SQL.String()
+	if strings.Contains(sql, `"version"`) {
+		t.Errorf("Update() without version SQL = %s; want no version", sql)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	if _, err := Upsert(context.Background(), &versionedDoc{}, nil); err != ErrNoConflictTarget {
+		t.Errorf("Upsert(no conflict) = %v; want %v", err, ErrNoConflictTarget)
+	}
+	db := dryRun(t)
+	cases := map[string][]string{
+		`ON CONFLICT ("md5") DO NOTHING`:                               nil,
+		`ON CONFLICT ("md5") DO UPDATE SET "title"="excluded"."title"`: {"title"},
+	}
+	for want, updates := range cases {
+		sql := db.Clauses(upsertClause([]string{"md5"}, updates)).Create(&versionedDoc{Md5: "x"}).Statement.SQL.String()
+		if !strings.Contains(sql, want) {
+			t.Errorf("upsertClause(%v) SQL = %s; want contains %s", updates, sql, want)
+		}
+	}
+}
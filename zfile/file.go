@@ -22,8 +22,8 @@ func New(conf Config) {
 		return
 	}
 	config = conf
-	// 如果可能，同步数据库表
-	if err := zdb.DB(context.TODO()).AutoMigrate(&ZfileRecord{}); err == nil {
+	// 如果可能，同步数据库表，zdb关闭AutoMigrate时需由迁移建表
+	if err := zdb.AutoMigrate(context.TODO(), &ZfileRecord{}); err == nil {
 		config.isPvMode = true
 	}
 	switch config.Provider {
@@ -58,24 +58,28 @@ func Upload(ctx context.Context, h *ReqUpload, r io.Reader) (*RespUpload, error)
 	}
 
 	if config.isPvMode {
-		var exist ZfileRecord
-		zdb.DB(ctx).Where("md5=?", md5).First(&exist)
-		if exist.Name != "" {
-			zlog.Debugf("file already exist in bucket, will cancel upload: %s", exist.Name)
-			_ = svr.delete(ctx, name)
-			return &RespUpload{
-				Name: config.FullName(h.Path, exist.Fid, ext),
-				Url:  config.HTTPDomain(exist.Name),
-				Md5:  md5,
-			}, nil
-		}
-		zdb.DB(ctx).Create(&ZfileRecord{
+		// md5唯一，冲突时保留已有记录，避免并发上传同一文件时先查后插的竞争
+		n, err := zdb.Upsert(ctx, &ZfileRecord{
 			Fid:    h.Fid,
 			Md5:    md5,
 			Bucket: config.Bucket,
 			Name:   name,
 			Expire: zutil.FirstTruth(h.IdleDays, config.IdleDays),
-		})
+		}, []string{"md5"})
+		if err != nil {
+			zlog.Warnf("save file record failed: %s %v", name, err)
+		} else if n == 0 {
+			var exist ZfileRecord
+			if zdb.Primary(ctx).Where("md5=?", md5).First(&exist).Error == nil && exist.Name != name {
+				zlog.Debugf("file already exist in bucket, will cancel upload: %s", exist.Name)
+				_ = svr.delete(ctx, name)
+				return &RespUpload{
+					Name: config.FullName(h.Path, exist.Fid, ext),
+					Url:  config.HTTPDomain(exist.Name),
+					Md5:  md5,
+				}, nil
+			}
+		}
 	}
 
 	return &RespUpload{
@@ -262,6 +262,14 @@ func strfnv32[K fmt.Stringer](key K) uint32 {
 	return fnv32(key.String())
 }
 
+// Fnv32
+// @Description: 分片使用的哈希函数，供其他分片结构复用
+// @param key
+// @return uint32
+func Fnv32(key string) uint32 {
+	return fnv32(key)
+}
+
 func fnv32(key string) uint32 {
 	hash := uint32(2166136261)
 	const prime32 = uint32(16777619)
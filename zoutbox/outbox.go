@@ -0,0 +1,154 @@
+package zoutbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/dromara/carbon/v2"
+	"github.com/zohu/zfiber/zdb"
+	"time"
+)
+
+const (
+	StatusPending = "pending"
+	StatusDone    = "done"
+	StatusDead    = "dead"
+)
+
+// Message
+// @Description: 待投递的事件，与业务数据在同一事务写入
+type Message struct {
+	Id           int64             `json:"id" gorm:"primaryKey"`
+	Topic        string            `json:"topic" gorm:"not null;comment:主题"`
+	AggregateKey string            `json:"aggregate_key" gorm:"not null;default:'';comment:聚合键,同键按写入顺序投递"`
+	Payload      string            `json:"payload" gorm:"type:jsonb;not null;comment:消息体"`
+	Headers      map[string]string `json:"headers,omitempty" gorm:"type:jsonb;serializer:json;comment:消息头"`
+	Status       string            `json:"status" gorm:"not null;default:pending;comment:状态,pending/done/dead"`
+	Attempts     int               `json:"attempts" gorm:"not null;default:0;comment:投递次数"`
+	NextAt       time.Time         `json:"next_at" gorm:"not null;comment:下次可投递时间"`
+	LastError    string            `json:"last_error" gorm:"not null;default:'';comment:最近一次失败原因"`
+	CreatedAt    carbon.DateTime   `json:"created_at"`
+	DeliveredAt  *carbon.DateTime  `json:"delivered_at,omitempty"`
+}
+
+func (Message) TableName() string {
+	return "outbox"
+}
+
+// Decode
+// @Description: 解析消息体
+// @receiver m
+// @param dst
+// @return error
+func (m *Message) Decode(dst any) error {
+	return sonic.UnmarshalString(m.Payload, dst)
+}
+
+// Migration
+// @Description: outbox表的迁移，版本号由业务指定，如 zdb.Register(zoutbox.Migration(20240101000000))
+// @param version
+// @return *zdb.Migration
+func Migration(version int64) *zdb.Migration {
+	return &zdb.Migration{
+		Version: version,
+		Name:    "zoutbox",
+		UpSQL: `CREATE TABLE IF NOT EXISTS outbox (
+	id            bigserial PRIMARY KEY,
+	topic         text        NOT NULL,
+	aggregate_key text        NOT NULL DEFAULT '',
+	payload       jsonb       NOT NULL,
+	headers       jsonb,
+	status        text        NOT NULL DEFAULT 'pending',
+	attempts      integer     NOT NULL DEFAULT 0,
+	next_at       timestamptz NOT NULL DEFAULT now(),
+	last_error    text        NOT NULL DEFAULT '',
+	created_at    timestamptz NOT NULL DEFAULT now(),
+	delivered_at  timestamptz
+);
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (next_at, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS outbox_aggregate_idx ON outbox (aggregate_key, id) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS outbox_done_idx ON outbox (delivered_at) WHERE status = 'done';`,
+		DownSQL: `DROP TABLE IF EXISTS outbox;`,
+	}
+}
+
+// Publish
+// @Description: 写入一条待投递消息，应在 zdb.Tx 内调用以与业务变更同时提交；提交后唤醒本实例的relay
+// 同一聚合键的写入方需互斥(如先更新聚合行)，否则并发事务的提交顺序与投递顺序可能不一致
+// @param ctx
+// @param topic
+// @param key 聚合键，为空不保证顺序
+// @param payload []byte/string/json.RawMessage原样写入，其他类型JSON序列化
+// @param headers
+// @return error
+func Publish(ctx context.Context, topic, key string, payload any, headers ...map[string]string) error {
+	if !tenantSupported() {
+		return ErrTenantUnsupported
+	}
+	var body string
+	switch p := payload.(type) {
+	case string:
+		body = p
+	case []byte:
+		body = string(p)
+	case json.RawMessage:
+		body = string(p)
+	default:
+		b, err := sonic.MarshalString(payload)
+		if err != nil {
+			return fmt.Errorf("zoutbox: marshal payload: %w", err)
+		}
+		body = b
+	}
+	m := &Message{
+		Topic:        topic,
+		AggregateKey: key,
+		Payload:      body,
+		Status:       StatusPending,
+		NextAt:       time.Now(),
+	}
+	if len(headers) > 0 {
+		m.Headers = headers[0]
+	}
+	if err := zdb.DB(ctx).Create(m).Error; err != nil {
+		return err
+	}
+	zdb.AfterCommit(ctx, func(ctx context.Context) {
+		if relay != nil {
+			relay.Wake()
+		}
+	})
+	return nil
+}
+
+// DeadLetters
+// @Description: 超过最大重试次数或永久失败的消息
+// @param ctx
+// @param limit
+// @return []Message
+// @return error
+func DeadLetters(ctx context.Context, limit int) ([]Message, error) {
+	var list []Message
+	err := zdb.Primary(ctx).Where("status = ?", StatusDead).Order("id").Limit(limit).Find(&list).Error
+	return list, err
+}
+
+// Requeue
+// @Description: 死信重新投递，重置投递次数
+// @param ctx
+// @param ids
+// @return int64 重新入队的条数
+// @return error
+func Requeue(ctx context.Context, ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res := zdb.DB(ctx).Model(&Message{}).
+		Where("id IN ? AND status = ?", ids, StatusDead).
+		Updates(map[string]any{"status": StatusPending, "attempts": 0, "next_at": time.Now(), "last_error": ""})
+	if res.Error == nil && relay != nil {
+		relay.Wake()
+	}
+	return res.RowsAffected, res.Error
+}
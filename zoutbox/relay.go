@@ -0,0 +1,301 @@
+package zoutbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zohu/zfiber/zants"
+	"github.com/zohu/zfiber/zdb"
+	"github.com/zohu/zfiber/zlog"
+	"github.com/zohu/zfiber/zutil"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Batch       int           `json:"batch" yaml:"batch" note:"每次认领的消息数,默认100"`
+	Interval    time.Duration `json:"interval" yaml:"interval" note:"轮询间隔,默认1s,本实例发布的消息提交后立即投递"`
+	Lease       time.Duration `json:"lease" yaml:"lease" note:"认领租期,超时未完成视为失败由其他实例重新认领,需大于投递超时,默认1m"`
+	MaxAttempts int           `json:"max_attempts" yaml:"max_attempts" note:"最大投递次数,超过进入死信,默认10"`
+	BackoffBase time.Duration `json:"backoff_base" yaml:"backoff_base" note:"重试退避基数,按次数指数增长,默认1s"`
+	BackoffMax  time.Duration `json:"backoff_max" yaml:"backoff_max" note:"重试退避上限,默认10m"`
+	Retention   time.Duration `json:"retention" yaml:"retention" note:"已投递消息保留时长,默认72h"`
+}
+
+func (c *Config) Validate() {
+	c.Batch = zutil.FirstTruth(c.Batch, 100)
+	c.Interval = zutil.FirstTruth(c.Interval, time.Second)
+	c.Lease = zutil.FirstTruth(c.Lease, time.Minute)
+	c.MaxAttempts = zutil.FirstTruth(c.MaxAttempts, 10)
+	c.BackoffBase = zutil.FirstTruth(c.BackoffBase, time.Second)
+	c.BackoffMax = zutil.FirstTruth(c.BackoffMax, 10*time.Minute)
+	c.Retention = zutil.FirstTruth(c.Retention, 72*time.Hour)
+}
+
+// Relay
+// @Description: 从outbox表认领消息投递到sink，多实例通过 FOR UPDATE SKIP LOCKED 分摊，至少投递一次
+type Relay struct {
+	conf   *Config
+	mu     sync.RWMutex
+	sinks  map[string]Sink
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	submit func(func()) error
+}
+
+var relay *Relay
+
+var (
+	ErrNotInit           = errors.New("zoutbox: relay not initialized")
+	ErrTenantUnsupported = errors.New("zoutbox: tenant database/schema mode is not supported")
+)
+
+// New
+// @Description: 创建并启动全局relay，投递任务提交到zants执行，需先初始化zants；
+// relay只认领默认库的outbox表，不支持database/schema模式的多租户
+// @param conf
+// @return *Relay
+func New(conf *Config) *Relay {
+	if !zants.Ready() {
+		zlog.Fatalf("init zoutbox failed: zants not initialized")
+		return nil
+	}
+	if !tenantSupported() {
+		zlog.Fatalf("init zoutbox failed: %v", ErrTenantUnsupported)
+		return nil
+	}
+	if conf == nil {
+		conf = new(Config)
+	}
+	conf.Validate()
+	relay = &Relay{
+		conf:   conf,
+		sinks:  make(map[string]Sink),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		submit: zants.TrySubmit,
+	}
+	go relay.run()
+	zlog.Infof("init zoutbox success, batch=%d", conf.Batch)
+	return relay
+}
+
+// Route
+// @Description: 全局relay注册主题的sink，需先调用New
+// @param topic
+// @param sink
+// @return error
+func Route(topic string, sink Sink) error {
+	if relay == nil {
+		return ErrNotInit
+	}
+	relay.Route(topic, sink)
+	return nil
+}
+
+// tenantSupported
+// @Description: 租户独立库或schema时消息写在租户库里，默认库的relay认领不到
+// @return bool
+func tenantSupported() bool {
+	mode := zdb.TenantMode()
+	return mode != zdb.TenantModeDatabase && mode != zdb.TenantModeSchema
+}
+
+// Route
+// @Description: 注册主题的sink，topic为*时作为默认sink；没有sink的消息按失败重试，最终进入死信
+// @receiver r
+// @param topic
+// @param sink
+// @return *Relay
+func (r *Relay) Route(topic string, sink Sink) *Relay {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sinks[topic] = sink
+	return r
+}
+
+func (r *Relay) sink(topic string) Sink {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s, ok := r.sinks[topic]; ok {
+		return s
+	}
+	return r.sinks["*"]
+}
+
+// Wake
+// @Description: 立即轮询一次
+// @receiver r
+func (r *Relay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop
+// @Description: 停止轮询并等待进行中的投递完成
+// @receiver r
+func (r *Relay) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+func (r *Relay) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.conf.Interval)
+	defer ticker.Stop()
+	var cleaned time.Time
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		// 同一聚合键每轮只认领队首，认领到消息时继续轮询直到取空
+		for {
+			n, err := r.poll(context.Background())
+			if err != nil {
+				zlog.Warnf("zoutbox poll failed: %v", err)
+			}
+			if n == 0 || err != nil || r.stopped() {
+				break
+			}
+		}
+		if time.Since(cleaned) > time.Hour {
+			cleaned = time.Now()
+			r.clean(context.Background())
+		}
+	}
+}
+
+func (r *Relay) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// claimSQL
+// @Description: 认领可投递的消息并延后next_at作为租约；有更早待投递消息的聚合键跳过，保证同键顺序
+const claimSQL = `UPDATE outbox SET next_at = now() + make_interval(secs => ?), attempts = attempts + 1
+WHERE id IN (
+	SELECT o.id FROM outbox o
+	WHERE o.status = 'pending' AND o.next_at <= now()
+	AND (o.aggregate_key = '' OR NOT EXISTS (
+		SELECT 1 FROM outbox p WHERE p.status = 'pending' AND p.aggregate_key = o.aggregate_key AND p.id < o.id
+	))
+	ORDER BY o.id LIMIT ? FOR UPDATE SKIP LOCKED
+)
+RETURNING *`
+
+// poll
+// @Description: 认领一批消息并发投递，等待全部完成；池拒绝时在当前goroutine投递
+// @receiver r
+// @param ctx
+// @return int 认领的条数
+// @return error
+func (r *Relay) poll(ctx context.Context) (int, error) {
+	var list []Message
+	if err := zdb.Primary(ctx).Raw(claimSQL, r.conf.Lease.Seconds(), r.conf.Batch).Scan(&list).Error; err != nil {
+		return 0, err
+	}
+	var wg sync.WaitGroup
+	for i := range list {
+		m := &list[i]
+		wg.Add(1)
+		task := func() {
+			defer wg.Done()
+			r.deliver(ctx, m)
+		}
+		if err := r.submit(task); err != nil {
+			zlog.Warnf("zoutbox submit %d failed, deliver inline: %v", m.Id, err)
+			task()
+		}
+	}
+	wg.Wait()
+	return len(list), nil
+}
+
+// deliver
+// @Description: 投递单条消息并记录结果
+// @receiver r
+// @param ctx
+// @param m
+func (r *Relay) deliver(ctx context.Context, m *Message) {
+	err := r.send(ctx, m)
+	db := zdb.Primary(ctx).Model(&Message{}).Where("id = ?", m.Id)
+	if err == nil {
+		err = db.Updates(map[string]any{"status": StatusDone, "delivered_at": time.Now(), "last_error": ""}).Error
+		if err != nil {
+			zlog.Warnf("zoutbox mark %d delivered failed: %v", m.Id, err)
+		}
+		return
+	}
+	values := map[string]any{"last_error": err.Error()}
+	if errors.Is(err, ErrPermanent) || m.Attempts >= r.conf.MaxAttempts {
+		values["status"] = StatusDead
+		zlog.Errorf("zoutbox message %d (%s) dead after %d attempts: %v", m.Id, m.Topic, m.Attempts, err)
+	} else {
+		values["next_at"] = time.Now().Add(r.backoff(m.Attempts))
+		zlog.Warnf("zoutbox message %d (%s) attempt %d failed: %v", m.Id, m.Topic, m.Attempts, err)
+	}
+	if err = db.Updates(values).Error; err != nil {
+		zlog.Warnf("zoutbox mark %d failed: %v", m.Id, err)
+	}
+}
+
+func (r *Relay) send(ctx context.Context, m *Message) (err error) {
+	sink := r.sink(m.Topic)
+	if sink == nil {
+		return fmt.Errorf("zoutbox: no sink for topic %s", m.Topic)
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("zoutbox: sink panic: %v", e)
+		}
+	}()
+	// 租约到期前必须返回，否则可能被其他实例重复投递
+	ctx, cancel := context.WithTimeout(ctx, r.conf.Lease)
+	defer cancel()
+	return sink.Deliver(ctx, m)
+}
+
+// backoff
+// @Description: 第n次失败后的等待时间，指数增长并加入最多10%的抖动
+// @receiver r
+// @param attempts
+// @return time.Duration
+func (r *Relay) backoff(attempts int) time.Duration {
+	d := r.conf.BackoffMax
+	if attempts < 31 {
+		d = min(r.conf.BackoffBase<<(max(attempts, 1)-1), r.conf.BackoffMax)
+	}
+	if d <= 0 {
+		d = r.conf.BackoffMax
+	}
+	return d + rand.N(d/10+1)
+}
+
+// clean
+// @Description: 删除超过保留时长的已投递消息
+// @receiver r
+// @param ctx
+func (r *Relay) clean(ctx context.Context) {
+	res := zdb.Primary(ctx).
+		Where("status = ? AND delivered_at < ?", StatusDone, time.Now().Add(-r.conf.Retention)).
+		Delete(&Message{})
+	if res.Error != nil {
+		zlog.Warnf("zoutbox clean failed: %v", res.Error)
+		return
+	}
+	if res.RowsAffected > 0 {
+		zlog.Infof("zoutbox cleaned %d delivered messages", res.RowsAffected)
+	}
+}
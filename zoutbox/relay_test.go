@@ -0,0 +1,83 @@
+package zoutbox
+
+import (
+	"context"
+	"errors"
+	"github.com/zohu/zfiber/zants"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	conf := &Config{BackoffBase: time.Second, BackoffMax: time.Minute}
+	conf.Validate()
+	r := &Relay{conf: conf}
+	cases := map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 10: time.Minute, 100: time.Minute}
+	for attempts, want := range cases {
+		if got := r.backoff(attempts); got < want || got > want+want/10 {
+			t.Errorf("backoff(%d) = %v; want [%v, %v]", attempts, got, want, want+want/10)
+		}
+	}
+}
+
+func TestSubmitWithoutPool(t *testing.T) {
+	ran := false
+	if err := zants.TrySubmit(func() { ran = true }); !errors.Is(err, zants.ErrNotInit) {
+		t.Errorf("TrySubmit() without pool = %v; want %v", err, zants.ErrNotInit)
+	}
+	if ran {
+		t.Errorf("TrySubmit() without pool ran the task")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	r := &Relay{sinks: make(map[string]Sink)}
+	if r.sink("a") != nil {
+		t.Errorf("sink(a) without routes != nil")
+	}
+	var got string
+	r.Route("a", SinkFunc(func(ctx context.Context, m *Message) error { got = "a"; return nil }))
+	r.Route("*", SinkFunc(func(ctx context.Context, m *Message) error { got = "*"; return nil }))
+	for topic, want := range map[string]string{"a": "a", "b": "*"} {
+		_ = r.sink(topic).Deliver(context.Background(), &Message{Topic: topic})
+		if got != want {
+			t.Errorf("sink(%s) routed to %s; want %s", topic, got, want)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sig := Sign("s3cret", r.Header.Get(HeaderTimestamp), `{"a":1}`); r.Header.Get(HeaderSignature) != sig {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL, "s3cret", time.Second)
+	m := &Message{Id: 1, Topic: "t", Payload: `{"a":1}`}
+	cases := map[int]struct{ ok, permanent bool }{
+		http.StatusOK:                  {true, false},
+		http.StatusServiceUnavailable:  {false, false},
+		http.StatusTooManyRequests:     {false, false},
+		http.StatusUnprocessableEntity: {false, true},
+	}
+	for code, want := range cases {
+		status = code
+		err := sink.Deliver(context.Background(), m)
+		if (err == nil) != want.ok || errors.Is(err, ErrPermanent) != want.permanent {
+			t.Errorf("Deliver() status %d = %v; want ok=%v permanent=%v", code, err, want.ok, want.permanent)
+		}
+	}
+}
+
+func TestRouteWithoutNew(t *testing.T) {
+	if err := Route("a", SinkFunc(func(ctx context.Context, m *Message) error { return nil })); !errors.Is(err, ErrNotInit) {
+		t.Errorf("Route() without New = %v; want %v", err, ErrNotInit)
+	}
+}
@@ -0,0 +1,166 @@
+package zoutbox
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/bytedance/sonic"
+	"github.com/valkey-io/valkey-go"
+	"github.com/zohu/zfiber/zch"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrPermanent
+// @Description: sink返回包装了该错误的错误时不再重试，直接进入死信
+var ErrPermanent = errors.New("zoutbox: permanent failure")
+
+// Permanent
+// @Description: 标记为永久失败
+// @param err
+// @return error
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// Sink
+// @Description: 投递目标，返回nil视为投递成功；可能重复投递，消费方需按Message.Id幂等
+type Sink interface {
+	Deliver(ctx context.Context, m *Message) error
+}
+
+// SinkFunc
+// @Description: 进程内处理函数
+type SinkFunc func(ctx context.Context, m *Message) error
+
+func (f SinkFunc) Deliver(ctx context.Context, m *Message) error {
+	return f(ctx, m)
+}
+
+// ========================= valkey stream =========================
+
+type streamSink struct {
+	v      valkey.Client
+	prefix string
+	maxLen int64
+}
+
+// NewStreamSink
+// @Description: 写入valkey stream，键为 prefix+topic
+// @param client 为nil时使用zch的客户端
+// @param prefix
+// @param maxLen 近似裁剪的最大长度，0不裁剪
+// @return Sink
+func NewStreamSink(client valkey.Client, prefix string, maxLen int64) Sink {
+	if client == nil {
+		client = zch.V()
+	}
+	return &streamSink{v: client, prefix: prefix, maxLen: maxLen}
+}
+
+func (s *streamSink) Deliver(ctx context.Context, m *Message) error {
+	// 构建器不可复用，两条分支各自从B()开始
+	cmd := s.v.B().Xadd().Key(s.prefix + m.Topic).Id("*").FieldValue()
+	if s.maxLen > 0 {
+		cmd = s.v.B().Xadd().Key(s.prefix + m.Topic).Maxlen().Almost().Threshold(strconv.FormatInt(s.maxLen, 10)).Id("*").FieldValue()
+	}
+	fields := s.fields(m)
+	for i := 0; i < len(fields); i += 2 {
+		cmd = cmd.FieldValue(fields[i], fields[i+1])
+	}
+	return s.v.Do(ctx, cmd.Build()).Error()
+}
+
+func (s *streamSink) fields(m *Message) []string {
+	fields := []string{
+		"id", strconv.FormatInt(m.Id, 10),
+		"topic", m.Topic,
+		"key", m.AggregateKey,
+		"payload", m.Payload,
+	}
+	if len(m.Headers) > 0 {
+		h, _ := sonic.MarshalString(m.Headers)
+		fields = append(fields, "headers", h)
+	}
+	return fields
+}
+
+// ========================= webhook =========================
+
+const (
+	HeaderId        = "X-Outbox-Id"
+	HeaderTopic     = "X-Outbox-Topic"
+	HeaderKey       = "X-Outbox-Key"
+	HeaderTimestamp = "X-Outbox-Timestamp"
+	HeaderSignature = "X-Outbox-Signature"
+)
+
+type webhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// NewWebhookSink
+// @Description: 以POST投递消息体，消息头原样透传；secret非空时附带签名 hex(hmac_sha256(secret, timestamp + "." + body))；
+// 2xx视为成功，408/429/5xx重试，其余4xx进入死信
+// @param url
+// @param secret
+// @param timeout 默认10s
+// @return Sink
+func NewWebhookSink(url, secret string, timeout time.Duration) Sink {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &webhookSink{url: url, secret: secret, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *webhookSink) Deliver(ctx context.Context, m *Message) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(m.Payload))
+	if err != nil {
+		return Permanent(err)
+	}
+	for k, v := range m.Headers {
+		req.Header.Set(k, v)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderId, strconv.FormatInt(m.Id, 10))
+	req.Header.Set(HeaderTopic, m.Topic)
+	req.Header.Set(HeaderKey, m.AggregateKey)
+	req.Header.Set(HeaderTimestamp, ts)
+	if s.secret != "" {
+		req.Header.Set(HeaderSignature, Sign(s.secret, ts, m.Payload))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return fmt.Errorf("zoutbox: webhook status %d", resp.StatusCode)
+	}
+	return Permanent(fmt.Errorf("webhook status %d", resp.StatusCode))
+}
+
+// Sign
+// @Description: webhook签名，接收方用于校验
+// @param secret
+// @param timestamp
+// @param body
+// @return string
+func Sign(secret, timestamp, body string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "." + body))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -10,3 +10,18 @@ func TestRandomStr(t *testing.T) {
 		t.Log(RandomStr(6))
 	}
 }
+
+func TestHost(t *testing.T) {
+	cases := map[string]string{
+		"example.com":                   "example.com",
+		"https://example.com":           "example.com",
+		"http://api.example.com:8080/a": "api.example.com",
+		"example.com:443":               "example.com",
+		".example.com":                  ".example.com",
+	}
+	for in, want := range cases {
+		if got := Host(in); got != want {
+			t.Errorf("Host(%s) = %s; want %s", in, got, want)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/bytedance/sonic"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
 func FirstTruth[T any](args ...T) T {
@@ -69,3 +70,17 @@ func When[T any](condition bool, trueValue, falseValue T) T {
 	}
 	return falseValue
 }
+
+// Host
+// @Description: 从域名或地址中提取主机名，去掉协议、端口和路径，如 https://example.com:8080/a -> example.com
+// @param domain
+// @return string
+func Host(domain string) string {
+	if i := strings.Index(domain, "://"); i >= 0 {
+		domain = domain[i+3:]
+	}
+	if i := strings.IndexAny(domain, ":/"); i >= 0 {
+		domain = domain[:i]
+	}
+	return domain
+}